@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"aether/internal/horizon/db"
+)
+
+// Audit log. Mutating handlers snapshot the rows they touch with auditRow
+// before and after the change and call recordAudit, which stores the fields
+// that changed. Any other successful non-GET request under /api/ still gets
+// a bare entry from auditMutation, so nothing an admin does goes unrecorded.
+// Entries older than audit_retention_days are pruned.
+
+// Columns never written to the log. A change still shows up, as "[redacted]".
+var auditRedacted = map[string]bool{
+	"master_key":    true,
+	"password_hash": true,
+	"private_key":   true,
+	"enigma_key":    true,
+	"token_hash":    true,
+	"totp_secret":   true,
+}
+
+// Columns holding inbound JSON, logged with their secret fields redacted
+var auditInbounds = map[string]bool{
+	"raw_inbounds": true,
+}
+
+type auditFieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+type auditCtxKey struct{}
+
+// auditState tracks whether the handler recorded its own entry.
+type auditState struct {
+	recorded bool
+}
+
+// auditRow snapshots one row as column -> value, or returns nil if it does
+// not exist.
+func auditRow(table, idColumn string, id interface{}) map[string]interface{} {
+	rows, err := db.DB.Query("SELECT * FROM "+table+" WHERE "+idColumn+"=?", id)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	cols, _ := rows.Columns()
+	if !rows.Next() {
+		return nil
+	}
+	values := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if rows.Scan(ptrs...) != nil {
+		return nil
+	}
+	snap := make(map[string]interface{}, len(cols))
+	for i, col := range cols {
+		if b, ok := values[i].([]byte); ok {
+			values[i] = string(b)
+		}
+		snap[col] = values[i]
+	}
+	return snap
+}
+
+// auditList snapshots the values of a link-table query (node configs, user
+// groups) as {key: [...]}.
+func auditList(key, query string, id interface{}) map[string]interface{} {
+	list := []interface{}{}
+	if rows, err := db.DB.Query(query, id); err == nil {
+		for rows.Next() {
+			var v interface{}
+			if rows.Scan(&v) == nil {
+				if b, ok := v.([]byte); ok {
+					v = string(b)
+				}
+				list = append(list, v)
+			}
+		}
+		rows.Close()
+	}
+	return map[string]interface{}{key: list}
+}
+
+// auditRowWith is auditRow plus an auditList of the row's links.
+func auditRowWith(table, idColumn string, id interface{}, key, query string) map[string]interface{} {
+	snap := auditRow(table, idColumn, id)
+	if snap == nil {
+		return nil
+	}
+	snap[key] = auditList(key, query, id)[key]
+	return snap
+}
+
+// auditValue is a snapshot value as it may be logged.
+func auditValue(key string, v interface{}) interface{} {
+	if raw, ok := v.(string); ok && auditInbounds[key] {
+		return redactInbounds(raw)
+	}
+	return v
+}
+
+// auditDiff returns the fields that differ between two snapshots. A nil
+// snapshot stands for a row that did not exist.
+func auditDiff(before, after map[string]interface{}) map[string]auditFieldChange {
+	changes := map[string]auditFieldChange{}
+	for key, old := range before {
+		old = auditValue(key, old)
+		nv, ok := after[key]
+		if nv = auditValue(key, nv); !ok || !reflect.DeepEqual(old, nv) {
+			changes[key] = auditFieldChange{Before: old, After: nv}
+		}
+	}
+	for key, nv := range after {
+		if _, ok := before[key]; !ok {
+			changes[key] = auditFieldChange{After: auditValue(key, nv)}
+		}
+	}
+	for key, c := range changes {
+		if auditRedacted[key] {
+			if c.Before != nil {
+				c.Before = "[redacted]"
+			}
+			if c.After != nil {
+				c.After = "[redacted]"
+			}
+			changes[key] = c
+		}
+	}
+	return changes
+}
+
+// recordAudit logs action (e.g. "user.update") on an entity by the request's
+// admin. before and after are snapshots from auditRow; either may be nil.
+func recordAudit(r *http.Request, action, entity string, entityID interface{}, before, after map[string]interface{}) {
+	if st, ok := r.Context().Value(auditCtxKey{}).(*auditState); ok {
+		st.recorded = true
+	}
+	var adminID, tokenID int
+	var username string
+	if a := currentAdmin(r); a != nil {
+		adminID, tokenID, username = a.ID, a.TokenID, a.Username
+	}
+	changes, _ := json.Marshal(auditDiff(before, after))
+	_, err := db.DB.Exec(`
+		INSERT INTO audit_log (created_at, admin_id, admin_username, token_id, action, entity, entity_id, changes, ip)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, time.Now().Unix(), adminID, username, tokenID, action, entity, auditString(entityID), string(changes), auditIP(r))
+	if err != nil {
+		log.Println("Audit Error:", err)
+	}
+}
+
+func auditString(v interface{}) string {
+	switch id := v.(type) {
+	case string:
+		return id
+	case int:
+		return strconv.Itoa(id)
+	case int64:
+		return strconv.FormatInt(id, 10)
+	}
+	return ""
+}
+
+// fromLoopback reports whether r came from loopback, where the admin
+// panel's proxy runs; only then are its X-Forwarded-* headers trusted.
+func fromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// auditIP is the client address, from X-Forwarded-For behind the proxy.
+// Only the last entry is the proxy's own; the ones before it are whatever
+// the client sent.
+func auditIP(r *http.Request) string {
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 && fromLoopback(r) {
+		hops := strings.Split(fwd[len(fwd)-1], ",")
+		if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+type auditStatusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditStatusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// auditMutation serves a mutating request and, if it succeeded without the
+// handler recording anything, logs the method and path.
+func auditMutation(next http.Handler, w http.ResponseWriter, r *http.Request) {
+	st := &auditState{}
+	r = r.WithContext(context.WithValue(r.Context(), auditCtxKey{}, st))
+	sw := &auditStatusWriter{ResponseWriter: w, status: http.StatusOK}
+	next.ServeHTTP(sw, r)
+	if st.recorded || sw.status >= 400 || r.URL.Path == "/api/auth/logout" {
+		return
+	}
+	entity := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/"), "/", 2)[0]
+	recordAudit(r, strings.ToLower(r.Method)+" "+r.URL.Path, entity, r.URL.Query().Get("id"), nil, nil)
+}
+
+// auditRetention is how long entries are kept; 0 keeps them forever.
+func auditRetention() time.Duration {
+	days, err := strconv.Atoi(getSetting("audit_retention_days"))
+	if err != nil || days < 0 {
+		days = 90
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func startAuditPruner() {
+	pruneAuditLog()
+	ticker := time.NewTicker(1 * time.Hour)
+	for range ticker.C {
+		pruneAuditLog()
+	}
+}
+
+func pruneAuditLog() {
+	keep := auditRetention()
+	if keep == 0 {
+		return
+	}
+	db.DB.Exec("DELETE FROM audit_log WHERE created_at < ?", time.Now().Add(-keep).Unix())
+}
+
+type auditEntry struct {
+	ID            int64                       `json:"id"`
+	CreatedAt     int64                       `json:"created_at"`
+	AdminID       int                         `json:"admin_id"`
+	AdminUsername string                      `json:"admin_username"`
+	TokenID       int                         `json:"token_id"` // API token used, 0 for a login session
+	Action        string                      `json:"action"`
+	Entity        string                      `json:"entity"`
+	EntityID      string                      `json:"entity_id"`
+	Changes       map[string]auditFieldChange `json:"changes"`
+	IP            string                      `json:"ip"`
+}
+
+// GET /api/audit - newest first. Filters: admin (username), admin_id, token_id, action
+// (prefix, e.g. "user."), entity, entity_id, since, until (unix), limit
+// (default 100, max 1000) and offset.
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	q := r.URL.Query()
+	var where []string
+	var args []interface{}
+	filter := func(clause, value string) {
+		if value != "" {
+			where = append(where, clause)
+			args = append(args, value)
+		}
+	}
+	filter("admin_username = ?", q.Get("admin"))
+	filter("admin_id = ?", q.Get("admin_id"))
+	filter("token_id = ?", q.Get("token_id"))
+	filter("entity = ?", q.Get("entity"))
+	filter("entity_id = ?", q.Get("entity_id"))
+	filter("created_at >= ?", q.Get("since"))
+	filter("created_at <= ?", q.Get("until"))
+	if action := q.Get("action"); action != "" {
+		where = append(where, "action LIKE ? ESCAPE '\\'")
+		args = append(args, strings.NewReplacer("%", "\\%", "_", "\\_").Replace(action)+"%")
+	}
+
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	query := "SELECT id, created_at, admin_id, admin_username, token_id, action, entity, entity_id, changes, ip FROM audit_log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	rows, err := db.DB.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer rows.Close()
+
+	list := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var changes string
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.AdminID, &e.AdminUsername, &e.TokenID, &e.Action, &e.Entity, &e.EntityID, &changes, &e.IP); err != nil {
+			continue
+		}
+		json.Unmarshal([]byte(changes), &e.Changes)
+		list = append(list, e)
+	}
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"aether/internal/horizon/db"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Admin authentication. Admins log in with a username and bcrypt password
+// and get a random session token, sent back as the horizon_session cookie
+// (for the web panel) and in the body (for scripts, as a Bearer token). Only
+// the SHA-256 of a token is stored. Everything under /api/ requires a session
+// except login itself and the public device API. Failed logins are throttled
+// (see login_throttle.go).
+//
+// The cookie is Secure when the request came over TLS, through the loopback
+// proxy with X-Forwarded-Proto: https, or always with HORIZON_SECURE_COOKIE=true.
+
+const sessionCookie = "horizon_session"
+
+// Paths under /api/ that stay open. /sub lives outside /api/ and is public.
+var publicAPIPaths = map[string]bool{
+	"/api/auth/login":    true,
+	"/api/v1/secure":     true,
+	"/api/v1/secure/key": true,
+}
+
+type Admin struct {
+	ID          int     `json:"id"`
+	Username    string  `json:"username"`
+	Role        string  `json:"role"` // See rbac.go
+	MaxUsers    int     `json:"max_users"`
+	MaxTotalGB  float64 `json:"max_total_gb"`
+	CreatedAt   int64   `json:"created_at"`
+	LastLoginAt int64   `json:"last_login_at"`
+	TOTPEnabled bool    `json:"totp_enabled"` // See mfa.go
+
+	verifiedAt int64 // Last login or step-up of the session
+
+	// Set when the request came with an API token (see tokens.go)
+	TokenID int      `json:"token_id,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"`
+}
+
+type adminCtxKey struct{}
+
+// currentAdmin returns the admin a request was authenticated as.
+func currentAdmin(r *http.Request) *Admin {
+	a, _ := r.Context().Value(adminCtxKey{}).(*Admin)
+	return a
+}
+
+// requireAdmin guards the /api/ routes of next with a session or API token
+// and the role and scope checks.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/") || publicAPIPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var a *Admin
+		var err error
+		if token := sessionToken(r); strings.HasPrefix(token, apiTokenPrefix) {
+			a, err = adminFromAPIToken(token, r)
+		} else {
+			a, err = adminFromSession(token)
+		}
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !roleAllows(a, r) || (a.TokenID != 0 && !scopeAllows(a.Scopes, r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !mfaAllows(a, w, r) {
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), adminCtxKey{}, a))
+		if r.Method == "GET" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		auditMutation(next, w, r)
+	})
+}
+
+// sessionToken reads the token from the Authorization header or the cookie.
+func sessionToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		return c.Value
+	}
+	return ""
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func adminFromSession(token string) (*Admin, error) {
+	if token == "" {
+		return nil, sql.ErrNoRows
+	}
+	a := &Admin{}
+	err := db.DB.QueryRow(`
+		SELECT a.id, a.username, a.role, a.max_users, a.max_total_gb, a.created_at, a.last_login_at, a.totp_enabled, s.verified_at
+		FROM admin_sessions s
+		JOIN admins a ON s.admin_id = a.id
+		WHERE s.token_hash=? AND s.expires_at > ? AND a.disabled = 0
+	`, hashToken(token), time.Now().Unix()).Scan(&a.ID, &a.Username, &a.Role, &a.MaxUsers, &a.MaxTotalGB, &a.CreatedAt, &a.LastLoginAt,
+		&a.TOTPEnabled, &a.verifiedAt)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// sessionTTL is how long a login lasts.
+func sessionTTL() time.Duration {
+	hours, err := strconv.Atoi(getSetting("admin_session_hours"))
+	if err != nil || hours <= 0 {
+		hours = 12
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// Compared against when the username is unknown, so both cases cost a bcrypt.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("horizon"), bcrypt.DefaultCost)
+
+// POST /api/auth/login - {"username", "password", "code"}. The code (TOTP or
+// recovery) is only needed once 2FA is enabled; without it the 401 carries
+// X-Horizon-MFA: required.
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	keys := loginKeys(r, req.Username)
+	if loginThrottled(w, keys) {
+		return
+	}
+
+	var id int
+	var hash string
+	var totpEnabled bool
+	err := db.DB.QueryRow("SELECT id, password_hash, totp_enabled FROM admins WHERE username=? AND disabled = 0", req.Username).Scan(&id, &hash, &totpEnabled)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(req.Password))
+		loginLimiter.fail(keys)
+		http.Error(w, "Invalid username or password", 401)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+		loginLimiter.fail(keys)
+		http.Error(w, "Invalid username or password", 401)
+		return
+	}
+	if totpEnabled {
+		if req.Code == "" {
+			w.Header().Set(mfaHeader, "required")
+			http.Error(w, "Two-factor code required", 401)
+			return
+		}
+		if verifyAdminCode(id, req.Code) != nil {
+			loginLimiter.fail(keys)
+			w.Header().Set(mfaHeader, "required")
+			http.Error(w, "Invalid two-factor code", 401)
+			return
+		}
+	}
+	loginLimiter.reset(keys)
+
+	token, expiresAt, err := createSession(id, r)
+	if err != nil {
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: sessionCookie, Value: token, Path: "/",
+		Expires: time.Unix(expiresAt, 0), HttpOnly: true, Secure: secureCookie(r), SameSite: http.SameSiteStrictMode,
+	})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token": token, "expires_at": expiresAt, "username": req.Username,
+	})
+}
+
+// secureCookie reports whether the session cookie gets the Secure flag.
+func secureCookie(r *http.Request) bool {
+	if r.TLS != nil || os.Getenv("HORIZON_SECURE_COOKIE") == "true" {
+		return true
+	}
+	return fromLoopback(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+func createSession(adminID int, r *http.Request) (string, int64, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", 0, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+	expiresAt := now.Add(sessionTTL()).Unix()
+
+	// Expired sessions are swept on login rather than by a background job
+	db.DB.Exec("DELETE FROM admin_sessions WHERE expires_at <= ?", now.Unix())
+	_, err := db.DB.Exec(`
+		INSERT INTO admin_sessions (token_hash, admin_id, created_at, expires_at, user_agent, verified_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, hashToken(token), adminID, now.Unix(), expiresAt, r.UserAgent(), now.Unix())
+	if err != nil {
+		return "", 0, err
+	}
+	db.DB.Exec("UPDATE admins SET last_login_at=? WHERE id=?", now.Unix(), adminID)
+	return token, expiresAt, nil
+}
+
+// POST /api/auth/logout
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	db.DB.Exec("DELETE FROM admin_sessions WHERE token_hash=?", hashToken(sessionToken(r)))
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: secureCookie(r)})
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
+
+// GET /api/auth/me
+func handleAuthMe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentAdmin(r))
+}
+
+func createAdmin(username, password, role string) error {
+	if username == "" || len(password) < 8 {
+		return errors.New("username is required and the password needs at least 8 characters")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.Exec("INSERT INTO admins (username, password_hash, role, created_at) VALUES (?, ?, ?, ?)",
+		username, string(hash), role, time.Now().Unix())
+	return err
+}
+
+// runCreateAdmin backs the -create-admin flag and creates an owner. The
+// password comes from HORIZON_ADMIN_PASSWORD or, failing that, the first
+// line of stdin.
+func runCreateAdmin(username string) error {
+	password := os.Getenv("HORIZON_ADMIN_PASSWORD")
+	if password == "" {
+		fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	return createAdmin(username, password, roleOwner)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"aether/internal/horizon/db"
+	"aether/internal/horizon/secrets"
+)
+
+// Backups. A snapshot is taken with the SQLite online backup API (see
+// db.Backup), gzipped and, with backup_encrypt, sealed under the KEK. The
+// scheduler saves one every backup_interval_hours into HORIZON_BACKUP_DIR
+// (default "backups") and keeps the newest backup_keep.
+//
+// A restore only swaps a file in once it is a Horizon database no newer
+// than this build, passes SQLite's integrity check and has secrets that open
+// with the current KEK. It is then migrated to the current schema.
+
+const backupPrefix = "horizon-"
+
+// Restores are uploaded whole; this is far above any real panel database
+const maxRestoreBytes = 2 << 30
+
+type backupFile struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	CreatedAt int64  `json:"created_at"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+func backupDir() string {
+	if dir := os.Getenv("HORIZON_BACKUP_DIR"); dir != "" {
+		return dir
+	}
+	return "backups"
+}
+
+func isBackupName(name string) bool {
+	return strings.HasPrefix(name, backupPrefix) && (strings.HasSuffix(name, ".db.gz") || strings.HasSuffix(name, ".db.gz.enc"))
+}
+
+// writeBackup streams a compressed (and, if encrypt, sealed) snapshot to w.
+func writeBackup(w io.Writer, encrypt bool) error {
+	tmp, err := os.CreateTemp("", "horizon-snapshot-*.db")
+	if err != nil {
+		return err
+	}
+	path := tmp.Name()
+	tmp.Close()
+	defer func() {
+		for _, p := range []string{path, path + "-wal", path + "-shm"} {
+			os.Remove(p)
+		}
+	}()
+	if err := db.Backup(path); err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out := w
+	var enc io.WriteCloser
+	if encrypt {
+		if enc, err = secrets.NewWriter(w); err != nil {
+			return err
+		}
+		out = enc
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, f); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if enc != nil {
+		return enc.Close()
+	}
+	return nil
+}
+
+// saveBackup writes a snapshot into the backup directory and returns its name.
+func saveBackup() (string, error) {
+	dir := backupDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	encrypt := getSetting("backup_encrypt") == "true"
+	name := backupPrefix + time.Now().UTC().Format("20060102-150405") + ".db.gz"
+	if encrypt {
+		name += ".enc"
+	}
+
+	// Written under a temporary name so a crash never leaves half a backup
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	err = writeBackup(f, encrypt)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return "", err
+	}
+	return name, os.Rename(path+".tmp", path)
+}
+
+// listBackups returns the saved backups, newest first.
+func listBackups() ([]backupFile, error) {
+	entries, err := os.ReadDir(backupDir())
+	if os.IsNotExist(err) {
+		return []backupFile{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := []backupFile{}
+	for _, e := range entries {
+		if e.IsDir() || !isBackupName(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, backupFile{
+			Name:      e.Name(),
+			Size:      info.Size(),
+			CreatedAt: info.ModTime().Unix(),
+			Encrypted: strings.HasSuffix(e.Name(), ".enc"),
+		})
+	}
+	// Names carry a UTC timestamp, so they sort by age
+	sort.Slice(list, func(i, j int) bool { return list[i].Name > list[j].Name })
+	return list, nil
+}
+
+func rotateBackups() {
+	keep, err := strconv.Atoi(getSetting("backup_keep"))
+	if err != nil || keep <= 0 {
+		return
+	}
+	list, err := listBackups()
+	if err != nil || len(list) <= keep {
+		return
+	}
+	for _, b := range list[keep:] {
+		if err := os.Remove(filepath.Join(backupDir(), b.Name)); err != nil {
+			log.Println("❌ Backup Rotation Failed:", err)
+		}
+	}
+}
+
+func startBackupScheduler() {
+	runScheduledBackup()
+	ticker := time.NewTicker(10 * time.Minute)
+	for range ticker.C {
+		runScheduledBackup()
+	}
+}
+
+// runScheduledBackup saves a backup if the newest one is older than
+// backup_interval_hours, so the schedule survives restarts.
+func runScheduledBackup() {
+	hours, err := strconv.Atoi(getSetting("backup_interval_hours"))
+	if err != nil || hours <= 0 {
+		return
+	}
+	list, err := listBackups()
+	if err != nil {
+		log.Println("❌ Backup Failed:", err)
+		return
+	}
+	if len(list) > 0 && time.Since(time.Unix(list[0].CreatedAt, 0)) < time.Duration(hours)*time.Hour {
+		return
+	}
+	name, err := saveBackup()
+	if err != nil {
+		log.Println("❌ Backup Failed:", err)
+		return
+	}
+	log.Println("💾 Backup saved:", name)
+	rotateBackups()
+}
+
+// restoreBackup validates a backup (as written by writeBackup, or a plain
+// SQLite file) and swaps it in for the live database.
+func restoreBackup(r io.Reader) error {
+	br := bufio.NewReader(r)
+	if header, _ := br.Peek(16); secrets.IsStream(header) {
+		dec, err := secrets.NewReader(br)
+		if err != nil {
+			return err
+		}
+		br = bufio.NewReader(dec)
+	}
+	var src io.Reader = br
+	header, err := br.Peek(16)
+	if err != nil && err != io.EOF {
+		return err // A damaged or truncated encrypted stream
+	}
+	if len(header) >= 2 && header[0] == 0x1f && header[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		src = gz
+	} else if !strings.HasPrefix(string(header), "SQLite format 3") {
+		return errors.New("not a Horizon backup")
+	}
+
+	tmp, err := os.CreateTemp("", "horizon-restore-*.db")
+	if err != nil {
+		return err
+	}
+	path := tmp.Name()
+	defer func() {
+		for _, p := range []string{path, path + "-wal", path + "-shm"} {
+			os.Remove(p)
+		}
+	}()
+	_, err = io.Copy(tmp, src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := checkBackup(path); err != nil {
+		return err
+	}
+	if err := db.Restore(path); err != nil {
+		return err
+	}
+	// Backups from older builds are brought up to date; plaintext secrets
+	// from before encryption at rest get sealed.
+	if err := db.Migrate(); err != nil {
+		return err
+	}
+	sealSecretsAtRest()
+	return nil
+}
+
+// checkBackup refuses a database this build can't run on.
+func checkBackup(path string) error {
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var integrity string
+	if err := conn.QueryRow("PRAGMA integrity_check").Scan(&integrity); err != nil {
+		return fmt.Errorf("not a Horizon backup: %w", err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("backup is damaged: %s", integrity)
+	}
+	version, err := db.Version(conn)
+	if err != nil {
+		return err
+	}
+	if version > db.LatestVersion() {
+		return fmt.Errorf("backup is from a newer Horizon (schema %d, this build knows up to %d)", version, db.LatestVersion())
+	}
+	_, err = rewriteSecrets(conn, func(value string) (string, error) {
+		_, err := secrets.Open(value)
+		return value, err
+	})
+	if err != nil {
+		return fmt.Errorf("backup secrets do not open with the current key-encryption key: %w", err)
+	}
+	return nil
+}
+
+// runRestore backs "horizon restore <file>".
+func runRestore(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return restoreBackup(f)
+}
+
+// GET  /api/backup - saved backups, newest first
+// POST /api/backup - streams a new snapshot; ?encrypt=true|false overrides
+// backup_encrypt. Owners only, behind a step-up (see mfa.go).
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	if currentAdmin(r).Role != roleOwner {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		list, err := listBackups()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case "POST":
+		encrypt := getSetting("backup_encrypt") == "true"
+		if v := r.URL.Query().Get("encrypt"); v != "" {
+			encrypt = v == "true"
+		}
+		name := backupPrefix + time.Now().UTC().Format("20060102-150405") + ".db.gz"
+		contentType := "application/gzip"
+		if encrypt {
+			name += ".enc"
+			contentType = "application/octet-stream"
+		}
+		recordAudit(r, "backup.download", "backup", name, nil, nil)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		if err := writeBackup(w, encrypt); err != nil {
+			// Headers are gone by now; the client sees a short download
+			log.Println("❌ Backup Failed:", err)
+		}
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// POST /api/backup/restore - the request body is a backup file, or
+// ?name= restores a saved one. Owners only, behind a step-up.
+func handleBackupRestore(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if currentAdmin(r).Role != roleOwner {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+
+	var src io.Reader = http.MaxBytesReader(w, r.Body, maxRestoreBytes)
+	name := r.URL.Query().Get("name")
+	if name != "" {
+		// Only names from the backup directory listing, never a path
+		if !isBackupName(name) || filepath.Base(name) != name {
+			http.Error(w, "Backup not found", 404)
+			return
+		}
+		f, err := os.Open(filepath.Join(backupDir(), name))
+		if err != nil {
+			http.Error(w, "Backup not found", 404)
+			return
+		}
+		defer f.Close()
+		src = f
+	}
+
+	if err := restoreBackup(src); err != nil {
+		http.Error(w, "Restore Failed: "+err.Error(), 400)
+		return
+	}
+	// Recorded in the restored database
+	recordAudit(r, "backup.restore", "backup", name, nil, nil)
+	log.Println("♻️ Database restored from backup", name)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
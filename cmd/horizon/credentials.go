@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"aether/internal/horizon/db"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Per-user credentials for protocols that don't take the UUID directly.
+// Everything is derived from the UUID, keyed with the panel's
+// credential_secret so the UUID alone doesn't give the keys away. Rotating
+// the UUID (/api/user/renew) rotates these too and nothing extra has to be
+// stored. The exception is
+// users imported from another panel (see panel_import.go): they keep their
+// old Trojan and Shadowsocks passwords so existing links still work, until
+// the UUID is renewed.
+
+// trojanUserPassword returns the user's Trojan password.
+func trojanUserPassword(uuid, imported string) string {
+	if imported != "" {
+		return imported
+	}
+	return uuid
+}
+
+// userKey derives the 32-byte key for one of the user's credentials.
+func userKey(purpose, uuid string) []byte {
+	mac := hmac.New(sha256.New, getSecret("credential_secret"))
+	mac.Write([]byte(purpose + ":" + uuid))
+	return mac.Sum(nil)
+}
+
+// isSS2022 reports whether method is a Shadowsocks 2022 (SIP022) cipher.
+func isSS2022(method string) bool {
+	return strings.HasPrefix(method, "2022-")
+}
+
+// ssUserPassword returns the user's Shadowsocks password. SS2022 needs a
+// base64 key of the cipher's size; older ciphers take any string. An
+// imported password is used when it fits the cipher.
+func ssUserPassword(method, uuid, imported string) string {
+	if !isSS2022(method) {
+		if imported != "" {
+			return imported
+		}
+		return uuid
+	}
+	size := 32
+	if strings.Contains(method, "aes-128") {
+		size = 16
+	}
+	if key, err := base64.StdEncoding.DecodeString(imported); err == nil && len(key) == size {
+		return imported
+	}
+	return base64.StdEncoding.EncodeToString(userKey("ss2022", uuid)[:size])
+}
+
+// wgUserKeys returns the user's WireGuard private and public keys (base64).
+func wgUserKeys(uuid string) (string, string) {
+	priv := userKey("wireguard", uuid)
+	priv[0] &= 248
+	priv[31] = (priv[31] & 127) | 64
+
+	pub, _ := curve25519.X25519(priv, curve25519.Basepoint)
+	return base64.StdEncoding.EncodeToString(priv), base64.StdEncoding.EncodeToString(pub)
+}
+
+// wgPublicKey derives the public key for a base64 WireGuard private key.
+func wgPublicKey(privateKey string) string {
+	priv, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil || len(priv) != 32 {
+		return ""
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+// wgUserAddress returns the user's tunnel address in 10.0.0.0/8, allocating
+// the next peer number on first use. 10.0.0.1 is left for the server side.
+func wgUserAddress(uuid string) string {
+	db.DB.Exec(`
+		UPDATE users SET wg_peer_id = (SELECT IFNULL(MAX(wg_peer_id), 0) + 1 FROM users)
+		WHERE uuid = ? AND IFNULL(wg_peer_id, 0) = 0
+	`, uuid)
+
+	var peerID int
+	db.DB.QueryRow("SELECT IFNULL(wg_peer_id, 0) FROM users WHERE uuid=?", uuid).Scan(&peerID)
+	if peerID == 0 {
+		return ""
+	}
+	n := peerID + 1
+	return fmt.Sprintf("10.%d.%d.%d/32", (n>>16)&255, (n>>8)&255, n&255)
+}
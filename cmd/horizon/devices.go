@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"aether/internal/horizon/db"
+)
+
+// Device binding shared by the secure API and the subscription endpoint. A
+// device is identified by its hardware ID and linked to users through
+// user_devices; users.device_limit caps how many devices one user may link.
+// On /sub the limit only applies when hwid_limit is set on the user (copied
+// from their template) or on one of their groups.
+
+var (
+	errDeviceLimit   = errors.New("device limit reached")
+	errDeviceBlocked = errors.New("device blocked")
+	errDeviceUnknown = errors.New("device not registered")
+)
+
+// bindUserDevice links hwid to the user, registering the device on first
+// sight, and returns its ID. Devices already linked never count against the
+// limit. A non-empty label renames the device.
+func bindUserDevice(uuid, hwid, label string) (int, error) {
+	if hwid == "" {
+		return 0, errors.New("hardware_id is required")
+	}
+
+	var limit int
+	if err := db.DB.QueryRow("SELECT device_limit FROM users WHERE uuid=?", uuid).Scan(&limit); err != nil {
+		return 0, err
+	}
+
+	var devID int
+	var status string
+	err := db.DB.QueryRow("SELECT id, status FROM devices WHERE hardware_id=?", hwid).Scan(&devID, &status)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if err == nil && status != "active" {
+		return 0, errDeviceBlocked
+	}
+
+	if devID != 0 {
+		var linked int
+		db.DB.QueryRow("SELECT COUNT(*) FROM user_devices WHERE user_uuid=? AND device_id=?", uuid, devID).Scan(&linked)
+		if linked > 0 {
+			if label != "" {
+				db.DB.Exec("UPDATE devices SET label=? WHERE id=?", label, devID)
+			}
+			return devID, touchDevice(devID)
+		}
+	}
+
+	var count int
+	db.DB.QueryRow("SELECT COUNT(*) FROM user_devices WHERE user_uuid=?", uuid).Scan(&count)
+	if count >= limit {
+		return 0, errDeviceLimit
+	}
+
+	if devID == 0 {
+		res, err := db.DB.Exec("INSERT INTO devices (hardware_id, label) VALUES (?, ?)", hwid, label)
+		if err != nil {
+			return 0, err
+		}
+		id, _ := res.LastInsertId()
+		devID = int(id)
+	} else if label != "" {
+		db.DB.Exec("UPDATE devices SET label=? WHERE id=?", label, devID)
+	}
+
+	if _, err := db.DB.Exec("INSERT OR IGNORE INTO user_devices (user_uuid, device_id) VALUES (?, ?)", uuid, devID); err != nil {
+		return 0, err
+	}
+	return devID, touchDevice(devID)
+}
+
+// userDeviceID returns the ID of hwid if it is an active device of the user.
+func userDeviceID(uuid, hwid string) (int, error) {
+	var devID int
+	var status string
+	err := db.DB.QueryRow(`
+		SELECT d.id, d.status FROM devices d
+		JOIN user_devices ud ON d.id = ud.device_id
+		WHERE ud.user_uuid=? AND d.hardware_id=?
+	`, uuid, hwid).Scan(&devID, &status)
+	if err == sql.ErrNoRows {
+		return 0, errDeviceUnknown
+	}
+	if err != nil {
+		return 0, err
+	}
+	if status != "active" {
+		return 0, errDeviceBlocked
+	}
+	return devID, nil
+}
+
+// touchDevice records that a device was just seen.
+func touchDevice(devID int) error {
+	_, err := db.DB.Exec("UPDATE devices SET last_seen=CURRENT_TIMESTAMP WHERE id=?", devID)
+	return err
+}
+
+// unlinkUserDevice removes a device from the user. A device no other user
+// holds is deleted along with its Enigma key.
+func unlinkUserDevice(uuid string, devID int) error {
+	res, err := db.DB.Exec("DELETE FROM user_devices WHERE user_uuid=? AND device_id=?", uuid, devID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errDeviceUnknown
+	}
+	_, err = db.DB.Exec("DELETE FROM devices WHERE id=? AND NOT EXISTS (SELECT 1 FROM user_devices WHERE device_id=?)", devID, devID)
+	return err
+}
+
+// setDeviceInfo records the OS a client reports, and the model as a label
+// for devices that have none yet.
+func setDeviceInfo(devID int, os, model string) {
+	if os != "" {
+		db.DB.Exec("UPDATE devices SET os=? WHERE id=?", os, devID)
+	}
+	if model != "" {
+		db.DB.Exec("UPDATE devices SET label=? WHERE id=? AND IFNULL(label, '')=''", model, devID)
+	}
+}
+
+// hwidLimitEnabled reports whether /sub enforces device limits for the user.
+func hwidLimitEnabled(uuid string) bool {
+	var enabled bool
+	db.DB.QueryRow(`
+		SELECT IFNULL(u.hwid_limit, 0) OR EXISTS (
+			SELECT 1 FROM user_groups ug JOIN groups g ON ug.group_id = g.id
+			WHERE ug.user_uuid = u.uuid AND g.hwid_limit = 1
+		) FROM users u WHERE u.uuid=?
+	`, uuid).Scan(&enabled)
+	return enabled
+}
+
+// subDeviceRemarks applies the device limit to a subscription fetch using
+// the X-Hwid, X-Device-Os and X-Device-Model headers clients send. It returns
+// the placeholder remarks setting to serve instead of configs, or "".
+func subDeviceRemarks(r *http.Request, uuid string) string {
+	hwid := r.Header.Get("X-Hwid")
+	if !hwidLimitEnabled(uuid) {
+		if hwid != "" {
+			if devID, err := userDeviceID(uuid, hwid); err == nil {
+				touchDevice(devID)
+			}
+		}
+		return ""
+	}
+	if hwid == "" {
+		return "sub_hwid_required_remarks"
+	}
+
+	devID, err := bindUserDevice(uuid, hwid, "")
+	switch err {
+	case nil:
+		setDeviceInfo(devID, r.Header.Get("X-Device-Os"), r.Header.Get("X-Device-Model"))
+	case errDeviceLimit:
+		return "sub_device_limit_remarks"
+	case errDeviceBlocked:
+		return "sub_device_blocked_remarks"
+	default:
+		// Don't lock users out over a database hiccup
+		log.Println("Sub Device Error:", err)
+	}
+	return ""
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"aether/internal/horizon/db"
+	"aether/internal/horizon/secrets"
+	"aether/pkg/enigma"
+)
+
+// Enigma server keyring. Clients run the handshake against the current key
+// (the most recently activated one) and learn its ID from /api/v1/secure/key
+// and the X-Enigma-Key-Id header on every secure response. Activating a new
+// key retires the old one, which is still accepted for enigma_key_overlap_days
+// so installed clients can move over before it expires.
+//
+// A key is pending until activated (activates_at 0), may be scheduled with a
+// future activates_at, and is accepted until expires_at (0 = never). A
+// scheduled key retires the keys before it when it takes over, so their
+// overlap window runs from its activates_at.
+
+var errNoEnigmaKey = errors.New("no active server key")
+
+type enigmaServerKey struct {
+	ID          string `json:"key_id"`
+	PublicKey   string `json:"public_key"`
+	CreatedAt   int64  `json:"created_at"`
+	ActivatesAt int64  `json:"activates_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+	RetiredAt   int64  `json:"retired_at"`
+	State       string `json:"state"` // pending, scheduled, current, accepted, expired
+
+	private []byte
+}
+
+const enigmaKeyColumns = "key_id, private_key, created_at, activates_at, expires_at, retired_at"
+
+// enigmaKeyPredecessors matches the unretired keys that key_id ? replaced
+// when it became current at activates_at ?.
+const enigmaKeyPredecessors = "retired_at = 0 AND key_id != ? AND activates_at > 0 AND activates_at <= ?"
+
+func scanEnigmaKey(scan func(...interface{}) error) (enigmaServerKey, error) {
+	var k enigmaServerKey
+	var encoded string
+	if err := scan(&k.ID, &encoded, &k.CreatedAt, &k.ActivatesAt, &k.ExpiresAt, &k.RetiredAt); err != nil {
+		return k, err
+	}
+	encoded, err := secrets.Open(encoded)
+	if err != nil {
+		return k, err
+	}
+	priv, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return k, err
+	}
+	pub, err := enigma.PublicKey(priv)
+	if err != nil {
+		return k, err
+	}
+	k.private = priv
+	k.PublicKey = base64.StdEncoding.EncodeToString(pub)
+	return k, nil
+}
+
+// usable reports whether requests sealed for k are accepted at now.
+func (k enigmaServerKey) usable(now int64) bool {
+	return k.ActivatesAt > 0 && k.ActivatesAt <= now && (k.ExpiresAt == 0 || k.ExpiresAt > now)
+}
+
+func (k enigmaServerKey) state(now int64, currentID string) string {
+	switch {
+	case k.ID == currentID:
+		return "current"
+	case k.ExpiresAt > 0 && k.ExpiresAt <= now:
+		return "expired"
+	case k.ActivatesAt == 0:
+		return "pending"
+	case k.ActivatesAt > now:
+		return "scheduled"
+	}
+	return "accepted"
+}
+
+// enigmaKeyID names a server key in v2 envelopes and the key endpoint.
+func enigmaKeyID(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// createEnigmaKey generates a key pair and stores it with the given dates.
+func createEnigmaKey(priv []byte, activatesAt, expiresAt int64) (string, error) {
+	if priv == nil {
+		var err error
+		if priv, _, err = enigma.GenerateKeyPair(); err != nil {
+			return "", err
+		}
+	}
+	pub, err := enigma.PublicKey(priv)
+	if err != nil {
+		return "", err
+	}
+	id := enigmaKeyID(pub)
+	sealed, err := secrets.Seal(base64.StdEncoding.EncodeToString(priv))
+	if err != nil {
+		return "", err
+	}
+	_, err = db.DB.Exec("INSERT INTO enigma_keys ("+enigmaKeyColumns+") VALUES (?, ?, ?, ?, ?, 0)",
+		id, sealed, time.Now().Unix(), activatesAt, expiresAt)
+	return id, err
+}
+
+// currentEnigmaKey returns the key new handshakes should use. An empty
+// keyring is seeded with the single key panels used before rotation existed,
+// so its key ID and installed clients keep working.
+func currentEnigmaKey() (enigmaServerKey, error) {
+	now := time.Now().Unix()
+	k, err := scanEnigmaKey(db.DB.QueryRow(`
+		SELECT `+enigmaKeyColumns+` FROM enigma_keys
+		WHERE activates_at > 0 AND activates_at <= ? AND retired_at = 0 AND (expires_at = 0 OR expires_at > ?)
+		ORDER BY activates_at DESC LIMIT 1
+	`, now, now).Scan)
+	if err == nil {
+		err = retireEnigmaPredecessors(k)
+	}
+	if err != sql.ErrNoRows {
+		return k, err
+	}
+
+	var count int
+	db.DB.QueryRow("SELECT COUNT(*) FROM enigma_keys").Scan(&count)
+	if count > 0 {
+		return k, errNoEnigmaKey
+	}
+	if _, err := createEnigmaKey(getSecret("enigma_server_key"), now, 0); err != nil {
+		return k, err
+	}
+	return currentEnigmaKey()
+}
+
+// retireEnigmaPredecessors starts the overlap window of the keys current
+// replaced, from when it took over. It only writes once per takeover.
+func retireEnigmaPredecessors(current enigmaServerKey) error {
+	var pending int
+	db.DB.QueryRow("SELECT COUNT(*) FROM enigma_keys WHERE "+enigmaKeyPredecessors, current.ID, current.ActivatesAt).Scan(&pending)
+	if pending == 0 {
+		return nil
+	}
+	expiresAt := time.Unix(current.ActivatesAt, 0).Add(enigmaKeyOverlap()).Unix()
+	_, err := retireEnigmaKeys(enigmaKeyPredecessors, expiresAt, current.ID, current.ActivatesAt)
+	return err
+}
+
+// acceptedEnigmaKey returns the key named id if requests sealed for it are
+// still accepted. An empty id means the current key.
+func acceptedEnigmaKey(id string) (enigmaServerKey, error) {
+	current, err := currentEnigmaKey()
+	if id == "" || (err == nil && id == current.ID) {
+		return current, err
+	}
+	k, err := scanEnigmaKey(db.DB.QueryRow("SELECT "+enigmaKeyColumns+" FROM enigma_keys WHERE key_id=?", id).Scan)
+	if err == nil && !k.usable(time.Now().Unix()) {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		return k, errors.New("unknown or expired key id")
+	}
+	return k, err
+}
+
+// enigmaKeyOverlap is how long a retired key stays accepted.
+func enigmaKeyOverlap() time.Duration {
+	days, err := strconv.Atoi(getSetting("enigma_key_overlap_days"))
+	if err != nil || days < 0 {
+		days = 30
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// retireEnigmaKeys stops the matching keys from being current and expires
+// them at expiresAt, unless they already expire sooner. Retiring a retired
+// key again can cut its overlap window short.
+func retireEnigmaKeys(where string, expiresAt int64, args ...interface{}) (int64, error) {
+	now := time.Now().Unix()
+	res, err := db.DB.Exec(`
+		UPDATE enigma_keys SET retired_at = CASE WHEN retired_at = 0 THEN ? ELSE retired_at END,
+			expires_at = CASE WHEN expires_at = 0 OR expires_at > ? THEN ? ELSE expires_at END
+		WHERE `+where, append([]interface{}{now, expiresAt, expiresAt}, args...)...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GET  /api/enigma/keys - the keyring, without private keys
+// POST /api/enigma/keys - {"activate": bool, "activates_at": unix, "expires_at": unix}
+// DELETE /api/enigma/keys?id= - drop a pending or expired key
+func handleEnigmaKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		current, _ := currentEnigmaKey()
+		rows, err := db.DB.Query("SELECT " + enigmaKeyColumns + " FROM enigma_keys ORDER BY created_at DESC")
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer rows.Close()
+
+		now := time.Now().Unix()
+		list := []enigmaServerKey{}
+		for rows.Next() {
+			if k, err := scanEnigmaKey(rows.Scan); err == nil {
+				k.State = k.state(now, current.ID)
+				list = append(list, k)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+
+	case "POST":
+		var req struct {
+			Activate    bool  `json:"activate"`
+			ActivatesAt int64 `json:"activates_at"`
+			ExpiresAt   int64 `json:"expires_at"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON", 400)
+				return
+			}
+		}
+		now := time.Now().Unix()
+		if req.ExpiresAt != 0 && req.ExpiresAt <= now {
+			http.Error(w, "expires_at must be in the future", 400)
+			return
+		}
+
+		// Make sure a legacy key is in the keyring before it is superseded
+		currentEnigmaKey()
+		id, err := createEnigmaKey(nil, req.ActivatesAt, req.ExpiresAt)
+		if err != nil {
+			http.Error(w, "Create Failed: "+err.Error(), 500)
+			return
+		}
+		if req.Activate {
+			if err := activateEnigmaKey(id); err != nil {
+				http.Error(w, "Activate Failed: "+err.Error(), 500)
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "key_id": id})
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "Missing ID", 400)
+			return
+		}
+		res, err := db.DB.Exec(`
+			DELETE FROM enigma_keys
+			WHERE key_id=? AND (activates_at = 0 OR (expires_at > 0 AND expires_at <= ?))
+		`, id, time.Now().Unix())
+		if err != nil {
+			http.Error(w, "Delete Failed", 500)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Only pending or expired keys can be deleted", 409)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// activateEnigmaKey makes id the current key now and starts the overlap
+// window for the key it replaces.
+func activateEnigmaKey(id string) error {
+	now := time.Now().Unix()
+	res, err := db.DB.Exec(`
+		UPDATE enigma_keys SET activates_at=?, retired_at=0
+		WHERE key_id=? AND (expires_at = 0 OR expires_at > ?)
+	`, now, id, now)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errors.New("key not found or expired")
+	}
+	_, err = retireEnigmaKeys(enigmaKeyPredecessors, time.Now().Add(enigmaKeyOverlap()).Unix(), id, now)
+	return err
+}
+
+// POST /api/enigma/keys/{id}/activate
+func handleEnigmaKeyActivate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if err := activateEnigmaKey(r.PathValue("id")); err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
+
+// POST /api/enigma/keys/{id}/retire - {"expires_at": unix}, default now plus
+// the overlap window. The current key can only be retired once another key
+// is active.
+func handleEnigmaKeyRetire(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var req struct {
+		ExpiresAt int64 `json:"expires_at"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+	}
+	if req.ExpiresAt == 0 {
+		req.ExpiresAt = time.Now().Add(enigmaKeyOverlap()).Unix()
+	}
+
+	id, now := r.PathValue("id"), time.Now().Unix()
+	var others int
+	db.DB.QueryRow(`
+		SELECT COUNT(*) FROM enigma_keys
+		WHERE key_id != ? AND activates_at > 0 AND activates_at <= ? AND retired_at = 0
+			AND (expires_at = 0 OR expires_at > ?)
+	`, id, now, now).Scan(&others)
+	if others == 0 {
+		http.Error(w, "Activate another key before retiring this one", 409)
+		return
+	}
+
+	n, err := retireEnigmaKeys("key_id = ?", req.ExpiresAt, id)
+	if err != nil {
+		http.Error(w, "Retire Failed", 500)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Key not found", 404)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
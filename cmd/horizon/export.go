@@ -0,0 +1,1200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"aether/internal/horizon/db"
+	"aether/internal/horizon/secrets"
+	"aether/pkg/enigma"
+)
+
+// Portable export/import. Unlike a backup, an export is a versioned JSON
+// bundle of the deployment itself: nodes, configs, groups, templates, users,
+// devices and hosts, with their links, keyed by name/UUID/hardware ID rather
+// than row IDs, so it can be loaded into another panel or merged into one
+// that is already running. Other panels' databases are converted into the
+// same bundle (see panel_import.go).
+//
+// Secrets (node master keys, inbound private keys, device keys, the
+// subscription token secret with the active tokens, the credential secret
+// and the Enigma keyring) are only included on request, and then in
+// plaintext: the importing panel seals them under its own KEK. Without them
+// nodes get new master keys on import, configs keep "[redacted]" until
+// edited, subscription links have to be handed out again, WireGuard and
+// SS2022 users get new keys and installed apps redo their handshake.
+//
+// An import runs in one transaction. Rows whose name (or UUID, or hardware
+// ID) already exists are conflicts, resolved by the conflict mode: abort
+// (default) rolls everything back, skip keeps the existing row, overwrite
+// replaces it and its links. A dry run reports what would happen and rolls
+// back.
+
+const (
+	exportFormat  = "horizon-export"
+	exportVersion = 1
+)
+
+type exportBundle struct {
+	Format         string `json:"format"`
+	Version        int    `json:"version"`
+	ExportedAt     int64  `json:"exported_at"`
+	SchemaVersion  int    `json:"schema_version"`
+	IncludeSecrets bool   `json:"include_secrets"`
+
+	Nodes          []exportNode       `json:"nodes"`
+	CoreConfigs    []exportConfig     `json:"core_configs"`
+	NodeConfigs    []exportLink       `json:"node_configs"`
+	Groups         []exportGroup      `json:"groups"`
+	GroupInbounds  []exportInbound    `json:"group_inbounds"`
+	Templates      []exportTemplate   `json:"user_templates"`
+	TemplateGroups []exportLink       `json:"template_groups"`
+	Users          []exportUser       `json:"users"`
+	UserGroups     []exportUserLink   `json:"user_groups"`
+	Devices        []exportDevice     `json:"devices"`
+	UserDevices    []exportDeviceLink `json:"user_devices"`
+	Hosts          []exportHost       `json:"hosts"`
+
+	// Secrets only
+	SubTokenSecret   string            `json:"sub_token_secret,omitempty"`
+	SubTokens        []exportSubToken  `json:"subscription_tokens,omitempty"`
+	CredentialSecret string            `json:"credential_secret,omitempty"` // See credentials.go
+	EnigmaKeys       []exportEnigmaKey `json:"enigma_keys,omitempty"`
+}
+
+// IDs in a bundle only tie its own records together
+type exportNode struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	IP         string `json:"ip"`
+	AdminPort  string `json:"admin_port"`
+	BaseConfig string `json:"base_config"`
+	MasterKey  string `json:"master_key,omitempty"`
+}
+
+type exportConfig struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	Protocol    string `json:"protocol"`
+	Port        string `json:"port"`
+	Settings    string `json:"settings"`
+	RawInbounds string `json:"raw_inbounds"`
+	Status      string `json:"status"`
+}
+
+// exportLink is node_id/config_id or template_id/group_id
+type exportLink struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+type exportGroup struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	IsDisabled bool   `json:"is_disabled"`
+	HWIDLimit  bool   `json:"hwid_limit"`
+}
+
+type exportInbound struct {
+	GroupID    int64  `json:"group_id"`
+	InboundTag string `json:"inbound_tag"`
+}
+
+type exportTemplate struct {
+	ID                     int64  `json:"id"`
+	Name                   string `json:"name"`
+	DataLimit              int64  `json:"data_limit"`
+	ExpireDuration         int64  `json:"expire_duration"`
+	UsernamePrefix         string `json:"username_prefix"`
+	UsernameSuffix         string `json:"username_suffix"`
+	Status                 string `json:"status"`
+	DataLimitResetStrategy string `json:"data_limit_reset_strategy"`
+	ExtraSettings          string `json:"extra_settings"`
+	IsDisabled             bool   `json:"is_disabled"`
+	HWIDLimit              bool   `json:"hwid_limit"`
+}
+
+type exportUser struct {
+	UUID                   string  `json:"uuid"`
+	Name                   string  `json:"name"`
+	LimitGB                float64 `json:"limit_gb"`
+	DeviceLimit            int     `json:"device_limit"`
+	UsedBytes              int64   `json:"used_bytes"`
+	UploadBytes            int64   `json:"upload_bytes"`
+	DownloadBytes          int64   `json:"download_bytes"`
+	Expiry                 int64   `json:"expiry"`
+	Status                 string  `json:"status"`
+	DataLimitResetStrategy string  `json:"data_limit_reset_strategy"`
+	LastResetAt            int64   `json:"last_reset_at"`
+	ResetAnchorAt          int64   `json:"reset_anchor_at,omitempty"` // 0 = last_reset_at
+	HWIDLimit              bool    `json:"hwid_limit"`
+	WGPeerID               int64   `json:"wg_peer_id"`
+	TrojanPassword         string  `json:"trojan_password,omitempty"` // See credentials.go
+	SSPassword             string  `json:"ss_password,omitempty"`
+}
+
+type exportUserLink struct {
+	UserUUID string `json:"user_uuid"`
+	GroupID  int64  `json:"group_id"`
+}
+
+type exportDevice struct {
+	HardwareID string `json:"hardware_id"`
+	Label      string `json:"label"`
+	Status     string `json:"status"`
+	OS         string `json:"os"`
+	LastSeen   string `json:"last_seen"`
+	EnigmaKey  string `json:"enigma_key,omitempty"`
+}
+
+type exportDeviceLink struct {
+	UserUUID   string `json:"user_uuid"`
+	HardwareID string `json:"hardware_id"`
+}
+
+// exportHost is a Host with node_id from the bundle (0 = every node)
+type exportHost struct {
+	InboundTag  string `json:"inbound_tag"`
+	NodeID      int64  `json:"node_id"`
+	Remark      string `json:"remark"`
+	Address     string `json:"address"`
+	Port        int    `json:"port"`
+	SNI         string `json:"sni"`
+	Host        string `json:"host"`
+	Path        string `json:"path"`
+	ALPN        string `json:"alpn"`
+	Fingerprint string `json:"fingerprint"`
+	Enabled     bool   `json:"enabled"`
+	Priority    int    `json:"priority"`
+}
+
+// exportSubToken is an active subscription token; the link itself is
+// rebuilt from the ID and the bundle's sub_token_secret.
+type exportSubToken struct {
+	TokenID   string `json:"token_id"`
+	UserUUID  string `json:"user_uuid"`
+	CreatedAt int64  `json:"created_at"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type exportEnigmaKey struct {
+	KeyID       string `json:"key_id"`
+	PrivateKey  string `json:"private_key"`
+	CreatedAt   int64  `json:"created_at"`
+	ActivatesAt int64  `json:"activates_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+	RetiredAt   int64  `json:"retired_at"`
+}
+
+// exportQuery runs query and hands each row's Scan to fn.
+func exportQuery(query string, fn func(scan func(...interface{}) error) error) error {
+	rows, err := db.DB.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows.Scan); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func buildExport(includeSecrets bool) (*exportBundle, error) {
+	b := &exportBundle{
+		Format:         exportFormat,
+		Version:        exportVersion,
+		ExportedAt:     time.Now().Unix(),
+		SchemaVersion:  db.LatestVersion(),
+		IncludeSecrets: includeSecrets,
+		Nodes:          []exportNode{},
+		CoreConfigs:    []exportConfig{},
+		NodeConfigs:    []exportLink{},
+		Groups:         []exportGroup{},
+		GroupInbounds:  []exportInbound{},
+		Templates:      []exportTemplate{},
+		TemplateGroups: []exportLink{},
+		Users:          []exportUser{},
+		UserGroups:     []exportUserLink{},
+		Devices:        []exportDevice{},
+		UserDevices:    []exportDeviceLink{},
+		Hosts:          []exportHost{},
+	}
+
+	err := exportQuery("SELECT id, IFNULL(name, ''), IFNULL(ip, ''), IFNULL(admin_port, ''), IFNULL(base_config, ''), IFNULL(master_key, '') FROM nodes ORDER BY id",
+		func(scan func(...interface{}) error) error {
+			var n exportNode
+			if err := scan(&n.ID, &n.Name, &n.IP, &n.AdminPort, &n.BaseConfig, &n.MasterKey); err != nil {
+				return err
+			}
+			var err error
+			if includeSecrets {
+				n.MasterKey, err = secrets.Open(n.MasterKey)
+			} else {
+				n.MasterKey = ""
+			}
+			b.Nodes = append(b.Nodes, n)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("nodes: %w", err)
+	}
+
+	err = exportQuery("SELECT id, name, IFNULL(protocol, ''), IFNULL(port, ''), IFNULL(settings, ''), IFNULL(raw_inbounds, ''), IFNULL(status, 'active') FROM core_configs ORDER BY id",
+		func(scan func(...interface{}) error) error {
+			var c exportConfig
+			if err := scan(&c.ID, &c.Name, &c.Protocol, &c.Port, &c.Settings, &c.RawInbounds, &c.Status); err != nil {
+				return err
+			}
+			var err error
+			if includeSecrets {
+				c.RawInbounds, err = openInbounds(c.RawInbounds)
+			} else {
+				c.RawInbounds = redactInbounds(c.RawInbounds)
+			}
+			b.CoreConfigs = append(b.CoreConfigs, c)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("core_configs: %w", err)
+	}
+
+	err = exportQuery("SELECT node_id, config_id FROM node_configs ORDER BY node_id, config_id",
+		func(scan func(...interface{}) error) error {
+			var l exportLink
+			err := scan(&l.From, &l.To)
+			b.NodeConfigs = append(b.NodeConfigs, l)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("node_configs: %w", err)
+	}
+
+	err = exportQuery("SELECT id, name, IFNULL(is_disabled, 0), IFNULL(hwid_limit, 0) FROM groups ORDER BY id",
+		func(scan func(...interface{}) error) error {
+			var g exportGroup
+			err := scan(&g.ID, &g.Name, &g.IsDisabled, &g.HWIDLimit)
+			b.Groups = append(b.Groups, g)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("groups: %w", err)
+	}
+
+	err = exportQuery("SELECT group_id, inbound_tag FROM group_inbounds ORDER BY group_id, inbound_tag",
+		func(scan func(...interface{}) error) error {
+			var gi exportInbound
+			err := scan(&gi.GroupID, &gi.InboundTag)
+			b.GroupInbounds = append(b.GroupInbounds, gi)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("group_inbounds: %w", err)
+	}
+
+	err = exportQuery(`
+		SELECT id, name, IFNULL(data_limit, 0), IFNULL(expire_duration, 0), IFNULL(username_prefix, ''), IFNULL(username_suffix, ''),
+		       IFNULL(status, 'active'), IFNULL(data_limit_reset_strategy, 'no_reset'), IFNULL(extra_settings, ''),
+		       IFNULL(is_disabled, 0), IFNULL(hwid_limit, 0)
+		FROM user_templates ORDER BY id`,
+		func(scan func(...interface{}) error) error {
+			var t exportTemplate
+			err := scan(&t.ID, &t.Name, &t.DataLimit, &t.ExpireDuration, &t.UsernamePrefix, &t.UsernameSuffix,
+				&t.Status, &t.DataLimitResetStrategy, &t.ExtraSettings, &t.IsDisabled, &t.HWIDLimit)
+			b.Templates = append(b.Templates, t)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("user_templates: %w", err)
+	}
+
+	err = exportQuery("SELECT template_id, group_id FROM template_group_association ORDER BY template_id, group_id",
+		func(scan func(...interface{}) error) error {
+			var l exportLink
+			err := scan(&l.From, &l.To)
+			b.TemplateGroups = append(b.TemplateGroups, l)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("template_groups: %w", err)
+	}
+
+	err = exportQuery(`
+		SELECT uuid, IFNULL(name, ''), IFNULL(limit_gb, 0), IFNULL(device_limit, 3), IFNULL(used_bytes, 0),
+		       IFNULL(upload_bytes, 0), IFNULL(download_bytes, 0), IFNULL(expiry, 0), IFNULL(status, 'active'),
+		       IFNULL(data_limit_reset_strategy, 'no_reset'), IFNULL(last_reset_at, 0), IFNULL(reset_anchor_at, 0), IFNULL(hwid_limit, 0), IFNULL(wg_peer_id, 0),
+		       IFNULL(trojan_password, ''), IFNULL(ss_password, '')
+		FROM users ORDER BY name, uuid`,
+		func(scan func(...interface{}) error) error {
+			var u exportUser
+			err := scan(&u.UUID, &u.Name, &u.LimitGB, &u.DeviceLimit, &u.UsedBytes,
+				&u.UploadBytes, &u.DownloadBytes, &u.Expiry, &u.Status,
+				&u.DataLimitResetStrategy, &u.LastResetAt, &u.ResetAnchorAt, &u.HWIDLimit, &u.WGPeerID,
+				&u.TrojanPassword, &u.SSPassword)
+			b.Users = append(b.Users, u)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("users: %w", err)
+	}
+
+	err = exportQuery("SELECT user_uuid, group_id FROM user_groups ORDER BY user_uuid, group_id",
+		func(scan func(...interface{}) error) error {
+			var l exportUserLink
+			err := scan(&l.UserUUID, &l.GroupID)
+			b.UserGroups = append(b.UserGroups, l)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("user_groups: %w", err)
+	}
+
+	err = exportQuery("SELECT hardware_id, IFNULL(label, ''), IFNULL(status, 'active'), IFNULL(os, ''), IFNULL(CAST(last_seen AS TEXT), ''), IFNULL(enigma_key, '') FROM devices ORDER BY id",
+		func(scan func(...interface{}) error) error {
+			var d exportDevice
+			if err := scan(&d.HardwareID, &d.Label, &d.Status, &d.OS, &d.LastSeen, &d.EnigmaKey); err != nil {
+				return err
+			}
+			var err error
+			if includeSecrets {
+				d.EnigmaKey, err = secrets.Open(d.EnigmaKey)
+			} else {
+				d.EnigmaKey = ""
+			}
+			b.Devices = append(b.Devices, d)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("devices: %w", err)
+	}
+
+	err = exportQuery("SELECT ud.user_uuid, d.hardware_id FROM user_devices ud JOIN devices d ON ud.device_id = d.id ORDER BY ud.user_uuid, d.hardware_id",
+		func(scan func(...interface{}) error) error {
+			var l exportDeviceLink
+			err := scan(&l.UserUUID, &l.HardwareID)
+			b.UserDevices = append(b.UserDevices, l)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("user_devices: %w", err)
+	}
+
+	err = exportQuery("SELECT inbound_tag, node_id, remark, address, port, sni, host, path, alpn, fingerprint, enabled, priority FROM hosts ORDER BY priority, id",
+		func(scan func(...interface{}) error) error {
+			var h exportHost
+			err := scan(&h.InboundTag, &h.NodeID, &h.Remark, &h.Address, &h.Port, &h.SNI, &h.Host, &h.Path, &h.ALPN, &h.Fingerprint, &h.Enabled, &h.Priority)
+			b.Hosts = append(b.Hosts, h)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("hosts: %w", err)
+	}
+	if !includeSecrets {
+		return b, nil
+	}
+
+	if b.SubTokenSecret, err = exportSecretSetting("sub_token_secret"); err != nil {
+		return nil, err
+	}
+	if b.CredentialSecret, err = exportSecretSetting("credential_secret"); err != nil {
+		return nil, err
+	}
+
+	// Revoked and expired tokens are refused either way
+	err = exportQuery(fmt.Sprintf("SELECT token_id, user_uuid, created_at, expires_at FROM subscription_tokens WHERE revoked_at=0 AND (expires_at=0 OR expires_at > %d) ORDER BY created_at", time.Now().Unix()),
+		func(scan func(...interface{}) error) error {
+			var t exportSubToken
+			err := scan(&t.TokenID, &t.UserUUID, &t.CreatedAt, &t.ExpiresAt)
+			b.SubTokens = append(b.SubTokens, t)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("subscription_tokens: %w", err)
+	}
+
+	err = exportQuery("SELECT "+enigmaKeyColumns+" FROM enigma_keys ORDER BY created_at",
+		func(scan func(...interface{}) error) error {
+			var k exportEnigmaKey
+			if err := scan(&k.KeyID, &k.PrivateKey, &k.CreatedAt, &k.ActivatesAt, &k.ExpiresAt, &k.RetiredAt); err != nil {
+				return err
+			}
+			var err error
+			k.PrivateKey, err = secrets.Open(k.PrivateKey)
+			b.EnigmaKeys = append(b.EnigmaKeys, k)
+			return err
+		})
+	if err != nil {
+		return nil, fmt.Errorf("enigma_keys: %w", err)
+	}
+	return b, nil
+}
+
+// exportSecretSetting opens a getSecret setting, or returns "" if the panel
+// never created it.
+func exportSecretSetting(key string) (string, error) {
+	var sealed string
+	err := db.DB.QueryRow("SELECT value FROM settings WHERE key=?", key).Scan(&sealed)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("%s: %w", key, err)
+	}
+	plain, err := secrets.Open(sealed)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", key, err)
+	}
+	return plain, nil
+}
+
+const (
+	conflictAbort     = "abort"
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+)
+
+type importConflict struct {
+	Type       string `json:"type"`
+	Key        string `json:"key"`
+	Resolution string `json:"resolution"`
+}
+
+type importReport struct {
+	DryRun    bool             `json:"dry_run"`
+	Applied   bool             `json:"applied"`
+	Created   map[string]int   `json:"created"`
+	Updated   map[string]int   `json:"updated"`
+	Skipped   map[string]int   `json:"skipped"`
+	Conflicts []importConflict `json:"conflicts"`
+	Warnings  []string         `json:"warnings"`
+}
+
+func (rep *importReport) warn(format string, args ...interface{}) {
+	rep.Warnings = append(rep.Warnings, fmt.Sprintf(format, args...))
+}
+
+// importer carries one import's transaction and ID mappings.
+type importer struct {
+	tx   *sql.Tx
+	mode string
+	rep  *importReport
+
+	// Bundle ID -> local ID, and whether the bundle's links apply (the row
+	// was created or overwritten rather than skipped)
+	nodes, configs, groups, templates map[int64]int64
+	ownLinks                          map[string]bool
+	users                             map[string]bool // UUIDs whose links apply
+	devices                           map[string]int64
+}
+
+// conflict records a clash and reports whether the row should be overwritten.
+func (im *importer) conflict(kind, key string) bool {
+	resolution := "skipped"
+	if im.mode == conflictOverwrite {
+		resolution = "overwritten"
+	}
+	im.rep.Conflicts = append(im.rep.Conflicts, importConflict{Type: kind, Key: key, Resolution: resolution})
+	return im.mode == conflictOverwrite
+}
+
+// existingID returns the id of the row matching query, or 0.
+func (im *importer) existingID(query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := im.tx.QueryRow(query, args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// importBundle loads b into the database. With mode abort, any conflict
+// rolls the import back; a dry run always does.
+func importBundle(b *exportBundle, mode string, dryRun bool) (*importReport, error) {
+	if b.Format != exportFormat {
+		return nil, fmt.Errorf("not a Horizon export")
+	}
+	if b.Version < 1 || b.Version > exportVersion {
+		return nil, fmt.Errorf("unsupported export version %d", b.Version)
+	}
+	switch mode {
+	case "":
+		mode = conflictAbort
+	case conflictAbort, conflictSkip, conflictOverwrite:
+	default:
+		return nil, fmt.Errorf("unknown conflict mode %q", mode)
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rep := &importReport{
+		DryRun:    dryRun,
+		Created:   map[string]int{},
+		Updated:   map[string]int{},
+		Skipped:   map[string]int{},
+		Conflicts: []importConflict{},
+		Warnings:  []string{},
+	}
+	im := &importer{
+		tx: tx, mode: mode, rep: rep,
+		nodes: map[int64]int64{}, configs: map[int64]int64{}, groups: map[int64]int64{}, templates: map[int64]int64{},
+		ownLinks: map[string]bool{}, users: map[string]bool{}, devices: map[string]int64{},
+	}
+	for _, step := range []func(*exportBundle) error{
+		im.importNodes, im.importConfigs, im.importGroups, im.importTemplates,
+		im.importUsers, im.importDevices, im.importHosts, im.importLinks,
+		im.importCredentialSecret, im.importSubTokens, im.importEnigmaKeys,
+	} {
+		if err := step(b); err != nil {
+			return nil, err
+		}
+	}
+
+	if dryRun || (mode == conflictAbort && len(rep.Conflicts) > 0) {
+		return rep, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	rep.Applied = true
+	return rep, nil
+}
+
+// linkKey names a bundle row in importer.ownLinks
+func linkKey(kind string, id int64) string {
+	return fmt.Sprintf("%s:%d", kind, id)
+}
+
+func (im *importer) importNodes(b *exportBundle) error {
+	for _, n := range b.Nodes {
+		id, err := im.existingID("SELECT id FROM nodes WHERE name=?", n.Name)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			im.nodes[n.ID] = id
+			if !im.conflict("node", n.Name) {
+				im.rep.Skipped["nodes"]++
+				continue
+			}
+			if _, err := im.tx.Exec("UPDATE nodes SET ip=?, admin_port=?, base_config=? WHERE id=?", n.IP, n.AdminPort, n.BaseConfig, id); err != nil {
+				return err
+			}
+			// Without a key in the bundle the node keeps its own
+			if n.MasterKey != "" {
+				sealed, err := secrets.Seal(n.MasterKey)
+				if err != nil {
+					return err
+				}
+				if _, err := im.tx.Exec("UPDATE nodes SET master_key=? WHERE id=?", sealed, id); err != nil {
+					return err
+				}
+			}
+			im.ownLinks[linkKey("node", n.ID)] = true
+			im.rep.Updated["nodes"]++
+			continue
+		}
+
+		key := n.MasterKey
+		if key == "" {
+			key = generateRandomKey()
+			im.rep.warn("node %s: master key not in export, generated a new one (reinstall its agent)", n.Name)
+		}
+		sealed, err := secrets.Seal(key)
+		if err != nil {
+			return err
+		}
+		res, err := im.tx.Exec("INSERT INTO nodes (name, ip, admin_port, master_key, status, base_config) VALUES (?, ?, ?, ?, 'offline', ?)",
+			n.Name, n.IP, n.AdminPort, sealed, n.BaseConfig)
+		if err != nil {
+			return err
+		}
+		im.nodes[n.ID], _ = res.LastInsertId()
+		im.ownLinks[linkKey("node", n.ID)] = true
+		im.rep.Created["nodes"]++
+	}
+	return nil
+}
+
+func (im *importer) importConfigs(b *exportBundle) error {
+	for _, c := range b.CoreConfigs {
+		var id int64
+		var stored string
+		err := im.tx.QueryRow("SELECT id, IFNULL(raw_inbounds, '') FROM core_configs WHERE name=? ORDER BY id LIMIT 1", c.Name).Scan(&id, &stored)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if id != 0 {
+			im.configs[c.ID] = id
+			if !im.conflict("config", c.Name) {
+				im.rep.Skipped["core_configs"]++
+				continue
+			}
+			raw, err := sealInbounds(restoreRedactedInbounds(c.RawInbounds, stored))
+			if err != nil {
+				return err
+			}
+			_, err = im.tx.Exec("UPDATE core_configs SET protocol=?, port=?, settings=?, raw_inbounds=?, status=? WHERE id=?",
+				c.Protocol, c.Port, c.Settings, raw, c.Status, id)
+			if err != nil {
+				return err
+			}
+			im.rep.Updated["core_configs"]++
+			continue
+		}
+
+		if strings.Contains(c.RawInbounds, redactedSecret) {
+			im.rep.warn("config %s: secrets not in export, set them before assigning it", c.Name)
+		}
+		raw, err := sealInbounds(c.RawInbounds)
+		if err != nil {
+			return err
+		}
+		res, err := im.tx.Exec("INSERT INTO core_configs (name, protocol, port, settings, raw_inbounds, status) VALUES (?, ?, ?, ?, ?, ?)",
+			c.Name, c.Protocol, c.Port, c.Settings, raw, c.Status)
+		if err != nil {
+			return err
+		}
+		im.configs[c.ID], _ = res.LastInsertId()
+		im.rep.Created["core_configs"]++
+	}
+	return nil
+}
+
+func (im *importer) importGroups(b *exportBundle) error {
+	for _, g := range b.Groups {
+		id, err := im.existingID("SELECT id FROM groups WHERE name=?", g.Name)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			im.groups[g.ID] = id
+			if !im.conflict("group", g.Name) {
+				im.rep.Skipped["groups"]++
+				continue
+			}
+			if _, err := im.tx.Exec("UPDATE groups SET is_disabled=?, hwid_limit=? WHERE id=?", g.IsDisabled, g.HWIDLimit, id); err != nil {
+				return err
+			}
+			im.ownLinks[linkKey("group", g.ID)] = true
+			im.rep.Updated["groups"]++
+			continue
+		}
+		res, err := im.tx.Exec("INSERT INTO groups (name, is_disabled, hwid_limit) VALUES (?, ?, ?)", g.Name, g.IsDisabled, g.HWIDLimit)
+		if err != nil {
+			return err
+		}
+		im.groups[g.ID], _ = res.LastInsertId()
+		im.ownLinks[linkKey("group", g.ID)] = true
+		im.rep.Created["groups"]++
+	}
+	return nil
+}
+
+func (im *importer) importTemplates(b *exportBundle) error {
+	for _, t := range b.Templates {
+		id, err := im.existingID("SELECT id FROM user_templates WHERE name=?", t.Name)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			im.templates[t.ID] = id
+			if !im.conflict("template", t.Name) {
+				im.rep.Skipped["user_templates"]++
+				continue
+			}
+			_, err := im.tx.Exec(`
+				UPDATE user_templates SET data_limit=?, expire_duration=?, username_prefix=?, username_suffix=?, status=?,
+				       data_limit_reset_strategy=?, extra_settings=?, is_disabled=?, hwid_limit=?
+				WHERE id=?
+			`, t.DataLimit, t.ExpireDuration, t.UsernamePrefix, t.UsernameSuffix, t.Status,
+				t.DataLimitResetStrategy, t.ExtraSettings, t.IsDisabled, t.HWIDLimit, id)
+			if err != nil {
+				return err
+			}
+			im.ownLinks[linkKey("template", t.ID)] = true
+			im.rep.Updated["user_templates"]++
+			continue
+		}
+		res, err := im.tx.Exec(`
+			INSERT INTO user_templates (name, data_limit, expire_duration, username_prefix, username_suffix, status,
+			                            data_limit_reset_strategy, extra_settings, is_disabled, hwid_limit)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, t.Name, t.DataLimit, t.ExpireDuration, t.UsernamePrefix, t.UsernameSuffix, t.Status,
+			t.DataLimitResetStrategy, t.ExtraSettings, t.IsDisabled, t.HWIDLimit)
+		if err != nil {
+			return err
+		}
+		im.templates[t.ID], _ = res.LastInsertId()
+		im.ownLinks[linkKey("template", t.ID)] = true
+		im.rep.Created["user_templates"]++
+	}
+	return nil
+}
+
+func (im *importer) importUsers(b *exportBundle) error {
+	for _, u := range b.Users {
+		var exists int
+		im.tx.QueryRow("SELECT COUNT(*) FROM users WHERE uuid=?", u.UUID).Scan(&exists)
+		// Usernames are unique in practice (see from_template); another
+		// user's name is never overwritten.
+		var nameTaken int
+		im.tx.QueryRow("SELECT COUNT(*) FROM users WHERE name=? AND uuid != ?", u.Name, u.UUID).Scan(&nameTaken)
+		if nameTaken > 0 {
+			im.rep.Conflicts = append(im.rep.Conflicts, importConflict{Type: "user", Key: u.Name, Resolution: "skipped"})
+			im.rep.Skipped["users"]++
+			continue
+		}
+
+		// WireGuard addresses come from wg_peer_id; a taken one is reassigned
+		var peerTaken int
+		im.tx.QueryRow("SELECT COUNT(*) FROM users WHERE wg_peer_id=? AND uuid != ?", u.WGPeerID, u.UUID).Scan(&peerTaken)
+		if peerTaken > 0 {
+			u.WGPeerID = 0
+		}
+
+		if exists > 0 {
+			if !im.conflict("user", u.UUID) {
+				im.rep.Skipped["users"]++
+				continue
+			}
+			_, err := im.tx.Exec(`
+				UPDATE users SET name=?, limit_gb=?, device_limit=?, used_bytes=?, upload_bytes=?, download_bytes=?, expiry=?, status=?,
+				       data_limit_reset_strategy=?, last_reset_at=?, reset_anchor_at=?, hwid_limit=?, wg_peer_id=?, trojan_password=?, ss_password=?
+				WHERE uuid=?
+			`, u.Name, u.LimitGB, u.DeviceLimit, u.UsedBytes, u.UploadBytes, u.DownloadBytes, u.Expiry, u.Status,
+				u.DataLimitResetStrategy, u.LastResetAt, u.ResetAnchorAt, u.HWIDLimit, u.WGPeerID, u.TrojanPassword, u.SSPassword, u.UUID)
+			if err != nil {
+				return err
+			}
+			im.users[u.UUID] = true
+			im.rep.Updated["users"]++
+			continue
+		}
+		_, err := im.tx.Exec(`
+			INSERT INTO users (uuid, name, limit_gb, device_limit, used_bytes, upload_bytes, download_bytes, expiry, status,
+			                   data_limit_reset_strategy, last_reset_at, reset_anchor_at, hwid_limit, wg_peer_id, trojan_password, ss_password)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, u.UUID, u.Name, u.LimitGB, u.DeviceLimit, u.UsedBytes, u.UploadBytes, u.DownloadBytes, u.Expiry, u.Status,
+			u.DataLimitResetStrategy, u.LastResetAt, u.ResetAnchorAt, u.HWIDLimit, u.WGPeerID, u.TrojanPassword, u.SSPassword)
+		if err != nil {
+			return err
+		}
+		im.users[u.UUID] = true
+		im.rep.Created["users"]++
+	}
+	return nil
+}
+
+func (im *importer) importDevices(b *exportBundle) error {
+	for _, d := range b.Devices {
+		key := d.EnigmaKey
+		if key != "" {
+			var err error
+			if key, err = secrets.Seal(key); err != nil {
+				return err
+			}
+		}
+		id, err := im.existingID("SELECT id FROM devices WHERE hardware_id=?", d.HardwareID)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			im.devices[d.HardwareID] = id
+			if !im.conflict("device", d.HardwareID) {
+				im.rep.Skipped["devices"]++
+				continue
+			}
+			if _, err := im.tx.Exec("UPDATE devices SET label=?, status=?, os=? WHERE id=?", d.Label, d.Status, d.OS, id); err != nil {
+				return err
+			}
+			if key != "" {
+				if _, err := im.tx.Exec("UPDATE devices SET enigma_key=? WHERE id=?", key, id); err != nil {
+					return err
+				}
+			}
+			im.rep.Updated["devices"]++
+			continue
+		}
+		// Devices without a key get a new one when they next register
+		res, err := im.tx.Exec("INSERT INTO devices (hardware_id, label, status, os, enigma_key) VALUES (?, ?, ?, ?, ?)",
+			d.HardwareID, d.Label, d.Status, d.OS, key)
+		if err != nil {
+			return err
+		}
+		if d.LastSeen != "" {
+			im.tx.Exec("UPDATE devices SET last_seen=? WHERE hardware_id=?", d.LastSeen, d.HardwareID)
+		}
+		im.devices[d.HardwareID], _ = res.LastInsertId()
+		im.rep.Created["devices"]++
+	}
+	return nil
+}
+
+// importHosts adds hosts the database doesn't have yet. Hosts have no name,
+// so one with the same tag, node, address, port and SNI is the same host.
+func (im *importer) importHosts(b *exportBundle) error {
+	for _, h := range b.Hosts {
+		var node int64
+		if h.NodeID != 0 {
+			var ok bool
+			if node, ok = im.nodes[h.NodeID]; !ok {
+				im.rep.warn("host %s: unknown node %d", h.InboundTag, h.NodeID)
+				continue
+			}
+		}
+		key := fmt.Sprintf("%s %s:%d %s", h.InboundTag, h.Address, h.Port, h.SNI)
+		id, err := im.existingID("SELECT id FROM hosts WHERE inbound_tag=? AND node_id=? AND address=? AND port=? AND sni=?",
+			h.InboundTag, node, h.Address, h.Port, h.SNI)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			if !im.conflict("host", key) {
+				im.rep.Skipped["hosts"]++
+				continue
+			}
+			_, err := im.tx.Exec("UPDATE hosts SET remark=?, host=?, path=?, alpn=?, fingerprint=?, enabled=?, priority=? WHERE id=?",
+				h.Remark, h.Host, h.Path, h.ALPN, h.Fingerprint, h.Enabled, h.Priority, id)
+			if err != nil {
+				return err
+			}
+			im.rep.Updated["hosts"]++
+			continue
+		}
+		_, err = im.tx.Exec(`
+			INSERT INTO hosts (inbound_tag, node_id, remark, address, port, sni, host, path, alpn, fingerprint, enabled, priority)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, h.InboundTag, node, h.Remark, h.Address, h.Port, h.SNI, h.Host, h.Path, h.ALPN, h.Fingerprint, h.Enabled, h.Priority)
+		if err != nil {
+			return err
+		}
+		im.rep.Created["hosts"]++
+	}
+	return nil
+}
+
+// importLinks adds the bundle's links for rows it created or overwrote;
+// an overwritten row's own links are replaced. Skipped rows keep theirs.
+func (im *importer) importLinks(b *exportBundle) error {
+	exec := func(query string, args ...interface{}) error {
+		_, err := im.tx.Exec(query, args...)
+		return err
+	}
+	cleared := map[string]bool{}
+	clear := func(key, query string, id interface{}) error {
+		if cleared[key] {
+			return nil
+		}
+		cleared[key] = true
+		return exec(query, id)
+	}
+
+	for _, l := range b.NodeConfigs {
+		node, okNode := im.nodes[l.From]
+		config, okConfig := im.configs[l.To]
+		if !im.ownLinks[linkKey("node", l.From)] {
+			continue
+		}
+		if !okNode || !okConfig {
+			im.rep.warn("node_configs: unknown node %d or config %d", l.From, l.To)
+			continue
+		}
+		if err := clear(linkKey("node", l.From), "DELETE FROM node_configs WHERE node_id=?", node); err != nil {
+			return err
+		}
+		if err := exec("INSERT OR IGNORE INTO node_configs (node_id, config_id) VALUES (?, ?)", node, config); err != nil {
+			return err
+		}
+	}
+
+	for _, gi := range b.GroupInbounds {
+		group, ok := im.groups[gi.GroupID]
+		if !im.ownLinks[linkKey("group", gi.GroupID)] {
+			continue
+		}
+		if !ok {
+			im.rep.warn("group_inbounds: unknown group %d", gi.GroupID)
+			continue
+		}
+		if err := clear(linkKey("group", gi.GroupID), "DELETE FROM group_inbounds WHERE group_id=?", group); err != nil {
+			return err
+		}
+		if err := exec("INSERT OR IGNORE INTO group_inbounds (group_id, inbound_tag) VALUES (?, ?)", group, gi.InboundTag); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range b.TemplateGroups {
+		template, okTemplate := im.templates[l.From]
+		group, okGroup := im.groups[l.To]
+		if !im.ownLinks[linkKey("template", l.From)] {
+			continue
+		}
+		if !okTemplate || !okGroup {
+			im.rep.warn("template_groups: unknown template %d or group %d", l.From, l.To)
+			continue
+		}
+		if err := clear(linkKey("template", l.From), "DELETE FROM template_group_association WHERE template_id=?", template); err != nil {
+			return err
+		}
+		if err := exec("INSERT OR IGNORE INTO template_group_association (template_id, group_id) VALUES (?, ?)", template, group); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range b.UserGroups {
+		group, ok := im.groups[l.GroupID]
+		if !im.users[l.UserUUID] {
+			continue
+		}
+		if !ok {
+			im.rep.warn("user_groups: unknown group %d", l.GroupID)
+			continue
+		}
+		if err := clear("user_groups:"+l.UserUUID, "DELETE FROM user_groups WHERE user_uuid=?", l.UserUUID); err != nil {
+			return err
+		}
+		if err := exec("INSERT OR IGNORE INTO user_groups (user_uuid, group_id) VALUES (?, ?)", l.UserUUID, group); err != nil {
+			return err
+		}
+	}
+
+	for _, l := range b.UserDevices {
+		device, ok := im.devices[l.HardwareID]
+		if !im.users[l.UserUUID] {
+			continue
+		}
+		if !ok {
+			im.rep.warn("user_devices: unknown device %s", l.HardwareID)
+			continue
+		}
+		if err := clear("user_devices:"+l.UserUUID, "DELETE FROM user_devices WHERE user_uuid=?", l.UserUUID); err != nil {
+			return err
+		}
+		if err := exec("INSERT OR IGNORE INTO user_devices (user_uuid, device_id) VALUES (?, ?)", l.UserUUID, device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importSecretSetting takes over the getSecret setting key from the bundle
+// and reports whether it is in effect. Replacing a different secret that is
+// inUse here is a conflict; consequence says what overwriting it breaks.
+func (im *importer) importSecretSetting(key, value string, inUse bool, consequence string) (bool, error) {
+	if _, err := hex.DecodeString(value); err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	var stored string
+	err := im.tx.QueryRow("SELECT value FROM settings WHERE key=?", key).Scan(&stored)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if stored, err = secrets.Open(stored); err != nil {
+		return false, err
+	}
+	if stored == value {
+		return true, nil
+	}
+	if stored != "" && inUse {
+		if !im.conflict("setting", key) {
+			return false, nil
+		}
+		im.rep.warn("%s replaced, %s", key, consequence)
+	}
+	sealed, err := secrets.Seal(value)
+	if err != nil {
+		return false, err
+	}
+	if _, err := im.tx.Exec("INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)", key, sealed); err != nil {
+		return false, err
+	}
+	im.rep.Updated["settings"]++
+	return true, nil
+}
+
+// importCredentialSecret takes over the secret imported users' WireGuard
+// keys and SS2022 passwords are derived with, so they keep working.
+func (im *importer) importCredentialSecret(b *exportBundle) error {
+	if b.CredentialSecret == "" {
+		if !b.IncludeSecrets && len(im.users) > 0 {
+			im.rep.warn("credential secret not in export, imported users get new WireGuard keys and SS2022 passwords")
+		}
+		return nil
+	}
+	var users int
+	im.tx.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
+	taken, err := im.importSecretSetting("credential_secret", b.CredentialSecret, users > im.rep.Created["users"],
+		"WireGuard keys and SS2022 passwords of this panel's users change")
+	if err != nil {
+		return err
+	}
+	if !taken {
+		im.rep.warn("credential_secret kept, imported users get new WireGuard keys and SS2022 passwords")
+	}
+	return nil
+}
+
+// importSubTokens brings over the subscription links of imported users. They
+// are signed with the exporting panel's secret, which this panel takes over
+// unless it has live tokens of its own; then it is a conflict, and
+// overwriting it invalidates those.
+func (im *importer) importSubTokens(b *exportBundle) error {
+	if b.SubTokenSecret == "" {
+		if len(im.users) > 0 {
+			im.rep.warn("subscription tokens not in export, imported users need new subscription links")
+		}
+		return nil
+	}
+	var live int
+	im.tx.QueryRow("SELECT COUNT(*) FROM subscription_tokens WHERE revoked_at=0").Scan(&live)
+	taken, err := im.importSecretSetting("sub_token_secret", b.SubTokenSecret, live > 0, "links issued by this panel stop working")
+	if err != nil {
+		return err
+	}
+	if !taken {
+		im.rep.Skipped["subscription_tokens"] += len(b.SubTokens)
+		im.rep.warn("sub_token_secret kept, imported users need new subscription links")
+		return nil
+	}
+
+	for _, t := range b.SubTokens {
+		if !im.users[t.UserUUID] {
+			im.rep.Skipped["subscription_tokens"]++
+			continue
+		}
+		res, err := im.tx.Exec("INSERT OR IGNORE INTO subscription_tokens (token_id, user_uuid, created_at, expires_at) VALUES (?, ?, ?, ?)",
+			t.TokenID, t.UserUUID, t.CreatedAt, t.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			im.rep.Created["subscription_tokens"]++
+		}
+	}
+	return nil
+}
+
+// importEnigmaKeys adds the exporting panel's server keys so installed apps
+// keep working. Key IDs derive from the key itself, so an existing ID is the
+// same key and only its dates can differ.
+func (im *importer) importEnigmaKeys(b *exportBundle) error {
+	if len(b.EnigmaKeys) == 0 {
+		if !b.IncludeSecrets && len(b.Devices) > 0 {
+			im.rep.warn("Enigma keys not in export, installed apps have to register again")
+		}
+		return nil
+	}
+	for _, k := range b.EnigmaKeys {
+		priv, err := base64.StdEncoding.DecodeString(k.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("enigma key %s: %w", k.KeyID, err)
+		}
+		pub, err := enigma.PublicKey(priv)
+		if err != nil {
+			return fmt.Errorf("enigma key %s: %w", k.KeyID, err)
+		}
+		if enigmaKeyID(pub) != k.KeyID {
+			return fmt.Errorf("enigma key %s: key ID does not match the key", k.KeyID)
+		}
+
+		id, err := im.existingID("SELECT rowid FROM enigma_keys WHERE key_id=?", k.KeyID)
+		if err != nil {
+			return err
+		}
+		if id != 0 {
+			if !im.conflict("enigma_key", k.KeyID) {
+				im.rep.Skipped["enigma_keys"]++
+				continue
+			}
+			_, err := im.tx.Exec("UPDATE enigma_keys SET activates_at=?, expires_at=?, retired_at=? WHERE key_id=?",
+				k.ActivatesAt, k.ExpiresAt, k.RetiredAt, k.KeyID)
+			if err != nil {
+				return err
+			}
+			im.rep.Updated["enigma_keys"]++
+			continue
+		}
+		sealed, err := secrets.Seal(k.PrivateKey)
+		if err != nil {
+			return err
+		}
+		_, err = im.tx.Exec("INSERT INTO enigma_keys ("+enigmaKeyColumns+") VALUES (?, ?, ?, ?, ?, ?)",
+			k.KeyID, sealed, k.CreatedAt, k.ActivatesAt, k.ExpiresAt, k.RetiredAt)
+		if err != nil {
+			return err
+		}
+		im.rep.Created["enigma_keys"]++
+	}
+	return nil
+}
+
+// GET /api/export - the bundle as a download; ?secrets=true includes node,
+// inbound and device keys, subscription tokens, the credential secret and the
+// Enigma keyring in plaintext. Owners only, behind a step-up.
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if currentAdmin(r).Role != roleOwner {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	includeSecrets := r.URL.Query().Get("secrets") == "true"
+	b, err := buildExport(includeSecrets)
+	if err != nil {
+		http.Error(w, "Export Failed: "+err.Error(), 500)
+		return
+	}
+	recordAudit(r, "export.download", "export", "", nil, map[string]interface{}{"include_secrets": includeSecrets})
+	name := "horizon-export-" + time.Now().UTC().Format("20060102-150405") + ".json"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(b)
+}
+
+// POST /api/import?conflict=abort|skip|overwrite&dry_run=true - the body is
+// an export bundle. Answers with the import report; 409 if it was aborted
+// over conflicts. Owners only, behind a step-up.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if currentAdmin(r).Role != roleOwner {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	var b exportBundle
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRestoreBytes)).Decode(&b); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	q := r.URL.Query()
+	rep, err := importBundle(&b, q.Get("conflict"), q.Get("dry_run") == "true")
+	if err != nil {
+		http.Error(w, "Import Failed: "+err.Error(), 400)
+		return
+	}
+	if rep.Applied {
+		recordAudit(r, "import.apply", "import", "", nil, map[string]interface{}{
+			"created": rep.Created, "updated": rep.Updated, "skipped": rep.Skipped,
+		})
+	}
+	if !rep.DryRun && !rep.Applied {
+		w.WriteHeader(409)
+	}
+	json.NewEncoder(w).Encode(rep)
+}
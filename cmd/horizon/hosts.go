@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"aether/internal/horizon/db"
+)
+
+// Host is a public endpoint for an inbound tag: a CDN domain, a relay port or
+// another SNI in front of the same inbound. Empty fields keep the inbound's
+// own value; an empty address means the node IP.
+type Host struct {
+	ID          int    `json:"id"`
+	InboundTag  string `json:"inbound_tag"`
+	NodeID      int    `json:"node_id"` // 0 = every node serving the tag
+	Remark      string `json:"remark"`
+	Address     string `json:"address"`
+	Port        int    `json:"port"`
+	SNI         string `json:"sni"`
+	Host        string `json:"host"`
+	Path        string `json:"path"`
+	ALPN        string `json:"alpn"` // Comma separated, e.g. "h2,http/1.1"
+	Fingerprint string `json:"fingerprint"`
+	Enabled     bool   `json:"enabled"`
+	Priority    int    `json:"priority"`
+}
+
+const hostColumns = "id, inbound_tag, node_id, remark, address, port, sni, host, path, alpn, fingerprint, enabled, priority"
+
+func scanHost(scan func(...interface{}) error) (Host, error) {
+	var h Host
+	err := scan(&h.ID, &h.InboundTag, &h.NodeID, &h.Remark, &h.Address, &h.Port,
+		&h.SNI, &h.Host, &h.Path, &h.ALPN, &h.Fingerprint, &h.Enabled, &h.Priority)
+	return h, err
+}
+
+// loadHosts returns the enabled hosts grouped by inbound tag, in priority order.
+func loadHosts() (map[string][]Host, error) {
+	rows, err := db.DB.Query("SELECT " + hostColumns + " FROM hosts WHERE enabled=1 ORDER BY priority, id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hosts := make(map[string][]Host)
+	for rows.Next() {
+		h, err := scanHost(rows.Scan)
+		if err != nil {
+			continue
+		}
+		hosts[h.InboundTag] = append(hosts[h.InboundTag], h)
+	}
+	return hosts, nil
+}
+
+// applyHost overrides the endpoint fields of p with those set on h.
+func applyHost(p Proxy, h Host) Proxy {
+	if h.Remark != "" {
+		p.Remark = h.Remark
+	}
+	if h.Address != "" {
+		p.Address = h.Address
+	}
+	if h.Port > 0 {
+		p.Port = h.Port
+	}
+	if h.SNI != "" && (p.Security == "tls" || p.Security == "reality") {
+		p.SNI = h.SNI
+	}
+	if h.Host != "" {
+		p.Host = h.Host
+	}
+	if h.Path != "" {
+		if p.Network == "grpc" {
+			p.ServiceName = h.Path
+		} else {
+			p.Path = h.Path
+		}
+	}
+	if h.ALPN != "" && p.Security == "tls" {
+		p.ALPN = h.ALPN
+	}
+	if h.Fingerprint != "" && p.Security != "none" {
+		p.Fingerprint = h.Fingerprint
+	}
+	return p
+}
+
+func handleHosts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	switch r.Method {
+	case "GET":
+		query := "SELECT " + hostColumns + " FROM hosts"
+		var args []interface{}
+		if tag := r.URL.Query().Get("tag"); tag != "" {
+			query += " WHERE inbound_tag=?"
+			args = append(args, tag)
+		}
+		rows, err := db.DB.Query(query+" ORDER BY inbound_tag, priority, id", args...)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer rows.Close()
+
+		list := []Host{}
+		for rows.Next() {
+			if h, err := scanHost(rows.Scan); err == nil {
+				list = append(list, h)
+			}
+		}
+		json.NewEncoder(w).Encode(list)
+
+	case "POST":
+		h := Host{Enabled: true}
+		if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if h.InboundTag == "" {
+			http.Error(w, "inbound_tag is required", 400)
+			return
+		}
+		h.ALPN = strings.ReplaceAll(h.ALPN, " ", "")
+		res, err := db.DB.Exec(`
+			INSERT INTO hosts (inbound_tag, node_id, remark, address, port, sni, host, path, alpn, fingerprint, enabled, priority)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, h.InboundTag, h.NodeID, h.Remark, h.Address, h.Port, h.SNI, h.Host, h.Path, h.ALPN, h.Fingerprint, h.Enabled, h.Priority)
+		if err != nil {
+			http.Error(w, "Create Failed: "+err.Error(), 500)
+			return
+		}
+		id, _ := res.LastInsertId()
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": id})
+
+	case "PUT":
+		var h Host
+		if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if h.InboundTag == "" {
+			http.Error(w, "inbound_tag is required", 400)
+			return
+		}
+		h.ALPN = strings.ReplaceAll(h.ALPN, " ", "")
+		res, err := db.DB.Exec(`
+			UPDATE hosts SET inbound_tag=?, node_id=?, remark=?, address=?, port=?, sni=?, host=?, path=?,
+				alpn=?, fingerprint=?, enabled=?, priority=?
+			WHERE id=?
+		`, h.InboundTag, h.NodeID, h.Remark, h.Address, h.Port, h.SNI, h.Host, h.Path, h.ALPN, h.Fingerprint, h.Enabled, h.Priority, h.ID)
+		if err != nil {
+			http.Error(w, "Update Failed", 500)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Host not found", 404)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+
+	case "DELETE":
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "Missing ID", 400)
+			return
+		}
+		if _, err := db.DB.Exec("DELETE FROM hosts WHERE id=?", id); err != nil {
+			http.Error(w, "Delete Failed", 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
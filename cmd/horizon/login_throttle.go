@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Login throttling. Failed password and two-factor checks are counted per
+// client IP and per username. After loginFreeAttempts failures each further
+// attempt has to wait twice as long as the last, up to loginMaxDelay, and is
+// answered 429 with Retry-After until then. Success clears both counts.
+// Counts are kept in memory only; failures idle for loginForgetAfter are
+// dropped.
+
+const (
+	loginFreeAttempts = 5
+	loginBaseDelay    = time.Second
+	loginMaxDelay     = 15 * time.Minute
+	loginForgetAfter  = time.Hour
+)
+
+type loginFailures struct {
+	count int
+	last  time.Time
+}
+
+type loginThrottle struct {
+	mu        sync.Mutex
+	failures  map[string]*loginFailures
+	lastSweep time.Time
+}
+
+var loginLimiter = &loginThrottle{failures: map[string]*loginFailures{}}
+
+// loginKeys names the counters a login attempt for username from r touches.
+func loginKeys(r *http.Request, username string) []string {
+	return []string{"ip:" + auditIP(r), "user:" + strings.ToLower(username)}
+}
+
+func (f *loginFailures) delay() time.Duration {
+	over := f.count - loginFreeAttempts
+	if over < 0 {
+		return 0
+	}
+	if over > 10 {
+		return loginMaxDelay
+	}
+	return min(loginBaseDelay<<over, loginMaxDelay)
+}
+
+// wait returns how long the longest-throttled key still has to wait.
+func (t *loginThrottle) wait(keys []string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		if f := t.failures[key]; f != nil {
+			wait = max(wait, f.last.Add(f.delay()).Sub(now))
+		}
+	}
+	return wait
+}
+
+func (t *loginThrottle) fail(keys []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if now.Sub(t.lastSweep) > time.Minute {
+		for key, f := range t.failures {
+			if now.Sub(f.last) > loginForgetAfter {
+				delete(t.failures, key)
+			}
+		}
+		t.lastSweep = now
+	}
+	for _, key := range keys {
+		f := t.failures[key]
+		if f == nil || now.Sub(f.last) > loginForgetAfter {
+			f = &loginFailures{}
+			t.failures[key] = f
+		}
+		f.count++
+		f.last = now
+	}
+}
+
+func (t *loginThrottle) reset(keys []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		delete(t.failures, key)
+	}
+}
+
+// loginThrottled writes the 429 if keys are still waiting out a backoff.
+func loginThrottled(w http.ResponseWriter, keys []string) bool {
+	wait := loginLimiter.wait(keys)
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+	return true
+}
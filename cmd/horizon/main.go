@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -15,16 +16,89 @@ import (
 
 	"aether/internal/horizon/core"
 	"aether/internal/horizon/db"
-	"aether/pkg/enigma"
+	"aether/internal/horizon/secrets"
 
 	"github.com/google/uuid"
 )
 
 func main() {
+	createAdminName := flag.String("create-admin", "", "create an admin account with this username and exit")
+	rekeyFile := flag.String("rekey", "", "re-encrypt all secrets under the key in this file (created if missing) and exit; stop Horizon first")
+	flag.Parse()
+
 	log.Println("🌅 Starting Project Horizon (Backend)...")
 	db.Init("horizon.db")
+
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(flag.Args()[1:]); err != nil {
+			log.Fatalln("❌ Migration Failed:", err)
+		}
+		return
+	}
+
+	if err := secrets.Init(); err != nil {
+		log.Fatalln("❌ Failed to load key-encryption key:", err)
+	}
+
+	if flag.Arg(0) == "restore" {
+		if flag.NArg() != 2 {
+			log.Fatalln("❌ Usage: horizon restore <backup file>")
+		}
+		if err := runRestore(flag.Arg(1)); err != nil {
+			log.Fatalln("❌ Restore Failed:", err)
+		}
+		log.Println("✅ Restored", flag.Arg(1))
+		return
+	}
+
+	if flag.Arg(0) == "import" {
+		migrateSchema()
+		sealSecretsAtRest()
+		if err := runImport(flag.Args()[1:]); err != nil {
+			log.Fatalln("❌ Import Failed:", err)
+		}
+		return
+	}
+
+	if *rekeyFile != "" {
+		migrateSchema()
+		sealSecretsAtRest()
+		if err := runRekey(*rekeyFile); err != nil {
+			log.Fatalln("❌ Rekey Failed:", err)
+		}
+		return
+	}
+
+	if *createAdminName != "" {
+		migrateSchema()
+		sealSecretsAtRest()
+		if err := runCreateAdmin(*createAdminName); err != nil {
+			log.Fatalln("❌ Failed to create admin:", err)
+		}
+		log.Println("✅ Admin created:", *createAdminName)
+		return
+	}
+
 	go core.StartSyncer()
 
+	// 🔐 Admin Auth (every other /api/ route requires a session, see auth.go)
+	http.HandleFunc("/api/auth/login", handleLogin)
+	http.HandleFunc("/api/auth/logout", handleLogout)
+	http.HandleFunc("/api/auth/me", handleAuthMe)
+	http.HandleFunc("/api/auth/verify", handleStepUp)
+	http.HandleFunc("/api/auth/2fa", handleMFAStatus)
+	http.HandleFunc("/api/auth/2fa/setup", handleMFASetup)
+	http.HandleFunc("/api/auth/2fa/enable", handleMFAEnable)
+	http.HandleFunc("/api/auth/2fa/disable", handleMFADisable)
+	http.HandleFunc("/api/auth/2fa/recovery-codes", handleMFARecoveryCodes)
+	http.HandleFunc("/api/admins", handleAdmins)
+	http.HandleFunc("/api/audit", handleAudit)
+	http.HandleFunc("/api/tokens", handleAPITokens)
+	http.HandleFunc("/api/backup", handleBackup)
+	http.HandleFunc("/api/backup/restore", handleBackupRestore)
+	http.HandleFunc("/api/export", handleExport)
+	http.HandleFunc("/api/import", handleImport)
+
 	// Existing APIs
 	http.HandleFunc("/api/nodes", handleNodes)
 	http.HandleFunc("/api/nodes/config", handleNodesConfig)
@@ -41,232 +115,55 @@ func main() {
 	http.HandleFunc("/api/user/from_template", handleUserFromTemplate)
 	http.HandleFunc("/api/users/bulk/from_template", handleUsersBulkFromTemplate)
 	http.HandleFunc("/sub", handleSubscription)
+	http.HandleFunc("/sub/{token}", handleSubscription)
+	http.HandleFunc("/api/users/sub-token", handleUserSubToken)
 	http.HandleFunc("/api/admin/stats", handleAdminStats)
 	// http.HandleFunc("/api/groups/configs", handleGroupConfigs)
 	http.HandleFunc("/api/users/assign-group", handleUserGroup)
+	http.HandleFunc("/api/settings", handleSettings)
+	http.HandleFunc("/api/hosts", handleHosts)
 
 	// 🛡️ Project Enigma
-	// http.HandleFunc("/api/v1/secure", handleSecure)
+	http.HandleFunc("/api/v1/secure", handleSecure)
+	http.HandleFunc("/api/v1/secure/key", handleSecureKey)
+	http.HandleFunc("/api/enigma/keys", handleEnigmaKeys)
+	http.HandleFunc("/api/enigma/keys/{id}/activate", handleEnigmaKeyActivate)
+	http.HandleFunc("/api/enigma/keys/{id}/retire", handleEnigmaKeyRetire)
 	// http.HandleFunc("/api/v1/test-secure", handleTestSecure) // Unencrypted for development
 	http.HandleFunc("/api/devices", handleDevices)
 
+	// 📈 Usage Charts
+	http.HandleFunc("/api/users/{uuid}/usage", handleUserUsage)
+	http.HandleFunc("/api/nodes/{id}/usage", handleNodeUsage)
+	http.HandleFunc("/api/nodes/{id}/master-key", handleNodeMasterKey)
+	http.HandleFunc("/sub/{token}/usage", handleUserUsage) // Self-service
+
 	log.Println("🚀 Horizon Backend running on :8080")
 	log.Println("🚀 Horizon Backend running on :8080")
 
 	// Run Migrations Synchronously
 	migrateSchema()
+	sealSecretsAtRest()
+	go startUsageResetter()
+	go core.StartUsagePruner()
+	go startAuditPruner()
+	go startBackupScheduler()
+
+	var admins int
+	db.DB.QueryRow("SELECT COUNT(*) FROM admins").Scan(&admins)
+	if admins == 0 {
+		log.Println("⚠️ No admin accounts yet, the API is locked. Create one with: horizon -create-admin <username>")
+	}
 
-	http.ListenAndServe(":8080", nil)
+	http.ListenAndServe(":8080", requireAdmin(http.DefaultServeMux))
 }
 
+// migrateSchema applies pending migrations (see internal/horizon/db).
 func migrateSchema() {
 	log.Println("🔄 Checking Database Schema...")
-
-	// 1. Configs Port Migration (Int -> Text)
-	var cid int
-	var name, ctype string
-	var notnull, pk int
-	var dfltValue interface{}
-
-	needsPortMigration := false
-	rows, err := db.DB.Query("PRAGMA table_info(core_configs)")
-	if err != nil {
-		log.Println("❌ Schema Check Error (core_configs):", err)
-	} else {
-		for rows.Next() {
-			rows.Scan(&cid, &name, &ctype, &notnull, &dfltValue, &pk)
-			if name == "port" && ctype != "TEXT" {
-				needsPortMigration = true
-			}
-		}
-		rows.Close()
-	}
-
-	if needsPortMigration {
-		log.Println("⚠️ Migrating 'port' column to TEXT...")
-		_, err := db.DB.Exec(`
-			ALTER TABLE core_configs ADD COLUMN port_new TEXT;
-			UPDATE core_configs SET port_new = CAST(port AS TEXT);
-			ALTER TABLE core_configs DROP COLUMN port;
-			ALTER TABLE core_configs RENAME COLUMN port_new TO port;
-		`)
-		if err != nil {
-			log.Println("❌ Port Migration Failed:", err)
-		} else {
-			log.Println("✅ Port Migration Successful.")
-		}
+	if err := db.Migrate(); err != nil {
+		log.Fatalln("❌ Migration Failed:", err)
 	}
-
-	// 2. Users Device Limit Migration
-	needsLimitMigration := true
-	rows, err = db.DB.Query("PRAGMA table_info(users)")
-	if err != nil {
-		log.Println("❌ Schema Check Error (users):", err)
-	} else {
-		log.Println("🔍 Inspecting 'users' table columns:")
-		for rows.Next() {
-			rows.Scan(&cid, &name, &ctype, &notnull, &dfltValue, &pk)
-			log.Printf("   - Column: %s (%s)", name, ctype)
-			if name == "device_limit" {
-				needsLimitMigration = false
-			}
-		}
-		rows.Close()
-	}
-
-	if needsLimitMigration {
-		log.Println("⚠️ Adding 'device_limit' column to users...")
-		_, err := db.DB.Exec("ALTER TABLE users ADD COLUMN device_limit INTEGER DEFAULT 3")
-		if err != nil {
-			log.Println("❌ Device Limit Migration Failed:", err)
-		} else {
-			log.Println("✅ Device Limit Migration Successful.")
-		}
-	} else {
-		log.Println("✅ 'device_limit' column exists.")
-	}
-
-	// 3. Multi-Node Configs Migration (Phase 13)
-	// Create node_configs table for M:N relationship
-	_, err = db.DB.Exec(`
-		CREATE TABLE IF NOT EXISTS node_configs (
-			node_id INTEGER,
-			config_id INTEGER,
-			PRIMARY KEY (node_id, config_id),
-			FOREIGN KEY(node_id) REFERENCES nodes(id),
-			FOREIGN KEY(config_id) REFERENCES core_configs(id)
-		)
-	`)
-	if err != nil {
-		log.Println("❌ Failed to create table node_configs:", err)
-	}
-
-	// Add raw_inbounds to core_configs if not exists
-	needsRawMigration := true
-	rows, err = db.DB.Query("PRAGMA table_info(core_configs)")
-	if err == nil {
-		for rows.Next() {
-			rows.Scan(&cid, &name, &ctype, &notnull, &dfltValue, &pk)
-			if name == "raw_inbounds" {
-				needsRawMigration = false
-			}
-		}
-		rows.Close()
-	}
-
-	if needsRawMigration {
-		log.Println("⚠️ Adding 'raw_inbounds' column to core_configs...")
-		_, err := db.DB.Exec("ALTER TABLE core_configs ADD COLUMN raw_inbounds TEXT")
-		if err != nil {
-			log.Println("❌ Raw Inbounds Migration Failed:", err)
-		} else {
-			log.Println("✅ Raw Inbounds Migration Successful.")
-		}
-	}
-
-	// Phase 13.5: Add base_config to nodes for Global Settings (DNS/Routing)
-	needsBaseConfig := true
-	rows, err = db.DB.Query("PRAGMA table_info(nodes)")
-	if err == nil {
-		for rows.Next() {
-			rows.Scan(&cid, &name, &ctype, &notnull, &dfltValue, &pk)
-			if name == "base_config" {
-				needsBaseConfig = false
-			}
-		}
-		rows.Close()
-	}
-
-	if needsBaseConfig {
-		log.Println("⚠️ Adding 'base_config' column to nodes...")
-		_, err := db.DB.Exec("ALTER TABLE nodes ADD COLUMN base_config TEXT")
-		if err != nil {
-			log.Println("❌ Base Config Migration Failed:", err)
-		} else {
-			log.Println("✅ Base Config Migration Successful.")
-		}
-	}
-
-	// Phase 14: Groups Access Control Migration
-	_, err = db.DB.Exec(`
-		CREATE TABLE IF NOT EXISTS groups (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT UNIQUE NOT NULL,
-			is_disabled BOOLEAN DEFAULT 0
-		);
-
-		CREATE TABLE IF NOT EXISTS group_inbounds (
-			group_id INTEGER,
-			inbound_tag TEXT,
-			PRIMARY KEY (group_id, inbound_tag),
-			FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE
-		);
-
-		CREATE TABLE IF NOT EXISTS user_groups (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_uuid TEXT NOT NULL,
-			group_id INTEGER NOT NULL,
-			FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE,
-			FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE,
-			UNIQUE(user_uuid, group_id)
-		);
-	`)
-	if err != nil {
-		log.Println("❌ Failed to create Group tables:", err)
-	}
-
-	// 14.1 Fix Legacy Groups Table (Missing is_disabled)
-	needsGroupDisabled := true
-	rows, err = db.DB.Query("PRAGMA table_info(groups)")
-	if err == nil {
-		for rows.Next() {
-			rows.Scan(&cid, &name, &ctype, &notnull, &dfltValue, &pk)
-			if name == "is_disabled" {
-				needsGroupDisabled = false
-			}
-		}
-		rows.Close()
-	}
-
-	if needsGroupDisabled {
-		log.Println("⚠️ Adding 'is_disabled' column to groups...")
-		_, err := db.DB.Exec("ALTER TABLE groups ADD COLUMN is_disabled BOOLEAN DEFAULT 0")
-		if err != nil {
-			log.Println("❌ Group Disabled Migration Failed:", err)
-		} else {
-			log.Println("✅ Group Disabled Migration Successful.")
-		}
-	}
-
-	// Phase 15: User Templates Migration
-	_, err = db.DB.Exec(`
-		CREATE TABLE IF NOT EXISTS user_templates (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			name TEXT UNIQUE NOT NULL,
-			data_limit INTEGER DEFAULT 0,
-			expire_duration INTEGER DEFAULT 0,
-			username_prefix TEXT,
-			username_suffix TEXT,
-			status TEXT DEFAULT 'active',
-			data_limit_reset_strategy TEXT DEFAULT 'no_reset',
-			extra_settings TEXT, -- JSON
-			is_disabled BOOLEAN DEFAULT 0
-		);
-
-		CREATE TABLE IF NOT EXISTS template_group_association (
-			template_id INTEGER,
-			group_id INTEGER,
-			PRIMARY KEY (template_id, group_id),
-			FOREIGN KEY(template_id) REFERENCES user_templates(id) ON DELETE CASCADE,
-			FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE
-		);
-	`)
-	if err != nil {
-		log.Println("❌ Failed to create User Template tables:", err)
-	} else {
-		log.Println("✅ User Template tables verified.")
-	}
-
 	log.Println("✅ Schema Check Complete.")
 }
 
@@ -275,18 +172,18 @@ func migrateSchema() {
 func handleNodes(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		rows, _ := db.DB.Query("SELECT id, name, ip, admin_port, master_key, status, base_config FROM nodes")
+		// Master keys are only shown through /api/nodes/{id}/master-key
+		rows, _ := db.DB.Query("SELECT id, name, ip, admin_port, status, base_config FROM nodes")
 		defer rows.Close()
 		var list []map[string]interface{}
 		for rows.Next() {
 			var id int
-			var name, ip, adminPort, masterKey, status string
+			var name, ip, adminPort, status string
 			var baseConfig sql.NullString
-			rows.Scan(&id, &name, &ip, &adminPort, &masterKey, &status, &baseConfig)
+			rows.Scan(&id, &name, &ip, &adminPort, &status, &baseConfig)
 			list = append(list, map[string]interface{}{
 				"id": id, "name": name, "ip": ip, "admin_port": adminPort,
-				"master_key": masterKey, "status": status,
-				"base_config": baseConfig.String,
+				"status": status, "base_config": baseConfig.String,
 			})
 		}
 		json.NewEncoder(w).Encode(list)
@@ -303,8 +200,12 @@ func handleNodes(w http.ResponseWriter, r *http.Request) {
   "routing": { "domainStrategy": "IPIfNonMatch", "rules": [] },
   "outbounds": [{ "protocol": "freedom", "tag": "DIRECT" }]
 }`
-		// Generate Master Key
-		masterKey := generateRandomKey()
+		// Generate Master Key (sealed; shown on demand by /api/nodes/{id}/master-key)
+		masterKey, err := secrets.Seal(generateRandomKey())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		adminPort := "8081"
 
 		res, err := db.DB.Exec("INSERT INTO nodes (name, ip, admin_port, master_key, status, base_config) VALUES (?, ?, ?, ?, 'offline', ?)",
@@ -314,11 +215,11 @@ func handleNodes(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		id, _ := res.LastInsertId()
+		recordAudit(r, "node.create", "node", id, nil, auditRow("nodes", "id", id))
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"id": int(id), "name": n.Name, "ip": n.IP,
-			"admin_port": adminPort, "master_key": masterKey,
-			"status": "offline", "base_config": defaultBase,
+			"admin_port": adminPort, "status": "offline", "base_config": defaultBase,
 		})
 
 	case "PUT":
@@ -329,6 +230,7 @@ func handleNodes(w http.ResponseWriter, r *http.Request) {
 			BaseConfig string `json:"base_config"`
 		}
 		json.NewDecoder(r.Body).Decode(&n)
+		before := auditRow("nodes", "id", n.ID)
 
 		// If BaseConfig is provided, update it too
 		if n.BaseConfig != "" {
@@ -345,30 +247,60 @@ func handleNodes(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		// Re-fetch to return full object including master key
+		recordAudit(r, "node.update", "node", n.ID, before, auditRow("nodes", "id", n.ID))
+
+		// Re-fetch to return the full object
 		var id int
-		var name, ip, adminPort, masterKey, status string
+		var name, ip, adminPort, status string
 		var baseConfig sql.NullString
-		db.DB.QueryRow("SELECT id, name, ip, admin_port, master_key, status, base_config FROM nodes WHERE id=?", n.ID).
-			Scan(&id, &name, &ip, &adminPort, &masterKey, &status, &baseConfig)
+		db.DB.QueryRow("SELECT id, name, ip, admin_port, status, base_config FROM nodes WHERE id=?", n.ID).
+			Scan(&id, &name, &ip, &adminPort, &status, &baseConfig)
 
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"id": id, "name": name, "ip": ip, "admin_port": adminPort,
-			"master_key": masterKey, "status": status,
-			"base_config": baseConfig.String,
+			"status": status, "base_config": baseConfig.String,
 		})
 	case "DELETE":
 		id := r.URL.Query().Get("id")
+		before := auditRow("nodes", "id", id)
 		db.DB.Exec("DELETE FROM node_configs WHERE node_id=?", id)
 		_, err := db.DB.Exec("DELETE FROM nodes WHERE id=?", id)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		recordAudit(r, "node.delete", "node", id, before, nil)
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	}
 }
 
+// GET /api/nodes/{id}/master-key - owners and admins only, behind a step-up
+// (see mfa.go). The key is the node agent's credential, so read-only admins
+// don't get it with the rest of the GETs.
+func handleNodeMasterKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	if a := currentAdmin(r); a.Role != roleOwner && a.Role != roleAdmin {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	var masterKey string
+	if err := db.DB.QueryRow("SELECT master_key FROM nodes WHERE id=?", r.PathValue("id")).Scan(&masterKey); err != nil {
+		http.Error(w, "Node not found", 404)
+		return
+	}
+	masterKey, err := secrets.Open(masterKey)
+	if err != nil {
+		http.Error(w, "Secret Error: "+err.Error(), 500)
+		return
+	}
+	recordAudit(r, "node.reveal_master_key", "node", r.PathValue("id"), nil, nil)
+	json.NewEncoder(w).Encode(map[string]interface{}{"master_key": masterKey})
+}
+
 // Proxy: Forward /api/nodes/config -> http://<NodeIP>:8081/api/config
 func handleNodesConfig(w http.ResponseWriter, r *http.Request) {
 	idStr := r.URL.Query().Get("id")
@@ -419,14 +351,21 @@ func handleUsers(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		// Modified query to include group_name using LEFT JOIN and device_count
+		// Resellers only see the users they own
+		where, args := "", []interface{}{}
+		if isReseller(r) {
+			where, args = "WHERE u.owner_admin_id = ?", append(args, currentAdminID(r))
+		}
 		rows, err := db.DB.Query(`
 			SELECT u.uuid, u.name, u.limit_gb, u.device_limit, u.used_bytes, u.expiry, u.status, 
+			       IFNULL(u.data_limit_reset_strategy, 'no_reset'), IFNULL(u.last_reset_at, 0),
+			       IFNULL(u.upload_bytes, 0), IFNULL(u.download_bytes, 0), IFNULL(u.hwid_limit, 0),
 			       g.name, g.id,
 			       (SELECT COUNT(*) FROM user_devices WHERE user_uuid = u.uuid) as device_count
 			FROM users u
 			LEFT JOIN user_groups ug ON u.uuid = ug.user_uuid
 			LEFT JOIN groups g ON ug.group_id = g.id
-		`)
+		`+where, args...)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
@@ -435,27 +374,33 @@ func handleUsers(w http.ResponseWriter, r *http.Request) {
 
 		users := []map[string]interface{}{}
 		for rows.Next() {
-			var uuid, name, status string
+			var uuid, name, status, resetStrategy string
 			var groupName sql.NullString
 			var groupID sql.NullInt64
 			var limitGB float64
 			var deviceLimit, deviceCount int
-			var usedBytes, expiry int64
+			var usedBytes, expiry, lastResetAt, uploadBytes, downloadBytes int64
+			var hwidLimit bool
 
-			err := rows.Scan(&uuid, &name, &limitGB, &deviceLimit, &usedBytes, &expiry, &status, &groupName, &groupID, &deviceCount)
+			err := rows.Scan(&uuid, &name, &limitGB, &deviceLimit, &usedBytes, &expiry, &status, &resetStrategy, &lastResetAt, &uploadBytes, &downloadBytes, &hwidLimit, &groupName, &groupID, &deviceCount)
 			if err != nil {
 				continue
 			}
 
 			userMap := map[string]interface{}{
-				"uuid":         uuid,
-				"name":         name,
-				"limit_gb":     limitGB,
-				"device_limit": deviceLimit,
-				"device_count": deviceCount,
-				"used_bytes":   usedBytes,
-				"expiry":       expiry,
-				"status":       status,
+				"uuid":                      uuid,
+				"name":                      name,
+				"limit_gb":                  limitGB,
+				"device_limit":              deviceLimit,
+				"device_count":              deviceCount,
+				"hwid_limit":                hwidLimit,
+				"used_bytes":                usedBytes,
+				"upload_bytes":              uploadBytes,
+				"download_bytes":            downloadBytes,
+				"expiry":                    expiry,
+				"status":                    status,
+				"last_reset_at":             lastResetAt,
+				"data_limit_reset_strategy": resetStrategy,
 			}
 
 			if groupName.Valid {
@@ -468,11 +413,13 @@ func handleUsers(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(users)
 	case "POST":
 		var u struct {
-			UUID        string  `json:"uuid"`
-			Name        string  `json:"name"`
-			LimitGB     float64 `json:"limit_gb"`
-			DeviceLimit int     `json:"device_limit"`
-			Expiry      int64   `json:"expiry"`
+			UUID          string  `json:"uuid"`
+			Name          string  `json:"name"`
+			LimitGB       float64 `json:"limit_gb"`
+			DeviceLimit   int     `json:"device_limit"`
+			Expiry        int64   `json:"expiry"`
+			ResetStrategy string  `json:"data_limit_reset_strategy"`
+			HWIDLimit     bool    `json:"hwid_limit"`
 		}
 		json.NewDecoder(r.Body).Decode(&u)
 		if u.UUID == "" {
@@ -481,40 +428,100 @@ func handleUsers(w http.ResponseWriter, r *http.Request) {
 		if u.DeviceLimit == 0 {
 			u.DeviceLimit = 3
 		}
-		_, err := db.DB.Exec("INSERT INTO users (uuid, name, limit_gb, device_limit, expiry) VALUES (?, ?, ?, ?, ?)",
-			u.UUID, u.Name, u.LimitGB, u.DeviceLimit, u.Expiry)
+		if !validResetStrategy(u.ResetStrategy) {
+			http.Error(w, "Invalid data_limit_reset_strategy", 400)
+			return
+		}
+		if u.ResetStrategy == "" {
+			u.ResetStrategy = "no_reset"
+		}
+		if err := checkResellerQuota(r, 1, u.LimitGB, u.LimitGB == 0); err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		_, err := db.DB.Exec("INSERT INTO users (uuid, name, limit_gb, device_limit, expiry, data_limit_reset_strategy, last_reset_at, hwid_limit, owner_admin_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			u.UUID, u.Name, u.LimitGB, u.DeviceLimit, u.Expiry, u.ResetStrategy, time.Now().Unix(), u.HWIDLimit, currentAdminID(r))
 
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		json.NewEncoder(w).Encode(map[string]string{"status": "ok", "uuid": u.UUID})
+		recordAudit(r, "user.create", "user", u.UUID, nil, auditUser(u.UUID))
+		resp := map[string]string{"status": "ok", "uuid": u.UUID}
+		if token, err := issueSubToken(u.UUID, 0); err == nil {
+			resp["subscription_url"] = subscriptionURL(r, token)
+		}
+		json.NewEncoder(w).Encode(resp)
 
 	case "PUT":
 		var u struct {
-			UUID        string  `json:"uuid"`
-			Name        string  `json:"name"`
-			LimitGB     float64 `json:"limit_gb"`
-			DeviceLimit int     `json:"device_limit"`
-			Expiry      int64   `json:"expiry"`
-			Status      string  `json:"status"`
+			UUID          string  `json:"uuid"`
+			Name          string  `json:"name"`
+			LimitGB       float64 `json:"limit_gb"`
+			DeviceLimit   int     `json:"device_limit"`
+			Expiry        int64   `json:"expiry"`
+			Status        string  `json:"status"`
+			ResetStrategy string  `json:"data_limit_reset_strategy"`
+			HWIDLimit     bool    `json:"hwid_limit"`
 		}
 		json.NewDecoder(r.Body).Decode(&u)
+		if !validResetStrategy(u.ResetStrategy) {
+			http.Error(w, "Invalid data_limit_reset_strategy", 400)
+			return
+		}
+		var oldLimitGB float64
+		var oldStatus string
+		var usedBytes int64
+		err := db.DB.QueryRow("SELECT limit_gb, IFNULL(status, 'active'), IFNULL(used_bytes, 0) FROM users WHERE uuid=?", u.UUID).
+			Scan(&oldLimitGB, &oldStatus, &usedBytes)
+		if err != nil || !canManageUser(r, u.UUID) {
+			http.Error(w, "User not found", 404)
+			return
+		}
+		if err := checkResellerQuota(r, 0, u.LimitGB-oldLimitGB, u.LimitGB == 0); err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
+		// Status is only changed when provided
+		if u.Status == "" {
+			u.Status = oldStatus
+		}
+		if !userStatuses[u.Status] {
+			http.Error(w, "Invalid status", 400)
+			return
+		}
+		if err := checkStatusChange(r, oldStatus, u.Status, u.LimitGB, usedBytes); err != nil {
+			http.Error(w, err.Error(), 403)
+			return
+		}
 
-		_, err := db.DB.Exec("UPDATE users SET name=?, limit_gb=?, device_limit=?, expiry=?, status=? WHERE uuid=?",
-			u.Name, u.LimitGB, u.DeviceLimit, u.Expiry, u.Status, u.UUID)
+		before := auditUser(u.UUID)
+
+		// Strategy is only changed when provided
+		_, err = db.DB.Exec(`
+			UPDATE users SET name=?, limit_gb=?, device_limit=?, expiry=?, status=?, hwid_limit=?,
+			       data_limit_reset_strategy=COALESCE(NULLIF(?, ''), data_limit_reset_strategy)
+			WHERE uuid=?`,
+			u.Name, u.LimitGB, u.DeviceLimit, u.Expiry, u.Status, u.HWIDLimit, u.ResetStrategy, u.UUID)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		recordAudit(r, "user.update", "user", u.UUID, before, auditUser(u.UUID))
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	case "DELETE":
 		uuid := r.URL.Query().Get("uuid")
+		if !canManageUser(r, uuid) {
+			http.Error(w, "User not found", 404)
+			return
+		}
+		before := auditUser(uuid)
 		_, err := db.DB.Exec("DELETE FROM users WHERE uuid=?", uuid)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		recordAudit(r, "user.delete", "user", uuid, before, nil)
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	}
 }
@@ -544,7 +551,7 @@ func handleUserConfig(w http.ResponseWriter, r *http.Request) {
 	// 1. Get user name (check existence)
 	var name string
 	err := db.DB.QueryRow("SELECT name FROM users WHERE uuid=?", uuid).Scan(&name)
-	if err != nil {
+	if err != nil || !canManageUser(r, uuid) {
 		http.Error(w, "user not found", 404)
 		return
 	}
@@ -640,12 +647,19 @@ func handleUserRenew(w http.ResponseWriter, r *http.Request) {
 		OldUUID string `json:"old_uuid"`
 	}
 	json.NewDecoder(r.Body).Decode(&req)
+	if !canManageUser(r, req.OldUUID) {
+		http.Error(w, "User not found", 404)
+		return
+	}
 	newUUID := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%d", time.Now().UnixNano()))))[:32]
-	_, err := db.DB.Exec("UPDATE users SET uuid=? WHERE uuid=?", newUUID, req.OldUUID)
+	before := auditUser(req.OldUUID)
+	// Imported passwords go too, so every credential rotates with the UUID
+	_, err := db.DB.Exec("UPDATE users SET uuid=?, trojan_password='', ss_password='' WHERE uuid=?", newUUID, req.OldUUID)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	recordAudit(r, "user.renew", "user", newUUID, before, auditUser(newUUID))
 	json.NewEncoder(w).Encode(map[string]string{
 		"status":   "ok",
 		"new_uuid": newUUID,
@@ -675,7 +689,7 @@ func handleConfigs(w http.ResponseWriter, r *http.Request) {
 			rows.Scan(&id, &name, &protocol, &port, &status, &rawInbounds, &nodeCount)
 			list = append(list, map[string]interface{}{
 				"id": id, "name": name, "protocol": protocol, "port": port,
-				"status": status, "raw_inbounds": rawInbounds.String, "node_count": nodeCount,
+				"status": status, "raw_inbounds": redactInbounds(rawInbounds.String), "node_count": nodeCount,
 			})
 		}
 		json.NewEncoder(w).Encode(list)
@@ -688,13 +702,20 @@ func handleConfigs(w http.ResponseWriter, r *http.Request) {
 			RawInbounds string `json:"raw_inbounds"`
 		}
 		json.NewDecoder(r.Body).Decode(&c)
+		sealed, err := sealInbounds(c.RawInbounds)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
 		// NodeID is no longer required for Templates
-		_, err := db.DB.Exec("INSERT INTO core_configs (name, protocol, port, settings, raw_inbounds) VALUES (?, ?, ?, ?, ?)",
-			c.Name, c.Protocol, c.Port, c.Settings, c.RawInbounds)
+		res, err := db.DB.Exec("INSERT INTO core_configs (name, protocol, port, settings, raw_inbounds) VALUES (?, ?, ?, ?, ?)",
+			c.Name, c.Protocol, c.Port, c.Settings, sealed)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		id, _ := res.LastInsertId()
+		recordAudit(r, "config.create", "config", id, nil, auditRow("core_configs", "id", id))
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	case "PUT":
 		var c struct {
@@ -705,15 +726,26 @@ func handleConfigs(w http.ResponseWriter, r *http.Request) {
 			RawInbounds string `json:"raw_inbounds"`
 		}
 		json.NewDecoder(r.Body).Decode(&c)
-		_, err := db.DB.Exec("UPDATE core_configs SET name=?, protocol=?, port=?, raw_inbounds=? WHERE id=?",
-			c.Name, c.Protocol, c.Port, c.RawInbounds, c.ID)
+		before := auditRow("core_configs", "id", c.ID)
+		// The editor only ever saw "[redacted]" for secrets it didn't change
+		var stored string
+		db.DB.QueryRow("SELECT IFNULL(raw_inbounds, '') FROM core_configs WHERE id=?", c.ID).Scan(&stored)
+		sealed, err := sealInbounds(restoreRedactedInbounds(c.RawInbounds, stored))
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		_, err = db.DB.Exec("UPDATE core_configs SET name=?, protocol=?, port=?, raw_inbounds=? WHERE id=?",
+			c.Name, c.Protocol, c.Port, sealed, c.ID)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		recordAudit(r, "config.update", "config", c.ID, before, auditRow("core_configs", "id", c.ID))
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	case "DELETE":
 		id := r.URL.Query().Get("id")
+		before := auditRow("core_configs", "id", id)
 		// Clean up links first
 		db.DB.Exec("DELETE FROM node_configs WHERE config_id=?", id)
 		db.DB.Exec("DELETE FROM group_configs WHERE config_id=?", id)
@@ -722,6 +754,7 @@ func handleConfigs(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		recordAudit(r, "config.delete", "config", id, before, nil)
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	}
 }
@@ -747,6 +780,9 @@ func handleNodeConfigsAssign(w http.ResponseWriter, r *http.Request) {
 		}
 		json.NewDecoder(r.Body).Decode(&req)
 
+		const assigned = "SELECT config_id FROM node_configs WHERE node_id=? ORDER BY config_id"
+		before := auditList("config_ids", assigned, req.NodeID)
+
 		// Transaction? Simulating for now.
 		// 1. Clear existing
 		_, err := db.DB.Exec("DELETE FROM node_configs WHERE node_id=?", req.NodeID)
@@ -759,6 +795,7 @@ func handleNodeConfigsAssign(w http.ResponseWriter, r *http.Request) {
 		for _, cid := range req.ConfigIDs {
 			db.DB.Exec("INSERT INTO node_configs (node_id, config_id) VALUES (?, ?)", req.NodeID, cid)
 		}
+		recordAudit(r, "node.assign_configs", "node", req.NodeID, before, auditList("config_ids", assigned, req.NodeID))
 
 		// 3. Trigger Config Push to Agent
 		if err := pushNodeConfig(req.NodeID); err != nil {
@@ -781,6 +818,9 @@ func pushNodeConfig(nodeID int) error {
 	if err != nil {
 		return fmt.Errorf("node not found")
 	}
+	if masterKey, err = secrets.Open(masterKey); err != nil {
+		return err
+	}
 
 	// 2. Fetch all raw_inbounds for this node
 	rows, err := db.DB.Query(`
@@ -800,7 +840,11 @@ func pushNodeConfig(nodeID int) error {
 		var raw sql.NullString
 		rows.Scan(&raw)
 		if raw.Valid && raw.String != "" {
-			trimmed := strings.TrimSpace(raw.String)
+			opened, err := openInbounds(raw.String)
+			if err != nil {
+				return err
+			}
+			trimmed := strings.TrimSpace(opened)
 			var list []map[string]interface{}
 
 			// Handle Array vs Single Object
@@ -826,7 +870,7 @@ func pushNodeConfig(nodeID int) error {
 				// Fetch Users allowed for this tag
 				// TODO: Optimize query (prepare once)
 				uRows, err := db.DB.Query(`
-					SELECT u.uuid, u.name 
+					SELECT u.uuid, u.name, IFNULL(u.trojan_password, ''), IFNULL(u.ss_password, '')
 					FROM users u 
 					JOIN user_groups ug ON u.uuid = ug.user_uuid 
 					JOIN group_inbounds gi ON ug.group_id = gi.group_id 
@@ -861,13 +905,29 @@ func pushNodeConfig(nodeID int) error {
 					settingsMap = make(map[string]interface{})
 				}
 
+				method, _ := settingsMap["method"].(string)
+				var peers []map[string]interface{}
+
 				for uRows.Next() {
-					var uuid, name string
-					uRows.Scan(&uuid, &name)
+					var uuid, name, trojanPassword, ssPassword string
+					uRows.Scan(&uuid, &name, &trojanPassword, &ssPassword)
+
+					// WireGuard has peers keyed by public key instead of clients
+					if protocol == "wireguard" {
+						_, pub := wgUserKeys(uuid)
+						if addr := wgUserAddress(uuid); addr != "" {
+							peers = append(peers, map[string]interface{}{
+								"publicKey":  pub,
+								"allowedIPs": []string{addr},
+							})
+						}
+						continue
+					}
 
+					// Email carries the UUID so agent stats map back to users
 					client := map[string]interface{}{
 						"id":    uuid,
-						"email": name,
+						"email": uuid,
 					}
 
 					// Protocol Specifics
@@ -878,8 +938,14 @@ func pushNodeConfig(nodeID int) error {
 					} else if protocol == "vmess" {
 						client["alterId"] = templateAlterId
 					} else if protocol == "trojan" {
-						client["password"] = uuid
+						client["password"] = trojanUserPassword(uuid, trojanPassword)
 						delete(client, "id") // Trojan uses password
+					} else if protocol == "shadowsocks" {
+						client["password"] = ssUserPassword(method, uuid, ssPassword)
+						if !isSS2022(method) {
+							client["method"] = method // Legacy multi-user needs a per-client cipher
+						}
+						delete(client, "id")
 					}
 
 					clients = append(clients, client)
@@ -887,7 +953,11 @@ func pushNodeConfig(nodeID int) error {
 				uRows.Close()
 
 				// Overwrite clients
-				settingsMap["clients"] = clients
+				if protocol == "wireguard" {
+					settingsMap["peers"] = peers
+				} else {
+					settingsMap["clients"] = clients
+				}
 				inbound["settings"] = settingsMap
 
 				allInbounds = append(allInbounds, inbound)
@@ -895,11 +965,13 @@ func pushNodeConfig(nodeID int) error {
 		}
 	}
 
-	// 3. Construct Full Config
-	var finalConfig map[string]interface{}
+	// 3. Construct Final Config
 	defaultBase := `{
 		"log": { "loglevel": "warning" },
-	// 3. Construct Final Config
+		"dns": { "servers": ["8.8.8.8", "1.1.1.1"] },
+		"routing": { "domainStrategy": "IPIfNonMatch", "rules": [] },
+		"outbounds": [{ "protocol": "freedom", "tag": "DIRECT" }]
+	}`
 	finalConfig := make(map[string]interface{})
 	if baseConfigRaw.Valid && baseConfigRaw.String != "" {
 		json.Unmarshal([]byte(baseConfigRaw.String), &finalConfig)
@@ -921,6 +993,10 @@ func pushNodeConfig(nodeID int) error {
 				"statsUserDownlink": true,
 			},
 		},
+		"system": map[string]interface{}{
+			"statsInboundUplink":   true,
+			"statsInboundDownlink": true,
+		},
 	}
 	// Merge routing rules or ensure API rule exists
 	// Ideally we parse existing routing, but for now let's ensure API rule is present
@@ -1035,11 +1111,23 @@ func handleGroupConfigs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+const userGroupsQuery = "SELECT group_id FROM user_groups WHERE user_uuid=? ORDER BY group_id"
+
+// auditUser snapshots a user with their groups.
+func auditUser(uuid string) map[string]interface{} {
+	return auditRowWith("users", "uuid", uuid, "group_ids", userGroupsQuery)
+}
+
 func handleUserGroup(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
 		var ug UserGroupReq
 		json.NewDecoder(r.Body).Decode(&ug)
+		if !canManageUser(r, ug.UserUUID) || !resellerAllowsGroup(r, ug.GroupID) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		before := auditList("group_ids", userGroupsQuery, ug.UserUUID)
 		// Remove existing group assignment first (since we only support 1 group per user for now)
 		db.DB.Exec("DELETE FROM user_groups WHERE user_uuid=?", ug.UserUUID)
 
@@ -1049,159 +1137,33 @@ func handleUserGroup(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		recordAudit(r, "user.assign_group", "user", ug.UserUUID, before, auditList("group_ids", userGroupsQuery, ug.UserUUID))
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	case "DELETE":
 		userUUID := r.URL.Query().Get("user_uuid")
 		groupID := r.URL.Query().Get("group_id")
+		if !canManageUser(r, userUUID) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		before := auditList("group_ids", userGroupsQuery, userUUID)
 		_, err := db.DB.Exec("DELETE FROM user_groups WHERE user_uuid=? AND group_id=?", userUUID, groupID)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		recordAudit(r, "user.unassign_group", "user", userUUID, before, auditList("group_ids", userGroupsQuery, userUUID))
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	default:
 		http.Error(w, "Method not allowed", 405)
 	}
 }
 
-// Enigma Shared Key (In production, use ECDH or safe storage)
+// Legacy Enigma shared key, only for clients that predate the X25519 handshake
+// and only while enigma_accept_v1 is on (see secure.go)
 var EnigmaKey = []byte("01234567890123456789012345678901") // 32 bytes
 
-func handleSecure(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", 405)
-		return
-	}
-
-	// 1. Read Encrypted Body
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Read error", 500)
-		return
-	}
-	defer r.Body.Close()
-
-	// 2. Decrypt
-	// Body is just the Base64 string directly
-	plaintext, err := enigma.Open(string(body), EnigmaKey)
-	if err != nil {
-		http.Error(w, "Enigma: Decryption failed", 403) // Forbidden if can't decrypt
-		return
-	}
-
-	log.Printf("🔓 Enigma Decrypted: %s", string(plaintext))
-
-	// 3. Process Request (Simple Echo/Command processor)
-	var req struct {
-		Action     string `json:"action"`
-		Payload    string `json:"payload"`
-		HardwareID string `json:"hardware_id"`
-		UserUUID   string `json:"user_uuid"`
-		Label      string `json:"label"`
-	}
-	if err := json.Unmarshal(plaintext, &req); err != nil {
-		http.Error(w, "Invalid JSON", 400)
-		return
-	}
-
-	var responseJSON map[string]interface{}
-
-	switch req.Action {
-	case "register_device":
-		// 1. Check User Limit
-		var limit, count int
-		err := db.DB.QueryRow("SELECT device_limit FROM users WHERE uuid=?", req.UserUUID).Scan(&limit)
-		if err != nil {
-			responseJSON = map[string]interface{}{"status": "error", "message": "User not found"}
-			break
-		}
-
-		db.DB.QueryRow("SELECT COUNT(*) FROM user_devices WHERE user_uuid=?", req.UserUUID).Scan(&count)
-
-		if count >= limit {
-			// Check existing
-			var existing int
-			err := db.DB.QueryRow("SELECT 1 FROM user_devices ud JOIN devices d ON ud.device_id = d.id WHERE ud.user_uuid=? AND d.hardware_id=?", req.UserUUID, req.HardwareID).Scan(&existing)
-
-			if err != nil {
-				// Not found
-				responseJSON = map[string]interface{}{"status": "error", "message": "Device limit reached"}
-				break
-			}
-		}
-
-		// 2. Insert Device (Ignore if exists)
-		_, err = db.DB.Exec("INSERT OR IGNORE INTO devices (hardware_id, label) VALUES (?, ?)", req.HardwareID, req.Label)
-
-		// 3. Link User
-		var devID int
-		db.DB.QueryRow("SELECT id FROM devices WHERE hardware_id=?", req.HardwareID).Scan(&devID)
-
-		_, err = db.DB.Exec("INSERT OR IGNORE INTO user_devices (user_uuid, device_id) VALUES (?, ?)", req.UserUUID, devID)
-
-		responseJSON = map[string]interface{}{"status": "ok", "message": "Device Registered"}
-
-	case "get_config":
-		// Return the full configuration for this user
-		// 1. Find User
-		var name string
-		var limit float64
-		err := db.DB.QueryRow("SELECT name, limit_gb FROM users WHERE uuid=?", req.UserUUID).Scan(&name, &limit)
-		if err != nil {
-			responseJSON = map[string]interface{}{"status": "error", "message": "User not found"}
-			break
-		}
-
-		// 2. Find Active Nodes
-		rows, err := db.DB.Query("SELECT ip, admin_port FROM nodes WHERE status='active'")
-		if err != nil {
-			responseJSON = map[string]interface{}{"status": "error", "message": "No active nodes"}
-			break
-		}
-		defer rows.Close()
-
-		var nodes []map[string]string
-		for rows.Next() {
-			var ip, port string
-			rows.Scan(&ip, &port)
-			// Construct a VLESS or simple config object here
-			// For MVP, we pass the raw connection details the client needs
-			nodeCfg := map[string]string{
-				"type":   "vless",
-				"server": ip,
-				"port":   "443", // Assuming standard port or derive from node config
-				"uuid":   req.UserUUID,
-				"flow":   "xtls-rprx-vision",
-			}
-			nodes = append(nodes, nodeCfg)
-		}
-
-		responseJSON = map[string]interface{}{
-			"status":           "ok",
-			"user":             name,
-			"configs":          nodes,
-			"subscription_url": fmt.Sprintf("https://api.aether.com/sub/%s", req.UserUUID), // Future
-		}
-
-	default:
-		responseJSON = map[string]interface{}{
-			"status":      "ok",
-			"server_time": time.Now().String(),
-			"reply":       "Enigma Received: " + req.Action,
-		}
-	}
-
-	respBytes, _ := json.Marshal(responseJSON)
-
-	// 4. Encrypt Response
-	cipherResp, err := enigma.Seal(respBytes, EnigmaKey)
-	if err != nil {
-		http.Error(w, "Encryption failed", 500)
-		return
-	}
-
-	w.Write([]byte(cipherResp))
-}
+const deviceUsersQuery = "SELECT user_uuid FROM user_devices WHERE device_id=? ORDER BY user_uuid"
 
 func handleDevices(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -1213,11 +1175,11 @@ func handleDevices(w http.ResponseWriter, r *http.Request) {
 		userUUID := r.URL.Query().Get("user_uuid")
 		if userUUID != "" {
 			// Filter by User
-			rows, err = db.DB.Query("SELECT d.id, d.hardware_id, d.label, d.status, d.last_seen, u.uuid, u.name FROM devices d JOIN user_devices ud ON d.id = ud.device_id JOIN users u ON ud.user_uuid = u.uuid WHERE u.uuid = ?", userUUID)
+			rows, err = db.DB.Query("SELECT d.id, d.hardware_id, d.label, d.status, d.last_seen, IFNULL(d.os, ''), u.uuid, u.name FROM devices d JOIN user_devices ud ON d.id = ud.device_id JOIN users u ON ud.user_uuid = u.uuid WHERE u.uuid = ?", userUUID)
 		} else {
 			// List All
 			rows, err = db.DB.Query(`
-				SELECT d.id, d.hardware_id, d.label, d.status, d.last_seen, u.uuid, u.name 
+				SELECT d.id, d.hardware_id, d.label, d.status, d.last_seen, IFNULL(d.os, ''), u.uuid, u.name 
 				FROM devices d 
 				LEFT JOIN user_devices ud ON d.id = ud.device_id 
 				LEFT JOIN users u ON ud.user_uuid = u.uuid`)
@@ -1232,16 +1194,17 @@ func handleDevices(w http.ResponseWriter, r *http.Request) {
 		var devices []map[string]interface{}
 		for rows.Next() {
 			var id int
-			var hwID, label, status, lastSeen string
+			var hwID, label, status, lastSeen, deviceOS string
 			var uUUID, uName sql.NullString
 
-			rows.Scan(&id, &hwID, &label, &status, &lastSeen, &uUUID, &uName)
+			rows.Scan(&id, &hwID, &label, &status, &lastSeen, &deviceOS, &uUUID, &uName)
 			devices = append(devices, map[string]interface{}{
 				"id":          id,
 				"hardware_id": hwID,
 				"label":       label,
 				"status":      status,
 				"last_seen":   lastSeen,
+				"os":          deviceOS,
 				"user_uuid":   uUUID.String,
 				"user_name":   uName.String,
 			})
@@ -1291,16 +1254,19 @@ func handleDevices(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		before := auditRowWith("devices", "id", devID, "user_uuids", deviceUsersQuery)
 		_, err = db.DB.Exec("INSERT OR IGNORE INTO user_devices (user_uuid, device_id) VALUES (?, ?)", req.UserUUID, devID)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		recordAudit(r, "device.link", "device", devID, before, auditRowWith("devices", "id", devID, "user_uuids", deviceUsersQuery))
 
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 
 	case "DELETE":
 		id := r.URL.Query().Get("id")
+		before := auditRowWith("devices", "id", id, "user_uuids", deviceUsersQuery)
 		// Delete from devices (Cascades usually, but let's be safe or rely on DB checks)
 		_, err := db.DB.Exec("DELETE FROM user_devices WHERE device_id=?", id)
 		_, err = db.DB.Exec("DELETE FROM devices WHERE id=?", id)
@@ -1308,10 +1274,16 @@ func handleDevices(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 500)
 			return
 		}
+		recordAudit(r, "device.delete", "device", id, before, nil)
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	}
 }
 
+// auditGroup snapshots a group with its inbound tags.
+func auditGroup(id interface{}) map[string]interface{} {
+	return auditRowWith("groups", "id", id, "inbound_tags", "SELECT inbound_tag FROM group_inbounds WHERE group_id=? ORDER BY inbound_tag")
+}
+
 // Phase 14: Groups CRUD
 func handleGroups(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -1319,12 +1291,13 @@ func handleGroups(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		rows, err := db.DB.Query(`
-			SELECT g.id, g.name, g.is_disabled, 
+			SELECT g.id, g.name, g.is_disabled, IFNULL(g.hwid_limit, 0),
 			       COUNT(DISTINCT ug.user_uuid) as total_users,
 			       GROUP_CONCAT(gi.inbound_tag) as tags
 			FROM groups g
 			LEFT JOIN user_groups ug ON g.id = ug.group_id
 			LEFT JOIN group_inbounds gi ON g.id = gi.group_id
+			` + resellerScope(r, "g.id", "admin_groups", "group_id") + `
 			GROUP BY g.id
 		`)
 		if err != nil {
@@ -1337,15 +1310,15 @@ func handleGroups(w http.ResponseWriter, r *http.Request) {
 		for rows.Next() {
 			var id, totalUsers int
 			var name string
-			var isDisabled bool
+			var isDisabled, hwidLimit bool
 			var tags sql.NullString
-			rows.Scan(&id, &name, &isDisabled, &totalUsers, &tags)
+			rows.Scan(&id, &name, &isDisabled, &hwidLimit, &totalUsers, &tags)
 			tagList := []string{}
 			if tags.Valid && tags.String != "" {
 				tagList = strings.Split(tags.String, ",")
 			}
 			list = append(list, map[string]interface{}{
-				"id": id, "name": name, "is_disabled": isDisabled,
+				"id": id, "name": name, "is_disabled": isDisabled, "hwid_limit": hwidLimit,
 				"total_users": totalUsers, "inbound_tags": tagList,
 			})
 		}
@@ -1356,13 +1329,14 @@ func handleGroups(w http.ResponseWriter, r *http.Request) {
 			Name        string   `json:"name"`
 			InboundTags []string `json:"inbound_tags"`
 			IsDisabled  bool     `json:"is_disabled"`
+			HWIDLimit   bool     `json:"hwid_limit"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid JSON", 400)
 			return
 		}
 
-		res, err := db.DB.Exec("INSERT INTO groups (name, is_disabled) VALUES (?, ?)", req.Name, req.IsDisabled)
+		res, err := db.DB.Exec("INSERT INTO groups (name, is_disabled, hwid_limit) VALUES (?, ?, ?)", req.Name, req.IsDisabled, req.HWIDLimit)
 		if err != nil {
 			http.Error(w, "Create Failed: "+err.Error(), 500)
 			return
@@ -1373,6 +1347,7 @@ func handleGroups(w http.ResponseWriter, r *http.Request) {
 		for _, tag := range req.InboundTags {
 			db.DB.Exec("INSERT INTO group_inbounds (group_id, inbound_tag) VALUES (?, ?)", gid, tag)
 		}
+		recordAudit(r, "group.create", "group", gid, nil, auditGroup(gid))
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": gid})
 
 	case "PUT":
@@ -1381,12 +1356,14 @@ func handleGroups(w http.ResponseWriter, r *http.Request) {
 			Name        string   `json:"name"`
 			InboundTags []string `json:"inbound_tags"`
 			IsDisabled  bool     `json:"is_disabled"`
+			HWIDLimit   bool     `json:"hwid_limit"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid JSON", 400)
 			return
 		}
-		_, err := db.DB.Exec("UPDATE groups SET name=?, is_disabled=? WHERE id=?", req.Name, req.IsDisabled, req.Id)
+		before := auditGroup(req.Id)
+		_, err := db.DB.Exec("UPDATE groups SET name=?, is_disabled=?, hwid_limit=? WHERE id=?", req.Name, req.IsDisabled, req.HWIDLimit, req.Id)
 		if err != nil {
 			http.Error(w, "Update Failed", 500)
 			return
@@ -1397,6 +1374,7 @@ func handleGroups(w http.ResponseWriter, r *http.Request) {
 		for _, tag := range req.InboundTags {
 			db.DB.Exec("INSERT INTO group_inbounds (group_id, inbound_tag) VALUES (?, ?)", req.Id, tag)
 		}
+		recordAudit(r, "group.update", "group", req.Id, before, auditGroup(req.Id))
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
 
 	case "DELETE":
@@ -1405,6 +1383,7 @@ func handleGroups(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Missing ID", 400)
 			return
 		}
+		before := auditGroup(id)
 		// Cascade delete handles user/inbound associations if ON DELETE CASCADE set.
 		// Sqlite needs `PRAGMA foreign_keys = ON` usually, but we can delete manually to be safe.
 		db.DB.Exec("DELETE FROM user_groups WHERE group_id=?", id)
@@ -1414,14 +1393,20 @@ func handleGroups(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Delete Failed", 500)
 			return
 		}
+		recordAudit(r, "group.delete", "group", id, before, nil)
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
 	}
 }
 
+// auditTemplate snapshots a user template with its groups.
+func auditTemplate(id interface{}) map[string]interface{} {
+	return auditRowWith("user_templates", "id", id, "group_ids", "SELECT group_id FROM template_group_association WHERE template_id=? ORDER BY group_id")
+}
+
 func handleUserTemplates(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
-		rows, _ := db.DB.Query("SELECT id, name, data_limit, expire_duration, username_prefix, username_suffix, status, data_limit_reset_strategy, extra_settings, is_disabled FROM user_templates")
+		rows, _ := db.DB.Query("SELECT id, name, data_limit, expire_duration, username_prefix, username_suffix, status, data_limit_reset_strategy, extra_settings, is_disabled, IFNULL(hwid_limit, 0) FROM user_templates " + resellerScope(r, "id", "admin_templates", "template_id"))
 		defer rows.Close()
 		var list []map[string]interface{}
 		for rows.Next() {
@@ -1436,8 +1421,9 @@ func handleUserTemplates(w http.ResponseWriter, r *http.Request) {
 				DataLimitResetStrategy string         `json:"data_limit_reset_strategy"`
 				ExtraSettings          sql.NullString `json:"extra_settings"`
 				IsDisabled             bool           `json:"is_disabled"`
+				HWIDLimit              bool           `json:"hwid_limit"`
 			}
-			rows.Scan(&t.ID, &t.Name, &t.DataLimit, &t.ExpireDuration, &t.UsernamePrefix, &t.UsernameSuffix, &t.Status, &t.DataLimitResetStrategy, &t.ExtraSettings, &t.IsDisabled)
+			rows.Scan(&t.ID, &t.Name, &t.DataLimit, &t.ExpireDuration, &t.UsernamePrefix, &t.UsernameSuffix, &t.Status, &t.DataLimitResetStrategy, &t.ExtraSettings, &t.IsDisabled, &t.HWIDLimit)
 
 			// Get Groups
 			gRows, _ := db.DB.Query("SELECT group_id FROM template_group_association WHERE template_id=?", t.ID)
@@ -1460,6 +1446,7 @@ func handleUserTemplates(w http.ResponseWriter, r *http.Request) {
 				"data_limit_reset_strategy": t.DataLimitResetStrategy,
 				"extra_settings":            t.ExtraSettings.String,
 				"is_disabled":               t.IsDisabled,
+				"hwid_limit":                t.HWIDLimit,
 				"group_ids":                 groups,
 			})
 		}
@@ -1476,17 +1463,25 @@ func handleUserTemplates(w http.ResponseWriter, r *http.Request) {
 			DataLimitResetStrategy string `json:"data_limit_reset_strategy"`
 			ExtraSettings          string `json:"extra_settings"`
 			IsDisabled             bool   `json:"is_disabled"`
+			HWIDLimit              bool   `json:"hwid_limit"`
 			GroupIDs               []int  `json:"group_ids"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid JSON", 400)
 			return
 		}
+		if !validResetStrategy(req.DataLimitResetStrategy) {
+			http.Error(w, "Invalid data_limit_reset_strategy", 400)
+			return
+		}
+		if req.DataLimitResetStrategy == "" {
+			req.DataLimitResetStrategy = "no_reset"
+		}
 
 		res, err := db.DB.Exec(`
-			INSERT INTO user_templates (name, data_limit, expire_duration, username_prefix, username_suffix, status, data_limit_reset_strategy, extra_settings, is_disabled) 
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-		`, req.Name, req.DataLimit, req.ExpireDuration, req.UsernamePrefix, req.UsernameSuffix, req.Status, req.DataLimitResetStrategy, req.ExtraSettings, req.IsDisabled)
+			INSERT INTO user_templates (name, data_limit, expire_duration, username_prefix, username_suffix, status, data_limit_reset_strategy, extra_settings, is_disabled, hwid_limit) 
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, req.Name, req.DataLimit, req.ExpireDuration, req.UsernamePrefix, req.UsernameSuffix, req.Status, req.DataLimitResetStrategy, req.ExtraSettings, req.IsDisabled, req.HWIDLimit)
 
 		if err != nil {
 			http.Error(w, err.Error(), 500)
@@ -1497,6 +1492,7 @@ func handleUserTemplates(w http.ResponseWriter, r *http.Request) {
 		for _, gid := range req.GroupIDs {
 			db.DB.Exec("INSERT INTO template_group_association (template_id, group_id) VALUES (?, ?)", tid, gid)
 		}
+		recordAudit(r, "template.create", "template", tid, nil, auditTemplate(tid))
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": tid})
 
 	case "PUT":
@@ -1511,14 +1507,23 @@ func handleUserTemplates(w http.ResponseWriter, r *http.Request) {
 			DataLimitResetStrategy string `json:"data_limit_reset_strategy"`
 			ExtraSettings          string `json:"extra_settings"`
 			IsDisabled             bool   `json:"is_disabled"`
+			HWIDLimit              bool   `json:"hwid_limit"`
 			GroupIDs               []int  `json:"group_ids"`
 		}
 		json.NewDecoder(r.Body).Decode(&req)
+		if !validResetStrategy(req.DataLimitResetStrategy) {
+			http.Error(w, "Invalid data_limit_reset_strategy", 400)
+			return
+		}
+		if req.DataLimitResetStrategy == "" {
+			req.DataLimitResetStrategy = "no_reset"
+		}
 
+		before := auditTemplate(req.ID)
 		_, err := db.DB.Exec(`
-			UPDATE user_templates SET name=?, data_limit=?, expire_duration=?, username_prefix=?, username_suffix=?, status=?, data_limit_reset_strategy=?, extra_settings=?, is_disabled=?
+			UPDATE user_templates SET name=?, data_limit=?, expire_duration=?, username_prefix=?, username_suffix=?, status=?, data_limit_reset_strategy=?, extra_settings=?, is_disabled=?, hwid_limit=?
 			WHERE id=?
-		`, req.Name, req.DataLimit, req.ExpireDuration, req.UsernamePrefix, req.UsernameSuffix, req.Status, req.DataLimitResetStrategy, req.ExtraSettings, req.IsDisabled, req.ID)
+		`, req.Name, req.DataLimit, req.ExpireDuration, req.UsernamePrefix, req.UsernameSuffix, req.Status, req.DataLimitResetStrategy, req.ExtraSettings, req.IsDisabled, req.HWIDLimit, req.ID)
 
 		if err != nil {
 			http.Error(w, err.Error(), 500)
@@ -1529,16 +1534,19 @@ func handleUserTemplates(w http.ResponseWriter, r *http.Request) {
 		for _, gid := range req.GroupIDs {
 			db.DB.Exec("INSERT INTO template_group_association (template_id, group_id) VALUES (?, ?)", req.ID, gid)
 		}
+		recordAudit(r, "template.update", "template", req.ID, before, auditTemplate(req.ID))
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
 
 	case "DELETE":
 		id := r.URL.Query().Get("id")
+		before := auditTemplate(id)
 		db.DB.Exec("DELETE FROM template_group_association WHERE template_id=?", id)
 		_, err := db.DB.Exec("DELETE FROM user_templates WHERE id=?", id)
 		if err != nil {
 			http.Error(w, "Delete Failed", 500)
 			return
 		}
+		recordAudit(r, "template.delete", "template", id, before, nil)
 		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
 	}
 }
@@ -1568,9 +1576,10 @@ func handleUserFromTemplate(w http.ResponseWriter, r *http.Request) {
 		Status         string
 		ResetStrategy  string
 		IsDisabled     bool
+		HWIDLimit      bool
 	}
-	err := db.DB.QueryRow("SELECT data_limit, expire_duration, username_prefix, username_suffix, status, data_limit_reset_strategy, is_disabled FROM user_templates WHERE id=?", req.TemplateID).Scan(
-		&t.DataLimit, &t.ExpireDuration, &t.Prefix, &t.Suffix, &t.Status, &t.ResetStrategy, &t.IsDisabled,
+	err := db.DB.QueryRow("SELECT data_limit, expire_duration, username_prefix, username_suffix, status, data_limit_reset_strategy, is_disabled, IFNULL(hwid_limit, 0) FROM user_templates WHERE id=?", req.TemplateID).Scan(
+		&t.DataLimit, &t.ExpireDuration, &t.Prefix, &t.Suffix, &t.Status, &t.ResetStrategy, &t.IsDisabled, &t.HWIDLimit,
 	)
 	if err != nil {
 		http.Error(w, "Template not found: "+err.Error(), 404)
@@ -1580,6 +1589,15 @@ func handleUserFromTemplate(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Template is disabled", 400)
 		return
 	}
+	if !resellerAllowsTemplate(r, req.TemplateID) {
+		http.Error(w, "Template not found", 404)
+		return
+	}
+	limitGB := float64(t.DataLimit) / (1024 * 1024 * 1024)
+	if err := checkResellerQuota(r, 1, limitGB, t.DataLimit == 0); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
 
 	// 2. Construct User
 	finalUsername := req.Username
@@ -1605,8 +1623,8 @@ func handleUserFromTemplate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 3. Insert User
-	_, err = db.DB.Exec("INSERT INTO users (uuid, name, limit_gb, expiry, status) VALUES (?, ?, ?, ?, ?)",
-		newUUID, finalUsername, float64(t.DataLimit)/(1024*1024*1024), expiry, t.Status)
+	_, err = db.DB.Exec("INSERT INTO users (uuid, name, limit_gb, expiry, status, data_limit_reset_strategy, last_reset_at, hwid_limit, owner_admin_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		newUUID, finalUsername, limitGB, expiry, t.Status, t.ResetStrategy, time.Now().Unix(), t.HWIDLimit, currentAdminID(r))
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -1620,8 +1638,13 @@ func handleUserFromTemplate(w http.ResponseWriter, r *http.Request) {
 		db.DB.Exec("INSERT INTO user_groups (user_uuid, group_id) VALUES (?, ?)", newUUID, gid)
 	}
 	rows.Close()
+	recordAudit(r, "user.create", "user", newUUID, nil, auditUser(newUUID))
 
-	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "uuid": newUUID, "username": finalUsername})
+	resp := map[string]interface{}{"success": true, "uuid": newUUID, "username": finalUsername}
+	if token, err := issueSubToken(newUUID, 0); err == nil {
+		resp["subscription_url"] = subscriptionURL(r, token)
+	}
+	json.NewEncoder(w).Encode(resp)
 }
 
 func handleUsersBulkFromTemplate(w http.ResponseWriter, r *http.Request) {
@@ -1656,14 +1679,20 @@ func handleUsersBulkFromTemplate(w http.ResponseWriter, r *http.Request) {
 		Status         string
 		ResetStrategy  string
 		IsDisabled     bool
+		HWIDLimit      bool
 	}
-	err := db.DB.QueryRow("SELECT data_limit, expire_duration, username_prefix, username_suffix, status, data_limit_reset_strategy, is_disabled FROM user_templates WHERE id=?", req.TemplateID).Scan(
-		&t.DataLimit, &t.ExpireDuration, &t.Prefix, &t.Suffix, &t.Status, &t.ResetStrategy, &t.IsDisabled,
+	err := db.DB.QueryRow("SELECT data_limit, expire_duration, username_prefix, username_suffix, status, data_limit_reset_strategy, is_disabled, IFNULL(hwid_limit, 0) FROM user_templates WHERE id=?", req.TemplateID).Scan(
+		&t.DataLimit, &t.ExpireDuration, &t.Prefix, &t.Suffix, &t.Status, &t.ResetStrategy, &t.IsDisabled, &t.HWIDLimit,
 	)
-	if err != nil {
+	if err != nil || !resellerAllowsTemplate(r, req.TemplateID) {
 		http.Error(w, "Template not found", 404)
 		return
 	}
+	limitGB := float64(t.DataLimit) / (1024 * 1024 * 1024)
+	if err := checkResellerQuota(r, req.Count, limitGB*float64(req.Count), t.DataLimit == 0); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
 
 	var createdLinks []string
 	createdCount := 0
@@ -1713,8 +1742,8 @@ func handleUsersBulkFromTemplate(w http.ResponseWriter, r *http.Request) {
 			expiry = time.Now().Add(time.Duration(t.ExpireDuration) * time.Second).Unix()
 		}
 
-		_, err = db.DB.Exec("INSERT INTO users (uuid, name, limit_gb, expiry, status) VALUES (?, ?, ?, ?, ?)",
-			newUUID, finalUsername, float64(t.DataLimit)/(1024*1024*1024), expiry, t.Status)
+		_, err = db.DB.Exec("INSERT INTO users (uuid, name, limit_gb, expiry, status, data_limit_reset_strategy, last_reset_at, hwid_limit, owner_admin_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			newUUID, finalUsername, limitGB, expiry, t.Status, t.ResetStrategy, time.Now().Unix(), t.HWIDLimit, currentAdminID(r))
 
 		if err == nil {
 			createdCount++
@@ -1722,9 +1751,10 @@ func handleUsersBulkFromTemplate(w http.ResponseWriter, r *http.Request) {
 			for _, gid := range groupIDs {
 				db.DB.Exec("INSERT INTO user_groups (user_uuid, group_id) VALUES (?, ?)", newUUID, gid)
 			}
-			// Generate Link (Mock for now, would use real domain)
-			link := fmt.Sprintf("https://t.me/PasarGuardBot?start=%s", finalUsername)
-			createdLinks = append(createdLinks, link)
+			recordAudit(r, "user.create", "user", newUUID, nil, auditUser(newUUID))
+			if token, err := issueSubToken(newUUID, 0); err == nil {
+				createdLinks = append(createdLinks, subscriptionURL(r, token))
+			}
 		}
 	}
 
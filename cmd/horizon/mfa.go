@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"aether/internal/horizon/db"
+	"aether/internal/horizon/secrets"
+
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Two-factor authentication. Admins may enroll an RFC 6238 TOTP secret
+// (SHA-1, 6 digits, 30 s) and get ten single-use recovery codes. Once
+// enrolled, login needs a code. Roles listed in mfa_required_roles must
+// enroll: until they do, their sessions only reach /api/auth/.
+//
+// Sensitive operations (stepUpRequired) also need the session to have been
+// verified within mfa_step_up_minutes, by a code or, for admins without 2FA,
+// the password, through POST /api/auth/verify. API tokens cannot step up
+// and never reach them.
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	recoveryCodeCount = 10
+)
+
+var errBadCode = errors.New("invalid code")
+
+// Tells clients why a request was refused, next to the status code
+const (
+	mfaHeader    = "X-Horizon-MFA"     // "required" on login, "enroll" elsewhere
+	stepUpHeader = "X-Horizon-Step-Up" // "required"
+)
+
+// stepUpRequired lists the operations that need a fresh verification.
+func stepUpRequired(r *http.Request) bool {
+	p := r.URL.Path
+	switch {
+	case r.Method == "DELETE" && p == "/api/nodes":
+		return true
+	case strings.HasPrefix(p, "/api/nodes/") && strings.HasSuffix(p, "/master-key"):
+		return true
+	case r.Method != "GET" && (p == "/api/admins" || p == "/api/tokens" || p == "/api/backup"):
+		return true
+	case p == "/api/backup/restore" || p == "/api/export" || p == "/api/import":
+		return true
+	case p == "/api/auth/2fa/disable" || p == "/api/auth/2fa/recovery-codes":
+		return true
+	}
+	return false
+}
+
+// mfaRequired reports whether admins with the role must enroll.
+func mfaRequired(role string) bool {
+	for _, r := range strings.Split(getSetting("mfa_required_roles"), ",") {
+		if strings.TrimSpace(r) == role {
+			return true
+		}
+	}
+	return false
+}
+
+func stepUpWindow() time.Duration {
+	minutes, err := strconv.Atoi(getSetting("mfa_step_up_minutes"))
+	if err != nil || minutes <= 0 {
+		minutes = 10
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// steppedUp reports whether a's session was verified recently enough.
+func steppedUp(a *Admin) bool {
+	return a.TokenID == 0 && a.verifiedAt > time.Now().Add(-stepUpWindow()).Unix()
+}
+
+// mfaAllows is the check run by requireAdmin after the role check. It writes
+// the refusal itself.
+func mfaAllows(a *Admin, w http.ResponseWriter, r *http.Request) bool {
+	if a.TokenID == 0 && !a.TOTPEnabled && mfaRequired(a.Role) && !strings.HasPrefix(r.URL.Path, "/api/auth/") {
+		w.Header().Set(mfaHeader, "enroll")
+		http.Error(w, "Two-factor enrollment required", http.StatusForbidden)
+		return false
+	}
+	if stepUpRequired(r) {
+		return requireStepUp(a, w)
+	}
+	return true
+}
+
+// requireStepUp refuses the request unless a's session was verified
+// recently, for handlers where that depends on the body (see handleSettings).
+func requireStepUp(a *Admin, w http.ResponseWriter) bool {
+	if !steppedUp(a) {
+		w.Header().Set(stepUpHeader, "required")
+		http.Error(w, "Step-up verification required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// matchTOTP returns the time step code is valid for, allowing one step of
+// clock drift either way.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - 1; step <= current+1; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(username, secret string) string {
+	issuer := getSetting("sub_profile_title")
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(totpDigits))
+	v.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+username) + "?" + v.Encode()
+}
+
+// verifyAdminCode checks a TOTP or recovery code for an enrolled admin. A
+// TOTP code is accepted once; a recovery code is used up.
+func verifyAdminCode(adminID int, code string) error {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	var secret string
+	var lastStep int64
+	err := db.DB.QueryRow("SELECT totp_secret, totp_last_step FROM admins WHERE id=? AND totp_enabled = 1", adminID).Scan(&secret, &lastStep)
+	if err != nil {
+		return errBadCode
+	}
+	if secret, err = secrets.Open(secret); err != nil {
+		return err
+	}
+	if step, ok := matchTOTP(secret, code, time.Now()); ok {
+		res, err := db.DB.Exec("UPDATE admins SET totp_last_step=? WHERE id=? AND totp_last_step < ?", step, adminID, step)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errBadCode // Replayed
+		}
+		return nil
+	}
+
+	rows, err := db.DB.Query("SELECT id, code_hash FROM admin_recovery_codes WHERE admin_id=? AND used_at = 0", adminID)
+	if err != nil {
+		return err
+	}
+	var matched int
+	for rows.Next() {
+		var id int
+		var hash string
+		if rows.Scan(&id, &hash) == nil && matched == 0 && bcrypt.CompareHashAndPassword([]byte(hash), []byte(strings.ToLower(code))) == nil {
+			matched = id
+		}
+	}
+	rows.Close()
+	if matched == 0 {
+		return errBadCode
+	}
+	res, err := db.DB.Exec("UPDATE admin_recovery_codes SET used_at=? WHERE id=? AND used_at = 0", time.Now().Unix(), matched)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errBadCode
+	}
+	return nil
+}
+
+// newRecoveryCodes replaces the admin's recovery codes and returns them.
+func newRecoveryCodes(adminID int) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		c := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes[i] = c[:4] + "-" + c[4:]
+		hash, err := bcrypt.GenerateFromPassword([]byte(codes[i]), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = string(hash)
+	}
+
+	db.DB.Exec("DELETE FROM admin_recovery_codes WHERE admin_id=?", adminID)
+	for _, hash := range hashes {
+		if _, err := db.DB.Exec("INSERT INTO admin_recovery_codes (admin_id, code_hash) VALUES (?, ?)", adminID, hash); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// markVerified starts the step-up window for the request's session.
+func markVerified(r *http.Request) {
+	db.DB.Exec("UPDATE admin_sessions SET verified_at=? WHERE token_hash=?", time.Now().Unix(), hashToken(sessionToken(r)))
+}
+
+// resetTOTP removes an admin's enrollment and recovery codes.
+func resetTOTP(adminID int) {
+	db.DB.Exec("UPDATE admins SET totp_secret='', totp_enabled=0, totp_last_step=0 WHERE id=?", adminID)
+	db.DB.Exec("DELETE FROM admin_recovery_codes WHERE admin_id=?", adminID)
+}
+
+// GET /api/auth/2fa - enrollment status
+func handleMFAStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	a := currentAdmin(r)
+	var left int
+	db.DB.QueryRow("SELECT COUNT(*) FROM admin_recovery_codes WHERE admin_id=? AND used_at = 0", a.ID).Scan(&left)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":             a.TOTPEnabled,
+		"required":            mfaRequired(a.Role),
+		"recovery_codes_left": left,
+		"stepped_up":          steppedUp(a),
+	})
+}
+
+// POST /api/auth/2fa/setup - start enrollment with a new secret
+func handleMFASetup(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	a := currentAdmin(r)
+	if a.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", 409)
+		return
+	}
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+	secret := totpEncoding.EncodeToString(raw)
+	sealed, err := secrets.Seal(secret)
+	if err != nil {
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+	if _, err := db.DB.Exec("UPDATE admins SET totp_secret=?, totp_last_step=0 WHERE id=?", sealed, a.ID); err != nil {
+		http.Error(w, "Setup Failed", 500)
+		return
+	}
+
+	uri := totpURI(a.Username, secret)
+	resp := map[string]interface{}{"secret": secret, "uri": uri}
+	if png, err := qrcode.Encode(uri, qrcode.Medium, 256); err == nil {
+		resp["qr"] = "data:image/png;base64," + base64.StdEncoding.EncodeToString(png)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// POST /api/auth/2fa/enable - {"code"} confirms the secret from setup and
+// returns the recovery codes, once.
+func handleMFAEnable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	a := currentAdmin(r)
+	if a.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is already enabled", 409)
+		return
+	}
+	var secret string
+	db.DB.QueryRow("SELECT totp_secret FROM admins WHERE id=?", a.ID).Scan(&secret)
+	if secret = secrets.OpenOrEmpty(secret); secret == "" {
+		http.Error(w, "Run setup first", 400)
+		return
+	}
+	step, ok := matchTOTP(secret, strings.TrimSpace(req.Code), time.Now())
+	if !ok {
+		http.Error(w, "Invalid code", 400)
+		return
+	}
+
+	codes, err := newRecoveryCodes(a.ID)
+	if err != nil {
+		http.Error(w, "Enable Failed", 500)
+		return
+	}
+	db.DB.Exec("UPDATE admins SET totp_enabled=1, totp_last_step=? WHERE id=?", step, a.ID)
+	markVerified(r)
+	recordAudit(r, "admin.2fa_enable", "admin", a.ID, nil, nil)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "recovery_codes": codes})
+}
+
+// POST /api/auth/2fa/disable (step-up)
+func handleMFADisable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	a := currentAdmin(r)
+	resetTOTP(a.ID)
+	recordAudit(r, "admin.2fa_disable", "admin", a.ID, nil, nil)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+}
+
+// POST /api/auth/2fa/recovery-codes (step-up) - replace the recovery codes
+func handleMFARecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	a := currentAdmin(r)
+	if !a.TOTPEnabled {
+		http.Error(w, "Two-factor authentication is not enabled", 409)
+		return
+	}
+	codes, err := newRecoveryCodes(a.ID)
+	if err != nil {
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+	recordAudit(r, "admin.2fa_recovery_codes", "admin", a.ID, nil, nil)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "recovery_codes": codes})
+}
+
+// POST /api/auth/verify - {"code"}, or {"password"} without 2FA. Starts the
+// step-up window for this session.
+func handleStepUp(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+	a := currentAdmin(r)
+	if a.TokenID != 0 {
+		http.Error(w, "API tokens cannot step up", 403)
+		return
+	}
+	var req struct {
+		Code     string `json:"code"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+
+	keys := loginKeys(r, a.Username)
+	if loginThrottled(w, keys) {
+		return
+	}
+	if a.TOTPEnabled {
+		if verifyAdminCode(a.ID, req.Code) != nil {
+			loginLimiter.fail(keys)
+			http.Error(w, "Invalid code", 401)
+			return
+		}
+	} else {
+		var hash string
+		db.DB.QueryRow("SELECT password_hash FROM admins WHERE id=?", a.ID).Scan(&hash)
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.Password)) != nil {
+			loginLimiter.fail(keys)
+			http.Error(w, "Invalid password", 401)
+			return
+		}
+	}
+	loginLimiter.reset(keys)
+	markVerified(r)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true, "expires_at": time.Now().Add(stepUpWindow()).Unix(),
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA-1. The RFC lists 8-digit codes; totpCode gives
+// their last 6 digits.
+const rfc6238Secret = "12345678901234567890"
+
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		if got := totpCode([]byte(rfc6238Secret), v.unix/totpPeriod); got != v.code {
+			t.Errorf("totpCode at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte(rfc6238Secret))
+	for _, v := range rfc6238Vectors {
+		step := v.unix / totpPeriod
+		for _, drift := range []int64{-1, 0, 1} {
+			now := time.Unix(v.unix+drift*totpPeriod, 0)
+			got, ok := matchTOTP(secret, v.code, now)
+			if !ok || got != step {
+				t.Errorf("matchTOTP(%s) %d steps off = %d, %v; want %d, true", v.code, drift, got, ok, step)
+			}
+		}
+		for _, drift := range []int64{-2, 2} {
+			at := v.unix + drift*totpPeriod
+			if at < 0 {
+				continue // Before the epoch steps truncate toward zero
+			}
+			if _, ok := matchTOTP(secret, v.code, time.Unix(at, 0)); ok {
+				t.Errorf("matchTOTP(%s) accepted %d steps off", v.code, drift)
+			}
+		}
+	}
+}
+
+func TestMatchTOTPRejects(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte(rfc6238Secret))
+	now := time.Unix(59, 0)
+	for _, tc := range []struct {
+		name, secret, code string
+	}{
+		{"wrong code", secret, "287083"},
+		{"short code", secret, "28708"},
+		{"8-digit code", secret, "94287082"},
+		{"empty code", secret, ""},
+		{"bad secret", "not base32!", "287082"},
+	} {
+		if _, ok := matchTOTP(tc.secret, tc.code, now); ok {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+
+	// Authenticator apps may show the secret in lower case
+	if _, ok := matchTOTP("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", now); !ok {
+		t.Error("lower-case secret rejected")
+	}
+}
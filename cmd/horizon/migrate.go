@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"aether/internal/horizon/db"
+)
+
+// runMigrate backs "horizon migrate":
+//
+//	horizon migrate status        list migrations and when they were applied
+//	horizon migrate up [version]  apply pending migrations (up to version)
+//	horizon migrate down [n]      roll back the last n migrations (default 1)
+//
+// Horizon applies pending migrations itself on start, so stop it before
+// rolling back.
+func runMigrate(args []string) error {
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+	num := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid number %q", args[1])
+		}
+		num = n
+	}
+
+	switch cmd {
+	case "status":
+		list, err := db.Status()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+		for _, m := range list {
+			applied := "pending"
+			if m.AppliedAt > 0 {
+				applied = time.Unix(m.AppliedAt, 0).Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, applied)
+		}
+		return tw.Flush()
+	case "up":
+		return db.MigrateTo(num)
+	case "down":
+		if num == 0 {
+			num = 1
+		}
+		return db.Rollback(num)
+	}
+	return fmt.Errorf("unknown command %q (want status, up or down)", cmd)
+}
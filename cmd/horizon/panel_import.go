@@ -0,0 +1,814 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Importing from other panels. A Marzban or 3x-ui database is converted into
+// an export bundle (see export.go) and loaded with the same importer, so
+// conflicts, dry runs and the report work the same way.
+//
+// Users keep their UUIDs and their Trojan and Shadowsocks passwords, so
+// proxy links already handed out keep working once the imported config is
+// deployed on a node at the old server's address. Each inbound becomes a
+// group of the same name, holding that inbound's tag, and users join the
+// groups for the inbounds they had. Everything that has no Horizon
+// equivalent is listed in the report.
+
+// Protocols Horizon manages clients for (see pushNodeConfig)
+var importProtocols = map[string]bool{"vless": true, "vmess": true, "trojan": true, "shadowsocks": true}
+
+// Remark variables Horizon expands (see remarkVars and collectProxies)
+var knownRemarkVars = map[string]bool{
+	"{USERNAME}": true, "{STATUS}": true, "{DATA_USED}": true, "{DATA_LIMIT}": true, "{DATA_LEFT}": true,
+	"{DAYS_LEFT}": true, "{EXPIRE_DATE}": true, "{NODE}": true, "{TAG}": true, "{PROTOCOL}": true, "{TRANSPORT}": true,
+}
+
+var remarkVarPattern = regexp.MustCompile(`\{[A-Z_]+\}`)
+
+// panelImport collects a bundle and what could not be mapped into it.
+type panelImport struct {
+	panel    string
+	b        *exportBundle
+	warnings []string
+}
+
+func newPanelImport(panel string) *panelImport {
+	return &panelImport{
+		panel: panel,
+		b: &exportBundle{
+			Format:         exportFormat,
+			Version:        exportVersion,
+			ExportedAt:     time.Now().Unix(),
+			IncludeSecrets: true, // Inbound keys come across in plaintext
+		},
+	}
+}
+
+func (p *panelImport) warn(format string, args ...interface{}) {
+	p.warnings = append(p.warnings, fmt.Sprintf(format, args...))
+}
+
+// addInbounds stores the panel's inbounds as one core config, with a group
+// per inbound. Groups get bundle IDs from 1 in the order of inbounds.
+func (p *panelImport) addInbounds(inbounds []map[string]interface{}, groupNames []string) error {
+	if len(inbounds) == 0 {
+		return nil
+	}
+	raw, err := json.Marshal(inbounds)
+	if err != nil {
+		return err
+	}
+	first := inbounds[0]
+	p.b.CoreConfigs = append(p.b.CoreConfigs, exportConfig{
+		ID:          1,
+		Name:        p.panel,
+		Protocol:    fmt.Sprint(first["protocol"]),
+		Port:        fmt.Sprint(first["port"]),
+		RawInbounds: string(raw),
+		Status:      "active",
+	})
+	for i, in := range inbounds {
+		id := int64(i + 1)
+		p.b.Groups = append(p.b.Groups, exportGroup{ID: id, Name: groupNames[i]})
+		p.b.GroupInbounds = append(p.b.GroupInbounds, exportInbound{GroupID: id, InboundTag: fmt.Sprint(in["tag"])})
+	}
+	p.warn("config %s: assign it to a node at the old server's address so existing links keep working", p.panel)
+	return nil
+}
+
+// openPanelDB opens another panel's SQLite database read-only.
+func openPanelDB(path string) (*sql.DB, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	return conn, conn.Ping()
+}
+
+// panelColumns returns the columns of table, empty if it does not exist;
+// both panels have added columns over the years.
+func panelColumns(conn *sql.DB, table string) map[string]bool {
+	cols := map[string]bool{}
+	rows, err := conn.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return cols
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if rows.Scan(&name) == nil {
+			cols[name] = true
+		}
+	}
+	return cols
+}
+
+// normalizeInbound reshapes an Xray inbound as the panels store it into what
+// Horizon reads: the user list emptied (pushNodeConfig fills it), REALITY
+// carrying the public key and server name the subscription needs, and
+// panel-only fields removed.
+func normalizeInbound(in map[string]interface{}, flow string) {
+	settings, _ := in["settings"].(map[string]interface{})
+	if settings == nil {
+		settings = map[string]interface{}{}
+	}
+	// The first client is the template for flow (see pushNodeConfig)
+	clients := []interface{}{}
+	if flow != "" {
+		clients = append(clients, map[string]interface{}{"flow": flow})
+	}
+	settings["clients"] = clients
+	in["settings"] = settings
+
+	stream, _ := in["streamSettings"].(map[string]interface{})
+	if stream == nil {
+		return
+	}
+	delete(stream, "externalProxy")
+	if tls, ok := stream["tlsSettings"].(map[string]interface{}); ok {
+		delete(tls, "settings")
+	}
+	reality, ok := stream["realitySettings"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	// 3x-ui keeps the client side under "settings"
+	if extra, ok := reality["settings"].(map[string]interface{}); ok {
+		for _, k := range []string{"publicKey", "serverName"} {
+			if v, _ := extra[k].(string); v != "" && reality[k] == nil {
+				reality[k] = v
+			}
+		}
+		delete(reality, "settings")
+	}
+	if s, _ := reality["serverName"].(string); s == "" {
+		if names, ok := reality["serverNames"].([]interface{}); ok && len(names) > 0 {
+			reality["serverName"] = names[0]
+		}
+	}
+	if s, _ := reality["publicKey"].(string); s == "" {
+		if priv, _ := reality["privateKey"].(string); priv != "" {
+			reality["publicKey"] = realityPublicKey(priv)
+		}
+	}
+}
+
+// realityPublicKey derives a REALITY public key, which unlike WireGuard's
+// uses unpadded URL-safe base64.
+func realityPublicKey(privateKey string) string {
+	priv, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil || len(priv) != 32 {
+		return ""
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(pub)
+}
+
+// inboundNetwork returns the transport and security of a stored inbound.
+func inboundNetwork(in map[string]interface{}) (string, string) {
+	stream, _ := in["streamSettings"].(map[string]interface{})
+	network, _ := stream["network"].(string)
+	security, _ := stream["security"].(string)
+	if network == "" {
+		network = "tcp"
+	}
+	return network, security
+}
+
+// supportsFlow reports whether XTLS flow applies to the inbound.
+func supportsFlow(in map[string]interface{}) bool {
+	network, security := inboundNetwork(in)
+	return in["protocol"] == "vless" && (network == "tcp" || network == "raw") && (security == "tls" || security == "reality")
+}
+
+// convertRemark maps a Marzban host remark onto Horizon's variables.
+func (p *panelImport) convertRemark(remark string) string {
+	remark = strings.NewReplacer("{DATA_USAGE}", "{DATA_USED}", "{STATUS_EMOJI}", "{STATUS}").Replace(remark)
+	for _, v := range remarkVarPattern.FindAllString(remark, -1) {
+		if !knownRemarkVars[v] {
+			p.warn("host remark %q: %s is not supported and shows as is", remark, v)
+		}
+	}
+	return remark
+}
+
+func bytesToGB(n int64) float64 {
+	return float64(n) / (1024 * 1024 * 1024)
+}
+
+// marzbanImport reads a Marzban database. Inbounds live in Marzban's Xray
+// config rather than the database; xrayConfig defaults to the
+// xray_config.json next to it.
+func marzbanImport(path, xrayConfig string) (*panelImport, error) {
+	conn, err := openPanelDB(path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	userCols := panelColumns(conn, "users")
+	if !userCols["username"] || len(panelColumns(conn, "proxies")) == 0 {
+		return nil, errors.New("not a Marzban database")
+	}
+	p := newPanelImport("marzban")
+
+	// Inbounds, by tag
+	if xrayConfig == "" {
+		xrayConfig = filepath.Join(filepath.Dir(path), "xray_config.json")
+	}
+	var config struct {
+		Inbounds []map[string]interface{} `json:"inbounds"`
+	}
+	var inbounds []map[string]interface{}
+	protocolOf := map[string]string{}
+	if data, err := os.ReadFile(xrayConfig); err != nil {
+		p.warn("xray config %s not read (%v): no inbounds imported and users are in no group", xrayConfig, err)
+	} else if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("xray config %s: %w", xrayConfig, err)
+	}
+	for _, in := range config.Inbounds {
+		tag, _ := in["tag"].(string)
+		protocol, _ := in["protocol"].(string)
+		if tag == "" || tag == "API_INBOUND" { // Marzban's own stats API; Horizon adds its own
+			continue
+		}
+		if !importProtocols[protocol] {
+			p.warn("inbound %s: %s inbounds are not imported", tag, protocol)
+			continue
+		}
+		protocolOf[tag] = protocol
+		inbounds = append(inbounds, in)
+	}
+
+	excluded := map[int64]map[string]bool{}
+	if len(panelColumns(conn, "exclude_inbounds_association")) > 0 {
+		rows, err := conn.Query("SELECT proxy_id, inbound_tag FROM exclude_inbounds_association")
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			var tag string
+			rows.Scan(&id, &tag)
+			if excluded[id] == nil {
+				excluded[id] = map[string]bool{}
+			}
+			excluded[id][tag] = true
+		}
+		rows.Close()
+	}
+
+	// Proxies: the user's credentials per protocol
+	type proxy struct {
+		id       int64
+		protocol string
+		settings map[string]interface{}
+	}
+	proxies := map[int64][]proxy{}
+	rows, err := conn.Query("SELECT id, user_id, type, IFNULL(settings, '{}') FROM proxies ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var pr proxy
+		var userID int64
+		var typ, settings string
+		if err := rows.Scan(&pr.id, &userID, &typ, &settings); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		pr.protocol = strings.ToLower(typ)
+		json.Unmarshal([]byte(settings), &pr.settings)
+		proxies[userID] = append(proxies[userID], pr)
+	}
+	rows.Close()
+
+	optional := func(col, fallback string) string {
+		if userCols[col] {
+			return "IFNULL(" + col + ", " + fallback + ")"
+		}
+		return fallback
+	}
+	rows, err = conn.Query(`SELECT id, username, IFNULL(status, 'active'), IFNULL(used_traffic, 0), IFNULL(data_limit, 0), IFNULL(expire, 0), ` +
+		optional("data_limit_reset_strategy", "'no_reset'") + `, ` + optional("on_hold_expire_duration", "0") +
+		` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flows := map[string]string{}    // tag -> first vless flow seen
+	ssMethod := map[string]string{} // tag -> first shadowsocks method seen
+	onHold, mixedIDs := 0, 0
+	for rows.Next() {
+		var id, used, limit, expire, holdFor int64
+		var name, status, strategy string
+		if err := rows.Scan(&id, &name, &status, &used, &limit, &expire, &strategy, &holdFor); err != nil {
+			return nil, err
+		}
+		u := exportUser{
+			Name:                   name,
+			LimitGB:                bytesToGB(limit),
+			DeviceLimit:            3,
+			UsedBytes:              used,
+			DownloadBytes:          used, // Marzban keeps no direction
+			Expiry:                 expire,
+			Status:                 "active",
+			DataLimitResetStrategy: strategy,
+		}
+		switch status {
+		case "disabled", "limited":
+			u.Status = status
+		case "on_hold":
+			// The clock starts now rather than on first connection
+			if holdFor > 0 {
+				u.Expiry = time.Now().Unix() + holdFor
+			}
+			onHold++
+		}
+		if !resetStrategies[u.DataLimitResetStrategy] {
+			p.warn("user %s: reset strategy %q not supported, set to no_reset", name, strategy)
+			u.DataLimitResetStrategy = "no_reset"
+		}
+
+		var vlessID, vmessID string
+		var groups []int64
+		for _, pr := range proxies[id] {
+			str := func(k string) string { s, _ := pr.settings[k].(string); return s }
+			switch pr.protocol {
+			case "vless":
+				vlessID = str("id")
+			case "vmess":
+				vmessID = str("id")
+			case "trojan":
+				u.TrojanPassword = str("password")
+			case "shadowsocks":
+				u.SSPassword = str("password")
+			}
+			for i, in := range inbounds {
+				tag := fmt.Sprint(in["tag"])
+				if protocolOf[tag] != pr.protocol || excluded[pr.id][tag] {
+					continue
+				}
+				groups = append(groups, int64(i+1))
+				if f := str("flow"); pr.protocol == "vless" && f != "" && flows[tag] == "" {
+					flows[tag] = f
+				}
+				if m := str("method"); pr.protocol == "shadowsocks" && m != "" && ssMethod[tag] == "" {
+					ssMethod[tag] = m
+				}
+			}
+		}
+		u.UUID = vlessID
+		if u.UUID == "" {
+			u.UUID = vmessID
+		} else if vmessID != "" && vmessID != vlessID {
+			mixedIDs++
+		}
+		if u.UUID == "" {
+			u.UUID = uuid.NewString()
+		}
+		p.b.Users = append(p.b.Users, u)
+		for _, g := range groups {
+			p.b.UserGroups = append(p.b.UserGroups, exportUserLink{UserUUID: u.UUID, GroupID: g})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if onHold > 0 {
+		p.warn("%d on-hold users: their expiry now counts from the import", onHold)
+	}
+	if mixedIDs > 0 {
+		p.warn("%d users had different VLESS and VMess UUIDs: their VMess links change to the VLESS UUID", mixedIDs)
+	}
+
+	names := make([]string, len(inbounds))
+	for i, in := range inbounds {
+		tag := fmt.Sprint(in["tag"])
+		names[i] = tag
+		flow := ""
+		if supportsFlow(in) {
+			flow = flows[tag]
+		}
+		normalizeInbound(in, flow)
+		// Marzban sets the Shadowsocks cipher per user; Horizon per inbound
+		settings := in["settings"].(map[string]interface{})
+		if m, _ := settings["method"].(string); m == "" && in["protocol"] == "shadowsocks" {
+			if ssMethod[tag] == "" {
+				ssMethod[tag] = "chacha20-ietf-poly1305"
+			}
+			settings["method"] = ssMethod[tag]
+			p.warn("inbound %s: every user now uses the %s cipher", tag, ssMethod[tag])
+		}
+	}
+	if err := p.addInbounds(inbounds, names); err != nil {
+		return nil, err
+	}
+
+	if err := p.marzbanHosts(conn, protocolOf); err != nil {
+		return nil, err
+	}
+	p.warn("Marzban subscription URLs do not carry over: users need their Horizon subscription link")
+	return p, nil
+}
+
+func (p *panelImport) marzbanHosts(conn *sql.DB, protocolOf map[string]string) error {
+	cols := panelColumns(conn, "hosts")
+	if len(cols) == 0 {
+		return nil
+	}
+	optional := func(col string) string {
+		if cols[col] {
+			return "IFNULL(CAST(" + col + " AS TEXT), '')"
+		}
+		return "''"
+	}
+	rows, err := conn.Query(`SELECT inbound_tag, IFNULL(remark, ''), IFNULL(address, ''), IFNULL(port, 0), ` +
+		strings.Join([]string{optional("sni"), optional("host"), optional("path"), optional("alpn"), optional("fingerprint"), optional("security"), optional("is_disabled")}, ", ") +
+		` FROM hosts ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for i := 0; rows.Next(); i++ {
+		var h exportHost
+		var security, disabled string
+		if err := rows.Scan(&h.InboundTag, &h.Remark, &h.Address, &h.Port, &h.SNI, &h.Host, &h.Path, &h.ALPN, &h.Fingerprint, &security, &disabled); err != nil {
+			return err
+		}
+		if protocolOf[h.InboundTag] == "" {
+			p.warn("host %q: inbound %s was not imported", h.Remark, h.InboundTag)
+			continue
+		}
+		if h.Address == "{SERVER_IP}" {
+			h.Address = "" // The node IP
+		}
+		if h.ALPN == "none" {
+			h.ALPN = ""
+		}
+		if h.Fingerprint == "none" {
+			h.Fingerprint = ""
+		}
+		if security != "" && security != "inbound_default" {
+			p.warn("host %q: security override %s is not supported", h.Remark, security)
+		}
+		h.Remark = p.convertRemark(h.Remark)
+		h.Enabled = disabled != "1"
+		h.Priority = i
+		p.b.Hosts = append(p.b.Hosts, h)
+	}
+	return rows.Err()
+}
+
+// xuiImport reads a 3x-ui (or x-ui) database. Clients there belong to one
+// inbound each; clients sharing a subscription ID become one user, as in
+// 3x-ui's own subscriptions.
+func xuiImport(path string) (*panelImport, error) {
+	conn, err := openPanelDB(path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if cols := panelColumns(conn, "inbounds"); !cols["stream_settings"] {
+		return nil, errors.New("not a 3x-ui database")
+	}
+	p := newPanelImport("3x-ui")
+
+	traffic := map[string][2]int64{}
+	if len(panelColumns(conn, "client_traffics")) > 0 {
+		rows, err := conn.Query("SELECT email, IFNULL(up, 0), IFNULL(down, 0) FROM client_traffics")
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var email string
+			var up, down int64
+			rows.Scan(&email, &up, &down)
+			traffic[email] = [2]int64{up, down}
+		}
+		rows.Close()
+	}
+
+	rows, err := conn.Query(`SELECT IFNULL(remark, ''), IFNULL(enable, 1), IFNULL(listen, ''), port, protocol, IFNULL(settings, '{}'),
+		IFNULL(stream_settings, '{}'), IFNULL(tag, ''), IFNULL(sniffing, '') FROM inbounds ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type client struct {
+		ID         string `json:"id"`
+		Password   string `json:"password"`
+		Flow       string `json:"flow"`
+		Email      string `json:"email"`
+		TotalGB    int64  `json:"totalGB"` // Bytes, despite the name
+		ExpiryTime int64  `json:"expiryTime"`
+		Enable     *bool  `json:"enable"`
+		SubID      string `json:"subId"`
+		Reset      int    `json:"reset"`
+	}
+	type user struct {
+		exportUser
+		groups   []int64
+		clients  int
+		disabled int
+		limits   map[int64]bool
+	}
+	users := map[string]*user{}
+	var order []string
+
+	var inbounds []map[string]interface{}
+	var names []string
+	var disabled []int
+	usedNames := map[string]bool{}
+	onHold := 0
+	for rows.Next() {
+		var remark, listen, protocol, settings, stream, tag, sniffing string
+		var enable bool
+		var port int
+		if err := rows.Scan(&remark, &enable, &listen, &port, &protocol, &settings, &stream, &tag, &sniffing); err != nil {
+			return nil, err
+		}
+		if tag == "" {
+			tag = fmt.Sprintf("inbound-%d", port)
+		}
+		if !importProtocols[protocol] {
+			p.warn("inbound %s: %s inbounds are not imported", tag, protocol)
+			continue
+		}
+
+		in := map[string]interface{}{"tag": tag, "port": port, "protocol": protocol}
+		if listen != "" {
+			in["listen"] = listen
+		}
+		var settingsMap, streamMap, sniffingMap map[string]interface{}
+		if err := json.Unmarshal([]byte(settings), &settingsMap); err != nil {
+			p.warn("inbound %s: settings are not JSON, skipped", tag)
+			continue
+		}
+		if json.Unmarshal([]byte(stream), &streamMap) == nil && streamMap != nil {
+			in["streamSettings"] = streamMap
+			p.xuiHosts(tag, streamMap)
+		}
+		if json.Unmarshal([]byte(sniffing), &sniffingMap) == nil && sniffingMap != nil {
+			in["sniffing"] = sniffingMap
+		}
+
+		var clients []client
+		raw, _ := json.Marshal(settingsMap["clients"])
+		json.Unmarshal(raw, &clients)
+		in["settings"] = settingsMap
+
+		group := int64(len(inbounds) + 1)
+		name := remark
+		if name == "" || usedNames[name] {
+			name = tag
+		}
+		usedNames[name] = true
+
+		flow := ""
+		for _, c := range clients {
+			key := c.SubID
+			if key == "" {
+				key = c.Email
+			}
+			if key == "" {
+				p.warn("inbound %s: a client without email or subscription ID was skipped", tag)
+				continue
+			}
+			u := users[key]
+			if u == nil {
+				u = &user{limits: map[int64]bool{}}
+				u.Name = c.Email
+				u.DeviceLimit = 3
+				u.Status = "active"
+				u.DataLimitResetStrategy = "no_reset"
+				users[key] = u
+				order = append(order, key)
+			}
+			u.clients++
+			u.groups = append(u.groups, group)
+			if c.Enable != nil && !*c.Enable {
+				u.disabled++
+			}
+			t := traffic[c.Email]
+			u.UploadBytes += t[0]
+			u.DownloadBytes += t[1]
+			u.limits[c.TotalGB] = true
+			if c.TotalGB > 0 && bytesToGB(c.TotalGB) > u.LimitGB {
+				u.LimitGB = bytesToGB(c.TotalGB)
+			}
+			expiry := c.ExpiryTime / 1000
+			if c.ExpiryTime < 0 {
+				// Counts from first use in 3x-ui; from the import here
+				expiry = time.Now().Unix() - c.ExpiryTime/1000
+				onHold++
+			}
+			if expiry > u.Expiry {
+				u.Expiry = expiry
+			}
+			if c.Reset > 0 {
+				strategy := map[int]string{1: "day", 7: "week", 30: "month", 365: "year"}[c.Reset]
+				if strategy == "" {
+					p.warn("user %s: reset every %d days is not supported", u.Name, c.Reset)
+				} else {
+					u.DataLimitResetStrategy = strategy
+				}
+			}
+
+			switch protocol {
+			case "vless", "vmess":
+				if u.UUID == "" {
+					u.UUID = c.ID
+				} else if c.ID != u.UUID {
+					p.warn("user %s: inbound %s used another UUID, its links change", u.Name, tag)
+				}
+				if c.Flow != "" && flow == "" {
+					flow = c.Flow
+				}
+			case "trojan":
+				u.TrojanPassword = c.Password
+			case "shadowsocks":
+				u.SSPassword = c.Password
+			}
+		}
+		if !supportsFlow(in) {
+			flow = ""
+		}
+		normalizeInbound(in, flow)
+		if !enable {
+			disabled = append(disabled, len(inbounds))
+		}
+		inbounds = append(inbounds, in)
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, key := range order {
+		u := users[key]
+		if u.UUID == "" {
+			u.UUID = uuid.NewString()
+		}
+		if u.disabled == u.clients {
+			u.Status = "disabled"
+		}
+		u.UsedBytes = u.UploadBytes + u.DownloadBytes
+		if len(u.limits) > 1 {
+			if u.limits[0] {
+				u.LimitGB = 0 // Unlimited somewhere wins
+			}
+			p.warn("user %s: data limits differed between inbounds, using %s", u.Name, formatLimit(u.LimitGB))
+		}
+		p.b.Users = append(p.b.Users, u.exportUser)
+		for _, g := range u.groups {
+			p.b.UserGroups = append(p.b.UserGroups, exportUserLink{UserUUID: u.UUID, GroupID: g})
+		}
+	}
+	if onHold > 0 {
+		p.warn("%d clients had an expiry starting on first use: it now counts from the import", onHold)
+	}
+	if err := p.addInbounds(inbounds, names); err != nil {
+		return nil, err
+	}
+	for _, i := range disabled {
+		p.b.Groups[i].IsDisabled = true // As the inbound was in 3x-ui
+	}
+	p.warn("3x-ui subscription URLs do not carry over: users need their Horizon subscription link")
+	return p, nil
+}
+
+// xuiHosts turns 3x-ui's external proxies (other addresses in front of the
+// same inbound) into hosts.
+func (p *panelImport) xuiHosts(tag string, stream map[string]interface{}) {
+	list, _ := stream["externalProxy"].([]interface{})
+	for i, item := range list {
+		ep, _ := item.(map[string]interface{})
+		dest, _ := ep["dest"].(string)
+		if dest == "" {
+			continue
+		}
+		port, _ := ep["port"].(float64)
+		remark, _ := ep["remark"].(string)
+		p.b.Hosts = append(p.b.Hosts, exportHost{
+			InboundTag: tag, Remark: remark, Address: dest, Port: int(port), Enabled: true, Priority: i,
+		})
+	}
+}
+
+func formatLimit(gb float64) string {
+	if gb == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%.2f GB", math.Round(gb*100)/100)
+}
+
+// runImport backs "horizon import":
+//
+//	horizon import [-dry-run] [-conflict skip|overwrite] marzban <db.sqlite3> [xray_config.json]
+//	horizon import [-dry-run] [-conflict skip|overwrite] 3x-ui <x-ui.db>
+//	horizon import [-dry-run] [-conflict skip|overwrite] horizon <export.json>
+//
+// Conflicts abort the import unless -conflict says how to resolve them.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "report what would be imported without changing anything")
+	conflict := fs.String("conflict", conflictAbort, "what to do with existing names and UUIDs: abort, skip or overwrite")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return errors.New("usage: horizon import [-dry-run] [-conflict abort|skip|overwrite] marzban|3x-ui|horizon <file>")
+	}
+
+	var p *panelImport
+	var err error
+	switch source, path := fs.Arg(0), fs.Arg(1); source {
+	case "marzban":
+		p, err = marzbanImport(path, fs.Arg(2))
+	case "3x-ui", "x-ui":
+		p, err = xuiImport(path)
+	case "horizon":
+		p = newPanelImport("horizon")
+		var data []byte
+		if data, err = os.ReadFile(path); err == nil {
+			err = json.Unmarshal(data, p.b)
+		}
+	default:
+		return fmt.Errorf("unknown source %q (want marzban, 3x-ui or horizon)", source)
+	}
+	if err != nil {
+		return err
+	}
+
+	rep, err := importBundle(p.b, *conflict, *dryRun)
+	if err != nil {
+		return err
+	}
+	rep.Warnings = append(p.warnings, rep.Warnings...)
+	printImportReport(rep)
+	if !rep.DryRun && !rep.Applied {
+		return fmt.Errorf("%d conflicts, nothing imported (rerun with -conflict skip or -conflict overwrite)", len(rep.Conflicts))
+	}
+	return nil
+}
+
+func printImportReport(rep *importReport) {
+	counts := func(label string, m map[string]int) {
+		if len(m) == 0 {
+			return
+		}
+		var parts []string
+		for k, n := range m {
+			parts = append(parts, fmt.Sprintf("%d %s", n, k))
+		}
+		sort.Strings(parts)
+		fmt.Printf("%s: %s\n", label, strings.Join(parts, ", "))
+	}
+	switch {
+	case rep.DryRun:
+		fmt.Println("Dry run, nothing was changed.")
+	case rep.Applied:
+		fmt.Println("Import complete.")
+	default:
+		fmt.Println("Import aborted.")
+	}
+	counts("Created", rep.Created)
+	counts("Updated", rep.Updated)
+	counts("Skipped", rep.Skipped)
+	if len(rep.Conflicts) > 0 {
+		fmt.Println("\nConflicts:")
+		for _, c := range rep.Conflicts {
+			fmt.Printf("  %s %s: %s\n", c.Type, c.Key, c.Resolution)
+		}
+	}
+	if len(rep.Warnings) > 0 {
+		fmt.Println("\nNot mapped / check:")
+		for _, w := range rep.Warnings {
+			fmt.Println("  " + w)
+		}
+	}
+}
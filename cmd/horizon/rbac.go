@@ -0,0 +1,387 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"aether/internal/horizon/db"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Roles
+//
+//	owner     - everything, including managing admins of any role
+//	admin     - everything except managing owners and other admins
+//	reseller  - only their own users (users.owner_admin_id), created from
+//	            their allowed templates and groups, within their caps
+//	read-only - every GET the owner can see, nothing else
+const (
+	roleOwner    = "owner"
+	roleAdmin    = "admin"
+	roleReseller = "reseller"
+	roleReadOnly = "read-only"
+)
+
+func validRole(role string) bool {
+	switch role {
+	case roleOwner, roleAdmin, roleReseller, roleReadOnly:
+		return true
+	}
+	return false
+}
+
+// Routes a reseller may call. Handlers scope each of them to the reseller's
+// own users, groups and templates.
+var resellerPaths = map[string]bool{
+	"/api/tokens":                   true,
+	"/api/users":                    true,
+	"/api/user/from_template":       true,
+	"/api/users/bulk/from_template": true,
+	"/api/users/sub-token":          true,
+	"/api/users/assign-group":       true,
+	"/api/user/renew":               true,
+	"/api/user/config":              true,
+	"/api/user_templates":           true,
+	"/api/groups":                   true,
+}
+
+// roleAllows is the route-level check run by requireAdmin.
+func roleAllows(a *Admin, r *http.Request) bool {
+	// Everyone manages their own login and 2FA
+	if strings.HasPrefix(r.URL.Path, "/api/auth/") {
+		return true
+	}
+	switch a.Role {
+	case roleOwner, roleAdmin:
+		return true
+	case roleReadOnly:
+		return r.Method == "GET"
+	case roleReseller:
+		if r.URL.Path == "/api/user_templates" || r.URL.Path == "/api/groups" {
+			return r.Method == "GET"
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/users/") && strings.HasSuffix(r.URL.Path, "/usage") {
+			return true
+		}
+		return resellerPaths[r.URL.Path]
+	}
+	return false
+}
+
+// isReseller reports whether the request comes from a reseller, whose
+// queries must be scoped to their own users.
+func isReseller(r *http.Request) bool {
+	a := currentAdmin(r)
+	return a != nil && a.Role == roleReseller
+}
+
+// currentAdminID is recorded as users.owner_admin_id on users an admin creates.
+func currentAdminID(r *http.Request) int {
+	if a := currentAdmin(r); a != nil {
+		return a.ID
+	}
+	return 0
+}
+
+// canManageUser reports whether the request may see or change the user.
+func canManageUser(r *http.Request, uuid string) bool {
+	if !isReseller(r) {
+		return true
+	}
+	var owner int
+	err := db.DB.QueryRow("SELECT IFNULL(owner_admin_id, 0) FROM users WHERE uuid=?", uuid).Scan(&owner)
+	return err == nil && owner == currentAdmin(r).ID
+}
+
+// resellerAllowsGroup reports whether a reseller was given the group.
+func resellerAllowsGroup(r *http.Request, groupID int) bool {
+	if !isReseller(r) {
+		return true
+	}
+	var n int
+	db.DB.QueryRow("SELECT COUNT(*) FROM admin_groups WHERE admin_id=? AND group_id=?", currentAdmin(r).ID, groupID).Scan(&n)
+	return n > 0
+}
+
+// resellerAllowsTemplate reports whether a reseller was given the template.
+func resellerAllowsTemplate(r *http.Request, templateID int) bool {
+	if !isReseller(r) {
+		return true
+	}
+	var n int
+	db.DB.QueryRow("SELECT COUNT(*) FROM admin_templates WHERE admin_id=? AND template_id=?", currentAdmin(r).ID, templateID).Scan(&n)
+	return n > 0
+}
+
+// resellerScope returns a WHERE clause limiting column to the groups or
+// templates given to a reseller (table admin_groups or admin_templates, with
+// idColumn group_id or template_id), or "" for other roles.
+func resellerScope(r *http.Request, column, table, idColumn string) string {
+	if !isReseller(r) {
+		return ""
+	}
+	return fmt.Sprintf("WHERE %s IN (SELECT %s FROM %s WHERE admin_id = %d)", column, idColumn, table, currentAdmin(r).ID)
+}
+
+// checkResellerQuota checks that a reseller may add users more users and
+// addGB more allotted traffic. Under a traffic cap unlimited users would
+// escape it, so they are refused.
+func checkResellerQuota(r *http.Request, users int, addGB float64, unlimited bool) error {
+	if !isReseller(r) {
+		return nil
+	}
+	a := currentAdmin(r)
+	var count int
+	var totalGB float64
+	db.DB.QueryRow("SELECT COUNT(*), IFNULL(SUM(limit_gb), 0) FROM users WHERE owner_admin_id=?", a.ID).Scan(&count, &totalGB)
+
+	if a.MaxUsers > 0 && count+users > a.MaxUsers {
+		return fmt.Errorf("user cap reached (%d of %d)", count, a.MaxUsers)
+	}
+	if a.MaxTotalGB > 0 {
+		if unlimited {
+			return errors.New("unlimited users are not allowed under a traffic cap")
+		}
+		if totalGB+addGB > a.MaxTotalGB {
+			return fmt.Errorf("traffic cap reached (%.0f of %.0f GB allotted)", totalGB, a.MaxTotalGB)
+		}
+	}
+	return nil
+}
+
+// Statuses a user is stored with. "limited" belongs to the traffic syncer,
+// which sets it when the data limit is used up; the periodic reset lifts it.
+var userStatuses = map[string]bool{
+	"active":   true,
+	"disabled": true,
+	"limited":  true,
+}
+
+// checkStatusChange checks that the request may move a user from status old
+// to status new under the user's new limit. Resellers can't set "limited",
+// nor make a user active that is already over its limit.
+func checkStatusChange(r *http.Request, old, new string, limitGB float64, usedBytes int64) error {
+	if old == new || !isReseller(r) {
+		return nil
+	}
+	switch {
+	case new == "limited":
+		return errors.New("users are only limited by their data limit")
+	case new == "active" && limitGB > 0 && usedBytes > int64(limitGB*1024*1024*1024):
+		return errors.New("raise the data limit before enabling a user over it")
+	}
+	return nil
+}
+
+// manageableRole reports whether actor may create or change an account with
+// the given role.
+func manageableRole(actor *Admin, role string) bool {
+	if actor.Role == roleOwner {
+		return true
+	}
+	return actor.Role == roleAdmin && (role == roleReseller || role == roleReadOnly)
+}
+
+type adminAccount struct {
+	Admin
+	Disabled    bool    `json:"disabled"`
+	UserCount   int     `json:"user_count"`
+	AllottedGB  float64 `json:"allotted_gb"`
+	GroupIDs    []int   `json:"group_ids"`
+	TemplateIDs []int   `json:"template_ids"`
+}
+
+func adminIDs(query string, id int) []int {
+	ids := []int{}
+	rows, err := db.DB.Query(query, id)
+	if err != nil {
+		return ids
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int
+		if rows.Scan(&v) == nil {
+			ids = append(ids, v)
+		}
+	}
+	return ids
+}
+
+func setAdminScope(id int, groupIDs, templateIDs []int) {
+	db.DB.Exec("DELETE FROM admin_groups WHERE admin_id=?", id)
+	for _, gid := range groupIDs {
+		db.DB.Exec("INSERT OR IGNORE INTO admin_groups (admin_id, group_id) VALUES (?, ?)", id, gid)
+	}
+	db.DB.Exec("DELETE FROM admin_templates WHERE admin_id=?", id)
+	for _, tid := range templateIDs {
+		db.DB.Exec("INSERT OR IGNORE INTO admin_templates (admin_id, template_id) VALUES (?, ?)", id, tid)
+	}
+}
+
+// auditAdmin snapshots an admin account with its groups and templates.
+func auditAdmin(id int) map[string]interface{} {
+	snap := auditRowWith("admins", "id", id, "group_ids", "SELECT group_id FROM admin_groups WHERE admin_id=? ORDER BY group_id")
+	if snap != nil {
+		snap["template_ids"] = auditList("template_ids", "SELECT template_id FROM admin_templates WHERE admin_id=? ORDER BY template_id", id)["template_ids"]
+	}
+	return snap
+}
+
+// /api/admins - owners manage every account, admins manage resellers and
+// read-only accounts.
+func handleAdmins(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	actor := currentAdmin(r)
+
+	switch r.Method {
+	case "GET":
+		rows, err := db.DB.Query(`
+			SELECT a.id, a.username, a.role, a.max_users, a.max_total_gb, a.created_at, a.last_login_at, a.disabled,
+			       (SELECT COUNT(*) FROM users WHERE owner_admin_id = a.id),
+			       (SELECT IFNULL(SUM(limit_gb), 0) FROM users WHERE owner_admin_id = a.id)
+			FROM admins a ORDER BY a.id
+		`)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer rows.Close()
+
+		list := []adminAccount{}
+		for rows.Next() {
+			var acc adminAccount
+			if err := rows.Scan(&acc.ID, &acc.Username, &acc.Role, &acc.MaxUsers, &acc.MaxTotalGB,
+				&acc.CreatedAt, &acc.LastLoginAt, &acc.Disabled, &acc.UserCount, &acc.AllottedGB); err != nil {
+				continue
+			}
+			list = append(list, acc)
+		}
+		for i := range list {
+			list[i].GroupIDs = adminIDs("SELECT group_id FROM admin_groups WHERE admin_id=?", list[i].ID)
+			list[i].TemplateIDs = adminIDs("SELECT template_id FROM admin_templates WHERE admin_id=?", list[i].ID)
+		}
+		json.NewEncoder(w).Encode(list)
+
+	case "POST", "PUT":
+		var req struct {
+			ID          int     `json:"id"`
+			Username    string  `json:"username"`
+			Password    string  `json:"password"`
+			Role        string  `json:"role"`
+			MaxUsers    int     `json:"max_users"`
+			MaxTotalGB  float64 `json:"max_total_gb"`
+			Disabled    bool    `json:"disabled"`
+			GroupIDs    []int   `json:"group_ids"`
+			TemplateIDs []int   `json:"template_ids"`
+			ResetTOTP   bool    `json:"reset_totp"` // For an admin who lost their device and codes
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if !validRole(req.Role) {
+			http.Error(w, "Invalid role", 400)
+			return
+		}
+		if !manageableRole(actor, req.Role) {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+
+		var before map[string]interface{}
+		if r.Method == "POST" {
+			if err := createAdmin(req.Username, req.Password, req.Role); err != nil {
+				http.Error(w, "Create Failed: "+err.Error(), 400)
+				return
+			}
+			db.DB.QueryRow("SELECT id FROM admins WHERE username=?", req.Username).Scan(&req.ID)
+		} else {
+			var current string
+			if err := db.DB.QueryRow("SELECT role FROM admins WHERE id=?", req.ID).Scan(&current); err != nil {
+				http.Error(w, "Admin not found", 404)
+				return
+			}
+			if !manageableRole(actor, current) {
+				http.Error(w, "Forbidden", 403)
+				return
+			}
+			before = auditAdmin(req.ID)
+			if current == roleOwner && (req.Role != roleOwner || req.Disabled) && lastOwner(req.ID) {
+				http.Error(w, "Cannot demote or disable the last owner", 409)
+				return
+			}
+			if req.Password != "" {
+				if len(req.Password) < 8 {
+					http.Error(w, "The password needs at least 8 characters", 400)
+					return
+				}
+				hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+				if err != nil {
+					http.Error(w, "Update Failed", 500)
+					return
+				}
+				db.DB.Exec("UPDATE admins SET password_hash=? WHERE id=?", string(hash), req.ID)
+			}
+			db.DB.Exec("UPDATE admins SET role=?, disabled=? WHERE id=?", req.Role, req.Disabled, req.ID)
+			if req.ResetTOTP {
+				resetTOTP(req.ID)
+			}
+			if req.Disabled || req.Password != "" || req.ResetTOTP {
+				db.DB.Exec("DELETE FROM admin_sessions WHERE admin_id=?", req.ID)
+			}
+		}
+
+		db.DB.Exec("UPDATE admins SET max_users=?, max_total_gb=? WHERE id=?", req.MaxUsers, req.MaxTotalGB, req.ID)
+		setAdminScope(req.ID, req.GroupIDs, req.TemplateIDs)
+		action := "admin.update"
+		if r.Method == "POST" {
+			action = "admin.create"
+		}
+		recordAudit(r, action, "admin", req.ID, before, auditAdmin(req.ID))
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": req.ID})
+
+	case "DELETE":
+		var id int
+		fmt.Sscan(r.URL.Query().Get("id"), &id)
+		var role string
+		if err := db.DB.QueryRow("SELECT role FROM admins WHERE id=?", id).Scan(&role); err == sql.ErrNoRows {
+			http.Error(w, "Admin not found", 404)
+			return
+		}
+		if !manageableRole(actor, role) || id == actor.ID {
+			http.Error(w, "Forbidden", 403)
+			return
+		}
+		if role == roleOwner && lastOwner(id) {
+			http.Error(w, "Cannot delete the last owner", 409)
+			return
+		}
+		before := auditAdmin(id)
+		// Their users stay, owned by the panel
+		db.DB.Exec("UPDATE users SET owner_admin_id=0 WHERE owner_admin_id=?", id)
+		setAdminScope(id, nil, nil)
+		db.DB.Exec("DELETE FROM admin_sessions WHERE admin_id=?", id)
+		db.DB.Exec("DELETE FROM api_tokens WHERE admin_id=?", id)
+		if _, err := db.DB.Exec("DELETE FROM admins WHERE id=?", id); err != nil {
+			http.Error(w, "Delete Failed", 500)
+			return
+		}
+		recordAudit(r, "admin.delete", "admin", id, before, nil)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
+
+// lastOwner reports whether id is the only enabled owner.
+func lastOwner(id int) bool {
+	var others int
+	db.DB.QueryRow("SELECT COUNT(*) FROM admins WHERE role=? AND disabled=0 AND id != ?", roleOwner, id).Scan(&others)
+	return others == 0
+}
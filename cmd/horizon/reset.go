@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"aether/internal/horizon/db"
+)
+
+// Data limit reset strategies (same values as user_templates)
+var resetStrategies = map[string]bool{
+	"no_reset": true,
+	"day":      true,
+	"week":     true,
+	"month":    true,
+	"year":     true,
+}
+
+// validResetStrategy accepts an empty value as "no_reset".
+func validResetStrategy(s string) bool {
+	return s == "" || resetStrategies[s]
+}
+
+// Upper bounds on the length of one period, daylight saving included
+var resetPeriodMax = map[string]time.Duration{
+	"day":   25 * time.Hour,
+	"week":  7*24*time.Hour + time.Hour,
+	"month": 31*24*time.Hour + time.Hour,
+	"year":  366*24*time.Hour + time.Hour,
+}
+
+// resetPeriodEnd returns when the nth period after anchor ends. Monthly and
+// yearly periods keep the anchor's day, or end on the last day of months
+// too short for it, so a user anchored on the 31st resets at every month's
+// end.
+func resetPeriodEnd(strategy string, anchor time.Time, n int) time.Time {
+	switch strategy {
+	case "day":
+		return anchor.AddDate(0, 0, n)
+	case "week":
+		return anchor.AddDate(0, 0, 7*n)
+	case "month":
+		return addMonthsClamped(anchor, n)
+	case "year":
+		return addMonthsClamped(anchor, 12*n)
+	}
+	return time.Time{}
+}
+
+func addMonthsClamped(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month()+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return time.Date(first.Year(), first.Month(), min(t.Day(), lastDay), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
+
+// lastResetBoundary returns the latest period end after anchor that is not
+// after now, or the zero time if the first period is still running.
+func lastResetBoundary(strategy string, anchor, now time.Time) time.Time {
+	maxLen, ok := resetPeriodMax[strategy]
+	if !ok {
+		return time.Time{}
+	}
+	n := max(int(now.Sub(anchor)/maxLen)-1, 0)
+	for !now.Before(resetPeriodEnd(strategy, anchor, n+1)) {
+		n++
+	}
+	if n == 0 {
+		return time.Time{}
+	}
+	return resetPeriodEnd(strategy, anchor, n)
+}
+
+func startUsageResetter() {
+	runUsageResets()
+	ticker := time.NewTicker(5 * time.Minute)
+	for range ticker.C {
+		runUsageResets()
+	}
+}
+
+// runUsageResets archives and zeroes the usage of every user whose reset
+// period has elapsed. Users that were limited for exceeding their quota are
+// re-enabled and pushed back to the nodes.
+func runUsageResets() {
+	rows, err := db.DB.Query(`
+		SELECT uuid, data_limit_reset_strategy, last_reset_at, reset_anchor_at, status
+		FROM users
+		WHERE data_limit_reset_strategy IS NOT NULL AND data_limit_reset_strategy != 'no_reset'
+	`)
+	if err != nil {
+		log.Println("Reset Error:", err)
+		return
+	}
+
+	type pendingReset struct {
+		UUID   string
+		Start  int64
+		End    int64
+		Status string
+	}
+	var due []pendingReset
+	now := time.Now()
+
+	for rows.Next() {
+		var p pendingReset
+		var strategy string
+		var anchor int64
+		if err := rows.Scan(&p.UUID, &strategy, &p.Start, &anchor, &p.Status); err != nil {
+			log.Println("Reset Error:", err)
+			continue
+		}
+
+		if p.Start == 0 {
+			// First period starts now for users that never had an anchor
+			db.DB.Exec("UPDATE users SET last_reset_at=?, reset_anchor_at=? WHERE uuid=?", now.Unix(), now.Unix(), p.UUID)
+			continue
+		}
+		if anchor == 0 {
+			anchor = p.Start
+			db.DB.Exec("UPDATE users SET reset_anchor_at=? WHERE uuid=?", anchor, p.UUID)
+		}
+		// Periods are counted from the anchor rather than the last reset, so
+		// they don't drift. Any missed entirely while Horizon was down are
+		// folded into this one.
+		end := lastResetBoundary(strategy, time.Unix(anchor, 0), now)
+		if end.IsZero() || end.Unix() <= p.Start {
+			continue
+		}
+		p.End = end.Unix()
+		due = append(due, p)
+	}
+	rows.Close()
+
+	reEnabled := 0
+	for _, p := range due {
+		usedBytes, err := resetUserUsage(p.UUID, p.Start, p.End)
+		if err != nil {
+			log.Printf("❌ Usage Reset Failed for %s: %v", p.UUID, err)
+			continue
+		}
+		log.Printf("🔁 Usage reset for %s (%.2fGB archived)", p.UUID, float64(usedBytes)/1e9)
+		if p.Status == "limited" {
+			reEnabled++
+		}
+	}
+
+	if reEnabled > 0 {
+		pushAllNodeConfigs()
+	}
+}
+
+// resetUserUsage archives the finished period and starts a new one, and
+// returns the usage it archived. The usage is read in the same transaction,
+// so traffic recorded since the user was picked is not lost.
+func resetUserUsage(uuid string, periodStart, periodEnd int64) (int64, error) {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO user_usage_resets (user_uuid, used_bytes, period_start, period_end)
+		SELECT uuid, IFNULL(used_bytes, 0), ?, ? FROM users WHERE uuid=?
+	`, periodStart, periodEnd, uuid)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, sql.ErrNoRows // Deleted since it was picked
+	}
+	var usedBytes int64
+	id, _ := res.LastInsertId()
+	if err := tx.QueryRow("SELECT used_bytes FROM user_usage_resets WHERE id=?", id).Scan(&usedBytes); err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users SET used_bytes=0, upload_bytes=0, download_bytes=0, last_reset_at=?,
+		       status = CASE WHEN status='limited' THEN 'active' ELSE status END
+		WHERE uuid=?
+	`, periodEnd, uuid)
+	if err != nil {
+		return 0, err
+	}
+	return usedBytes, tx.Commit()
+}
+
+// pushAllNodeConfigs re-renders and pushes the config of every node that has
+// configs assigned, so user status changes take effect.
+func pushAllNodeConfigs() {
+	rows, err := db.DB.Query("SELECT DISTINCT node_id FROM node_configs")
+	if err != nil {
+		log.Println("Push Error:", err)
+		return
+	}
+	var nodeIDs []int
+	for rows.Next() {
+		var id int
+		rows.Scan(&id)
+		nodeIDs = append(nodeIDs, id)
+	}
+	rows.Close()
+
+	for _, id := range nodeIDs {
+		if err := pushNodeConfig(id); err != nil {
+			log.Printf("⚠️ Config Push Failed for Node %d: %v", id, err)
+		}
+	}
+}
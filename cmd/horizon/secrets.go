@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"aether/internal/horizon/db"
+	"aether/internal/horizon/secrets"
+)
+
+// Secrets at rest. The columns below, and the private keys inside
+// core_configs.raw_inbounds, are stored sealed under the key-encryption key
+// (see internal/horizon/secrets). They are opened only to talk to agents and
+// clients, and API responses show redactedSecret instead.
+
+const redactedSecret = "[redacted]"
+
+// Server-side random secrets kept in settings by getSecret
+var secretSettings = []string{"enigma_server_key", "sub_token_secret", "credential_secret"}
+
+var sealedColumns = []struct{ table, idColumn, column, where string }{
+	{"nodes", "id", "master_key", ""},
+	{"enigma_keys", "key_id", "private_key", ""},
+	{"devices", "id", "enigma_key", ""},
+	{"admins", "id", "totp_secret", ""},
+	{"settings", "key", "value", "key IN ('" + strings.Join(secretSettings, "', '") + "')"},
+}
+
+// Secret fields of an inbound: Reality private keys and WireGuard server keys
+var inboundSecretPaths = [][]string{
+	{"streamSettings", "realitySettings", "privateKey"},
+	{"settings", "secretKey"},
+}
+
+// transformInbounds applies fn to every secret field in a raw_inbounds value
+// (an array or a single inbound). Values that aren't JSON are left alone.
+func transformInbounds(raw string, fn func(string) (string, error)) (string, error) {
+	list, single, ok := parseInbounds(raw)
+	if !ok {
+		return raw, nil
+	}
+	changed := false
+	for _, in := range list {
+		for _, path := range inboundSecretPaths {
+			parent, key := inboundField(in, path)
+			value, ok := parent[key].(string)
+			if !ok || value == "" {
+				continue
+			}
+			nv, err := fn(value)
+			if err != nil {
+				return "", err
+			}
+			if nv != value {
+				parent[key] = nv
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return raw, nil
+	}
+	return formatInbounds(list, single)
+}
+
+func parseInbounds(raw string) ([]map[string]interface{}, bool, bool) {
+	trimmed := strings.TrimSpace(raw)
+	if strings.HasPrefix(trimmed, "[") {
+		var list []map[string]interface{}
+		if json.Unmarshal([]byte(trimmed), &list) != nil {
+			return nil, false, false
+		}
+		return list, false, true
+	}
+	var single map[string]interface{}
+	if json.Unmarshal([]byte(trimmed), &single) != nil || single == nil {
+		return nil, true, false
+	}
+	return []map[string]interface{}{single}, true, true
+}
+
+func formatInbounds(list []map[string]interface{}, single bool) (string, error) {
+	var out interface{} = list
+	if single {
+		out = list[0]
+	}
+	b, err := json.MarshalIndent(out, "", "  ")
+	return string(b), err
+}
+
+// inboundField returns the object holding the last element of path, or nil.
+func inboundField(in map[string]interface{}, path []string) (map[string]interface{}, string) {
+	parent := in
+	for _, key := range path[:len(path)-1] {
+		next, ok := parent[key].(map[string]interface{})
+		if !ok {
+			return nil, ""
+		}
+		parent = next
+	}
+	return parent, path[len(path)-1]
+}
+
+func sealInbounds(raw string) (string, error) {
+	return transformInbounds(raw, secrets.Seal)
+}
+
+func openInbounds(raw string) (string, error) {
+	return transformInbounds(raw, secrets.Open)
+}
+
+func redactInbounds(raw string) string {
+	redacted, _ := transformInbounds(raw, func(string) (string, error) { return redactedSecret, nil })
+	return redacted
+}
+
+// restoreRedactedInbounds puts the stored secrets back into an edited
+// raw_inbounds that still holds redactedSecret, matching inbounds by tag.
+func restoreRedactedInbounds(edited, stored string) string {
+	list, single, ok := parseInbounds(edited)
+	if !ok || !strings.Contains(edited, redactedSecret) {
+		return edited
+	}
+	storedList, _, _ := parseInbounds(stored)
+	byTag := map[string]map[string]interface{}{}
+	for _, in := range storedList {
+		if tag, _ := in["tag"].(string); tag != "" {
+			byTag[tag] = in
+		}
+	}
+
+	for i, in := range list {
+		old := byTag[fmt.Sprint(in["tag"])]
+		if old == nil && i < len(storedList) {
+			old = storedList[i]
+		}
+		for _, path := range inboundSecretPaths {
+			parent, key := inboundField(in, path)
+			if parent == nil || parent[key] != redactedSecret {
+				continue
+			}
+			delete(parent, key)
+			if old != nil {
+				if oldParent, _ := inboundField(old, path); oldParent != nil && oldParent[key] != nil {
+					parent[key] = oldParent[key]
+				}
+			}
+		}
+	}
+	restored, err := formatInbounds(list, single)
+	if err != nil {
+		return edited
+	}
+	return restored
+}
+
+// rewriteSecrets runs fn over every secret value in conn and stores what it
+// returns, all in one transaction. Columns an older schema lacks are skipped.
+func rewriteSecrets(conn *sql.DB, fn func(string) (string, error)) (int, error) {
+	tx, err := conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	changed := 0
+	rewrite := func(table, idColumn, column, where string, apply func(string) (string, error)) error {
+		var exists int
+		tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?", table, column).Scan(&exists)
+		if exists == 0 {
+			return nil
+		}
+		query := "SELECT " + idColumn + ", " + column + " FROM " + table + " WHERE IFNULL(" + column + ", '') != ''"
+		if where != "" {
+			query += " AND " + where
+		}
+		rows, err := tx.Query(query)
+		if err != nil {
+			return err
+		}
+		type row struct {
+			id    interface{}
+			value string
+		}
+		var list []row
+		for rows.Next() {
+			var r row
+			if err := rows.Scan(&r.id, &r.value); err != nil {
+				rows.Close()
+				return err
+			}
+			list = append(list, r)
+		}
+		rows.Close()
+
+		for _, r := range list {
+			nv, err := apply(r.value)
+			if err != nil {
+				return fmt.Errorf("%s.%s (%s %v): %w", table, column, idColumn, r.id, err)
+			}
+			if nv == r.value {
+				continue
+			}
+			if _, err := tx.Exec("UPDATE "+table+" SET "+column+"=? WHERE "+idColumn+"=?", nv, r.id); err != nil {
+				return err
+			}
+			changed++
+		}
+		return nil
+	}
+
+	for _, c := range sealedColumns {
+		if err := rewrite(c.table, c.idColumn, c.column, c.where, fn); err != nil {
+			return 0, err
+		}
+	}
+	err = rewrite("core_configs", "id", "raw_inbounds", "", func(raw string) (string, error) {
+		return transformInbounds(raw, fn)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return changed, tx.Commit()
+}
+
+// sealSecretsAtRest runs at startup. It seals plaintext left by older
+// versions and checks that every sealed value opens under the current KEK,
+// so a wrong key stops Horizon before it writes anything.
+func sealSecretsAtRest() {
+	n, err := rewriteSecrets(db.DB, func(value string) (string, error) {
+		if secrets.IsSealed(value) {
+			_, err := secrets.Open(value)
+			return value, err
+		}
+		return secrets.Seal(value)
+	})
+	if err != nil {
+		log.Fatalln("❌ Secrets do not open with the configured key-encryption key:", err)
+	}
+	if n > 0 {
+		log.Printf("🔐 Sealed %d plaintext secrets", n)
+	}
+}
+
+// runRekey backs the -rekey flag: it re-seals every secret under the key in
+// path (created if missing). Stop the panel first, then point HORIZON_KEK_FILE
+// at the new key.
+func runRekey(path string) error {
+	newKey, err := secrets.LoadKeyFile(path, true)
+	if err != nil {
+		return err
+	}
+	if newKey.ID == secrets.Current().ID {
+		return fmt.Errorf("%s holds the current key", path)
+	}
+	n, err := rewriteSecrets(db.DB, func(value string) (string, error) {
+		plain, err := secrets.Open(value)
+		if err != nil {
+			return "", err
+		}
+		return newKey.Seal(plain)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("🔐 Re-sealed %d secrets under key %s. Set HORIZON_KEK_FILE=%s (or HORIZON_KEK) and start Horizon.", n, newKey.ID, path)
+	return nil
+}
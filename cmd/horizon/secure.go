@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"aether/internal/horizon/db"
+	"aether/internal/horizon/secrets"
+	"aether/pkg/enigma"
+)
+
+// Secure API key selection. A request is sealed with one of:
+//   - X-Enigma-Device: <hardware id>  -> that device's long-term key
+//   - X-Enigma-Key: <ephemeral pub>   -> X25519 session key (see pkg/enigma)
+//   - neither                         -> the legacy shared EnigmaKey (v1 only)
+// X-Enigma-Version: 2 selects the v2 envelope (key ID, timestamp, nonce,
+// bound to method and path); without it the body is a v1 message, accepted
+// only while the enigma_accept_v1 setting is on (off by default: the shared
+// key ships in every old APK, so it protects nothing once extracted). The response is sealed with the
+// same key and envelope version; X-Enigma-Key-Id on the reply names the
+// current server key (see enigma_keys.go).
+
+// Messages older or newer than this are refused; nonces are kept as long.
+const enigmaReplayWindow = 5 * time.Minute
+
+var enigmaReplay = enigma.NewReplayCache(enigmaReplayWindow)
+
+// enigmaRequest is the key context of an opened secure request, reused to
+// seal the reply.
+type enigmaRequest struct {
+	Key       []byte
+	Handshake bool
+	Device    bool // Sealed with the device's own long-term key
+	Version   int
+	KeyID     string
+	Binding   string
+}
+
+// GET /api/v1/secure/key - the current public key clients run the handshake
+// against, and the other keys still accepted during a rotation.
+func handleSecureKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	current, err := currentEnigmaKey()
+	if err != nil {
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	type acceptedKey struct {
+		KeyID     string `json:"key_id"`
+		PublicKey string `json:"public_key"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	accepted := []acceptedKey{}
+	now := time.Now().Unix()
+	rows, err := db.DB.Query("SELECT "+enigmaKeyColumns+" FROM enigma_keys WHERE key_id != ? ORDER BY activates_at DESC", current.ID)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			if k, err := scanEnigmaKey(rows.Scan); err == nil && k.usable(now) {
+				accepted = append(accepted, acceptedKey{k.ID, k.PublicKey, k.ExpiresAt})
+			}
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"algorithm":  "x25519",
+		"key_id":     current.ID,
+		"public_key": current.PublicKey,
+		"expires_at": current.ExpiresAt,
+		"accepted":   accepted,
+	})
+}
+
+// resolveEnigmaKey picks the key a secure request was sealed with. handshake
+// is true when it came from a fresh X25519 exchange against the server key
+// named kid (the current key if empty).
+func resolveEnigmaKey(r *http.Request, kid string) (key []byte, handshake bool, err error) {
+	if hwid := r.Header.Get("X-Enigma-Device"); hwid != "" {
+		key, err := deviceEnigmaKey(hwid)
+		return key, false, err
+	}
+	if eph := r.Header.Get("X-Enigma-Key"); eph != "" {
+		pub, err := base64.StdEncoding.DecodeString(eph)
+		if err != nil {
+			return nil, false, errors.New("invalid ephemeral key")
+		}
+		server, err := acceptedEnigmaKey(kid)
+		if err != nil {
+			return nil, false, err
+		}
+		key, err := enigma.ServerSessionKey(server.private, pub)
+		return key, true, err
+	}
+	return EnigmaKey, false, nil
+}
+
+// deviceEnigmaKey returns the long-term key issued to a device at registration.
+func deviceEnigmaKey(hwid string) ([]byte, error) {
+	var encoded string
+	err := db.DB.QueryRow("SELECT IFNULL(enigma_key, '') FROM devices WHERE hardware_id=?", hwid).Scan(&encoded)
+	if err == sql.ErrNoRows || encoded == "" {
+		return nil, errors.New("device not registered")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if encoded, err = secrets.Open(encoded); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+var errDeviceKeyExists = errors.New("device already has a key")
+
+// issueDeviceEnigmaKey generates and stores a new long-term key for a
+// device. Unless rotate is set it only succeeds for a device that has no key
+// yet; otherwise knowing a user and hardware ID would be enough to take a
+// device's key over.
+func issueDeviceEnigmaKey(deviceID int, rotate bool) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	encoded := base64.StdEncoding.EncodeToString(key)
+	sealed, err := secrets.Seal(encoded)
+	if err != nil {
+		return "", err
+	}
+	query := "UPDATE devices SET enigma_key=? WHERE id=?"
+	if !rotate {
+		query += " AND IFNULL(enigma_key, '')=''"
+	}
+	res, err := db.DB.Exec(query, sealed, deviceID)
+	if err != nil {
+		return "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", errDeviceKeyExists
+	}
+	return encoded, nil
+}
+
+// openEnigmaRequest reads and decrypts a secure request body. On failure it
+// returns the HTTP status to answer with.
+func openEnigmaRequest(r *http.Request) ([]byte, *enigmaRequest, int, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, nil, 500, errors.New("read error")
+	}
+
+	v2 := r.Header.Get("X-Enigma-Version") == "2"
+	if !v2 && getSetting("enigma_accept_v1") != "true" {
+		return nil, nil, 403, errors.New("v1 messages are no longer accepted")
+	}
+
+	// v2 names the server key in its header; v1 handshakes may send
+	// X-Enigma-Key-Id, otherwise they are against the current key.
+	kid := r.Header.Get("X-Enigma-Key-Id")
+	if v2 {
+		h, err := enigma.ParseHeader(string(body))
+		if err != nil {
+			return nil, nil, 400, errors.New("malformed message")
+		}
+		kid = h.KeyID
+	}
+
+	key, handshake, err := resolveEnigmaKey(r, kid)
+	if err != nil {
+		return nil, nil, 403, err
+	}
+	req := &enigmaRequest{
+		Key: key, Handshake: handshake, Device: r.Header.Get("X-Enigma-Device") != "",
+		Version: 1, Binding: enigma.Binding(r.Method, r.URL.Path),
+	}
+
+	if !v2 {
+		plaintext, err := enigma.Open(string(body), key)
+		if err != nil {
+			return nil, nil, 403, errors.New("decryption failed")
+		}
+		return plaintext, req, 200, nil
+	}
+
+	// v2 never falls back to the shared key
+	if !handshake && r.Header.Get("X-Enigma-Device") == "" {
+		return nil, nil, 403, errors.New("v2 requires a handshake or device key")
+	}
+	plaintext, h, err := enigma.OpenV2(string(body), key, req.Binding)
+	if err != nil {
+		return nil, nil, 403, errors.New("decryption failed")
+	}
+	if err := enigmaReplay.Check(h); err == enigma.ErrReplay {
+		return nil, nil, 403, errors.New("replayed message")
+	} else if err != nil {
+		return nil, nil, 403, errors.New("stale message, check the device clock")
+	}
+	req.Version, req.KeyID = 2, h.KeyID
+	return plaintext, req, 200, nil
+}
+
+// writeEnigmaResponse seals resp the same way the request was sealed.
+func writeEnigmaResponse(w http.ResponseWriter, req *enigmaRequest, resp interface{}) {
+	respBytes, _ := json.Marshal(resp)
+
+	var sealed string
+	var err error
+	if req.Version == 2 {
+		sealed, err = enigma.SealV2(respBytes, req.Key, req.KeyID, req.Binding)
+	} else {
+		sealed, err = enigma.Seal(respBytes, req.Key)
+	}
+	if err != nil {
+		http.Error(w, "Encryption failed", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if current, err := currentEnigmaKey(); err == nil {
+		w.Header().Set("X-Enigma-Key-Id", current.ID)
+	}
+	if req.Version == 2 {
+		w.Header().Set("X-Enigma-Version", "2")
+	}
+	w.Write([]byte(sealed))
+}
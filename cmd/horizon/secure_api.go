@@ -0,0 +1,208 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"aether/internal/horizon/db"
+)
+
+// Secure API for the Aether app. Every request and response is an Enigma
+// message (see secure.go); the plaintext is a JSON object with an action.
+// The user is identified by a subscription token. Older clients that send
+// the user UUID instead are only accepted while sub_allow_uuid_links is on,
+// the same rule as for /sub links. Every action except register_device needs
+// a device already bound to the user.
+//
+//	register_device   {hardware_id, label}  -> device_key (first binding over a
+//	                                           handshake, or a new one when sealed
+//	                                           with the current device key)
+//	get_config        {hardware_id}         -> the rendered subscription
+//	list_devices      {hardware_id}         -> the user's devices
+//	unregister_device {hardware_id, device_id} (0 = the calling device)
+//	heartbeat         {hardware_id}         -> account status
+
+type secureRequest struct {
+	Action     string `json:"action"`
+	Token      string `json:"token"`
+	UserUUID   string `json:"user_uuid"`
+	HardwareID string `json:"hardware_id"`
+	Label      string `json:"label"`
+	DeviceID   int    `json:"device_id"`
+}
+
+type secureDevice struct {
+	ID       int    `json:"id"`
+	Label    string `json:"label"`
+	Status   string `json:"status"`
+	LastSeen string `json:"last_seen"`
+	Current  bool   `json:"current"`
+}
+
+func secureError(message string) map[string]interface{} {
+	return map[string]interface{}{"status": "error", "message": message}
+}
+
+// POST /api/v1/secure
+func handleSecure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	plaintext, sec, status, err := openEnigmaRequest(r)
+	if err != nil {
+		http.Error(w, "Enigma: "+err.Error(), status)
+		return
+	}
+
+	var req secureRequest
+	if err := json.Unmarshal(plaintext, &req); err != nil {
+		http.Error(w, "Invalid JSON", 400)
+		return
+	}
+	writeEnigmaResponse(w, sec, secureAction(r, sec, req))
+}
+
+func secureAction(r *http.Request, sec *enigmaRequest, req secureRequest) map[string]interface{} {
+	var uuid string
+	switch {
+	case req.Token != "":
+		var err error
+		if uuid, err = verifySubToken(req.Token); err != nil {
+			return secureError("Invalid token")
+		}
+	case req.UserUUID != "" && getSetting("sub_allow_uuid_links") == "true":
+		uuid = req.UserUUID
+	default:
+		return secureError("Token required")
+	}
+
+	// A request sealed with a device key speaks for that device only
+	if hwid := r.Header.Get("X-Enigma-Device"); hwid != "" {
+		if req.HardwareID == "" {
+			req.HardwareID = hwid
+		} else if req.HardwareID != hwid {
+			return secureError("Hardware ID does not match the device key")
+		}
+	}
+	if req.HardwareID == "" {
+		return secureError("hardware_id is required")
+	}
+
+	if req.Action == "register_device" {
+		return secureRegister(sec, uuid, req)
+	}
+
+	devID, err := userDeviceID(uuid, req.HardwareID)
+	switch err {
+	case nil:
+	case errDeviceUnknown:
+		return secureError("Device not registered")
+	case errDeviceBlocked:
+		return secureError("Device blocked")
+	default:
+		return secureError("Internal Error")
+	}
+	touchDevice(devID)
+
+	switch req.Action {
+	case "get_config":
+		u, err := loadSubUser(uuid)
+		if err != nil {
+			return secureError("User not found")
+		}
+		proxies, err := subscriptionProxies(u)
+		if err != nil {
+			return secureError("Config unavailable")
+		}
+		resp := map[string]interface{}{"status": "ok", "config": buildEnigmaSub(u, proxies)}
+		if token, _, err := userSubToken(uuid); err == nil {
+			resp["subscription_url"] = subscriptionURL(r, token)
+		}
+		return resp
+
+	case "list_devices":
+		var limit int
+		db.DB.QueryRow("SELECT device_limit FROM users WHERE uuid=?", uuid).Scan(&limit)
+		rows, err := db.DB.Query(`
+			SELECT d.id, IFNULL(d.label, ''), d.status, IFNULL(d.last_seen, '') FROM devices d
+			JOIN user_devices ud ON d.id = ud.device_id
+			WHERE ud.user_uuid=? ORDER BY d.id
+		`, uuid)
+		if err != nil {
+			return secureError("Internal Error")
+		}
+		defer rows.Close()
+
+		devices := []secureDevice{}
+		for rows.Next() {
+			var d secureDevice
+			if rows.Scan(&d.ID, &d.Label, &d.Status, &d.LastSeen) == nil {
+				d.Current = d.ID == devID
+				devices = append(devices, d)
+			}
+		}
+		return map[string]interface{}{"status": "ok", "devices": devices, "device_limit": limit}
+
+	case "unregister_device":
+		target := req.DeviceID
+		if target == 0 {
+			target = devID
+		}
+		if err := unlinkUserDevice(uuid, target); err == errDeviceUnknown {
+			return secureError("Device not found")
+		} else if err != nil {
+			return secureError("Internal Error")
+		}
+		return map[string]interface{}{"status": "ok", "message": "Device Unregistered"}
+
+	case "heartbeat":
+		u, err := loadSubUser(uuid)
+		if err != nil {
+			return secureError("User not found")
+		}
+		return map[string]interface{}{
+			"status":      "ok",
+			"user_status": u.subStatus(),
+			"server_time": time.Now().Unix(),
+		}
+	}
+	return secureError("Unknown Action")
+}
+
+// secureRegister binds the calling device to the user. A device's first
+// long-term key is handed out over a fresh handshake, never under the shared
+// key. After that only the device itself can replace it, with a request
+// sealed under the current key; a device that lost its key has to be removed
+// by an admin or by another of the user's devices and registered again.
+func secureRegister(sec *enigmaRequest, uuid string, req secureRequest) map[string]interface{} {
+	devID, err := bindUserDevice(uuid, req.HardwareID, req.Label)
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		return secureError("User not found")
+	case errDeviceLimit:
+		return secureError("Device limit reached")
+	case errDeviceBlocked:
+		return secureError("Device blocked")
+	default:
+		return secureError("Internal Error")
+	}
+
+	resp := map[string]interface{}{"status": "ok", "message": "Device Registered", "device_id": devID}
+	if sec.Handshake || sec.Device {
+		deviceKey, err := issueDeviceEnigmaKey(devID, sec.Device)
+		switch err {
+		case nil:
+			resp["device_key"] = deviceKey
+		case errDeviceKeyExists:
+			return secureError("Device already has a key; rotate it with a request sealed by that key")
+		default:
+			return secureError("Key issue failed")
+		}
+	}
+	return resp
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"aether/internal/horizon/db"
+	"aether/internal/horizon/secrets"
+)
+
+// Panel-wide settings and their defaults. Only keys listed here can be set.
+var defaultSettings = map[string]string{
+	"sub_profile_title":   "Horizon",
+	"sub_update_interval": "12", // Hours
+	"sub_support_url":     "",
+	"sub_web_page_url":    "",
+	"sub_base_url":        "", // Public base for /sub links; request host if empty
+	// Accept the old /sub/<uuid> and /sub?uuid= links alongside tokens. While
+	// on, revoking a token does not lock out anyone who knows the UUID.
+	"sub_allow_uuid_links": "false",
+
+	// Remark templates. Variables: {USERNAME} {NODE} {TAG} {PROTOCOL} {TRANSPORT}
+	// {STATUS} {DATA_USED} {DATA_LIMIT} {DATA_LEFT} {DAYS_LEFT} {EXPIRE_DATE}.
+	// The *_remarks settings hold one placeholder entry per line.
+	"sub_remark_template":  "Horizon-{NODE}-{TAG}",
+	"sub_show_info":        "false",
+	"sub_info_remarks":     "Traffic left: {DATA_LEFT}\nDays left: {DAYS_LEFT}",
+	"sub_limited_remarks":  "Data limit reached ({DATA_LIMIT})\nRenew your subscription to continue",
+	"sub_expired_remarks":  "Subscription expired on {EXPIRE_DATE}\nRenew your subscription to continue",
+	"sub_disabled_remarks": "Account disabled\nContact support",
+
+	// Served instead of configs when a device limit applies (hwid_limit)
+	"sub_hwid_required_remarks":  "This subscription needs an app that sends a device ID",
+	"sub_device_limit_remarks":   "Device limit reached\nRemove a device to use this one",
+	"sub_device_blocked_remarks": "This device is blocked\nContact support",
+
+	// Admin login lifetime
+	"admin_session_hours": "12",
+
+	// Accept v1 Enigma messages (no replay protection, and the shared key
+	// built into old app releases) on the secure API. Only for a migration
+	// window while old clients update.
+	"enigma_accept_v1": "false",
+	// How long a replaced or retired server key is still accepted
+	"enigma_key_overlap_days": "30",
+
+	// Roles that must enroll in 2FA, comma-separated (e.g. "owner,admin")
+	"mfa_required_roles": "",
+	// How long a login or step-up verification covers sensitive operations
+	"mfa_step_up_minutes": "10",
+
+	// Days of audit log to keep (0 = forever)
+	"audit_retention_days": "90",
+
+	// Scheduled backups (see backup.go): hours between snapshots (0 = off),
+	// how many to keep (0 = all) and whether to encrypt them with the KEK
+	"backup_interval_hours": "24",
+	"backup_keep":           "7",
+	"backup_encrypt":        "false",
+
+	// Routing hints for the Aether app (JSON, see sub_enigma.go)
+	"app_routing_rules": `{"direct": ["geosite:private", "geoip:private"], "block": []}`,
+}
+
+// getSetting returns the stored value for key, or its default.
+func getSetting(key string) string {
+	var value sql.NullString
+	err := db.DB.QueryRow("SELECT value FROM settings WHERE key=?", key).Scan(&value)
+	if err != nil || !value.Valid {
+		return defaultSettings[key]
+	}
+	return value.String
+}
+
+// getSecret returns a random server-side secret stored under key, creating it
+// on first use. Secrets are not in defaultSettings and never leave the panel;
+// keys must be listed in secretSettings so they are sealed at rest.
+func getSecret(key string) []byte {
+	var value string
+	err := db.DB.QueryRow("SELECT value FROM settings WHERE key=?", key).Scan(&value)
+	if err == nil {
+		if secret, err := hex.DecodeString(secrets.OpenOrEmpty(value)); err == nil && len(secret) > 0 {
+			return secret
+		}
+	}
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	if sealed, err := secrets.Seal(hex.EncodeToString(secret)); err == nil {
+		db.DB.Exec("INSERT OR IGNORE INTO settings (key, value) VALUES (?, ?)", key, sealed)
+	}
+	// Another request may have won the race; the stored value is authoritative
+	db.DB.QueryRow("SELECT value FROM settings WHERE key=?", key).Scan(&value)
+	if stored, err := hex.DecodeString(secrets.OpenOrEmpty(value)); err == nil && len(stored) > 0 {
+		return stored
+	}
+	return secret
+}
+
+func handleSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case "GET":
+		settings := make(map[string]string, len(defaultSettings))
+		for key := range defaultSettings {
+			settings[key] = getSetting(key)
+		}
+		json.NewEncoder(w).Encode(settings)
+
+	case "PUT":
+		var req map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		for key := range req {
+			if _, ok := defaultSettings[key]; !ok {
+				http.Error(w, "Unknown setting: "+key, 400)
+				return
+			}
+		}
+		before, after := map[string]interface{}{}, map[string]interface{}{}
+		for key, value := range req {
+			before[key], after[key] = getSetting(key), value
+		}
+		// The 2FA policy is the owner's, and changing it needs a step-up
+		for key, value := range req {
+			if !strings.HasPrefix(key, "mfa_") || before[key] == value {
+				continue
+			}
+			a := currentAdmin(r)
+			if a.Role != roleOwner {
+				http.Error(w, "Only owners can change "+key, 403)
+				return
+			}
+			if !requireStepUp(a, w) {
+				return
+			}
+			break
+		}
+		for key, value := range req {
+			_, err := db.DB.Exec(`
+				INSERT INTO settings (key, value) VALUES (?, ?)
+				ON CONFLICT(key) DO UPDATE SET value = excluded.value
+			`, key, value)
+			if err != nil {
+				http.Error(w, err.Error(), 500)
+				return
+			}
+		}
+		recordAudit(r, "settings.update", "settings", "", before, after)
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
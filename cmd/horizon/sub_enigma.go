@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"aether/internal/horizon/db"
+	"aether/internal/horizon/secrets"
+	"aether/pkg/enigma"
+)
+
+// Structured subscription for the official Aether app, sealed with Enigma so
+// there is nothing link-shaped on the wire. Bump enigmaSubVersion on any
+// breaking schema change; additive fields keep the version.
+const enigmaSubVersion = 1
+
+type enigmaSub struct {
+	Version        int             `json:"version"`
+	GeneratedAt    int64           `json:"generated_at"`
+	UpdateInterval int             `json:"update_interval"` // Hours
+	User           enigmaSubUser   `json:"user"`
+	Notices        []string        `json:"notices,omitempty"`
+	Nodes          []enigmaSubNode `json:"nodes"`
+	Routing        json.RawMessage `json:"routing,omitempty"`
+}
+
+type enigmaSubUser struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+	Limit    int64  `json:"limit"`  // Bytes, 0 = unlimited
+	Expire   int64  `json:"expire"` // Unix, 0 = never
+}
+
+type enigmaSubNode struct {
+	ID        int                 `json:"id"`
+	Name      string              `json:"name"`
+	Endpoints []enigmaSubEndpoint `json:"endpoints"`
+}
+
+// enigmaSubEndpoint is one inbound as reached through one host.
+type enigmaSubEndpoint struct {
+	Tag         string `json:"tag"`
+	Remark      string `json:"remark"`
+	Protocol    string `json:"protocol"`
+	Address     string `json:"address"`
+	Port        int    `json:"port"`
+	Credential  string `json:"credential"` // UUID, password or private key
+	Flow        string `json:"flow,omitempty"`
+	Network     string `json:"network"`
+	Security    string `json:"security"`
+	SNI         string `json:"sni,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	ALPN        string `json:"alpn,omitempty"`
+	PublicKey   string `json:"public_key,omitempty"`
+	ShortID     string `json:"short_id,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Host        string `json:"host,omitempty"`
+	ServiceName string `json:"service_name,omitempty"`
+	HeaderType  string `json:"header_type,omitempty"`
+	Mode        string `json:"mode,omitempty"`
+	Extra       string `json:"extra,omitempty"`
+	Method      string `json:"method,omitempty"`
+	LocalAddr   string `json:"local_address,omitempty"`
+	MTU         int    `json:"mtu,omitempty"`
+	Link        string `json:"link"` // Share link, for clients that import rather than parse
+}
+
+func buildEnigmaSub(u subUser, proxies []Proxy) enigmaSub {
+	interval, _ := strconv.Atoi(getSetting("sub_update_interval"))
+	sub := enigmaSub{
+		Version:        enigmaSubVersion,
+		GeneratedAt:    time.Now().Unix(),
+		UpdateInterval: interval,
+		User: enigmaSubUser{
+			Name: u.Name, Status: u.subStatus(),
+			Upload: u.Upload, Download: u.Download, Limit: u.Limit, Expire: u.Expiry,
+		},
+		Nodes: []enigmaSubNode{},
+	}
+	if rules := getSetting("app_routing_rules"); json.Valid([]byte(rules)) {
+		sub.Routing = json.RawMessage(rules)
+	}
+
+	nodeIndex := make(map[int]int)
+	for _, p := range proxies {
+		if p.Placeholder {
+			sub.Notices = append(sub.Notices, p.Remark)
+			continue
+		}
+		i, ok := nodeIndex[p.NodeID]
+		if !ok {
+			i = len(sub.Nodes)
+			nodeIndex[p.NodeID] = i
+			sub.Nodes = append(sub.Nodes, enigmaSubNode{ID: p.NodeID, Name: p.NodeName})
+		}
+		sub.Nodes[i].Endpoints = append(sub.Nodes[i].Endpoints, enigmaSubEndpoint{
+			Tag: p.Tag, Remark: p.Remark, Protocol: p.Protocol, Address: p.Address, Port: p.Port,
+			Credential: p.ID, Flow: p.Flow, Network: p.Network, Security: p.Security,
+			SNI: p.SNI, Fingerprint: p.Fingerprint, ALPN: p.ALPN, PublicKey: p.PublicKey, ShortID: p.ShortID,
+			Path: p.Path, Host: p.Host, ServiceName: p.ServiceName, HeaderType: p.HeaderType,
+			Mode: p.Mode, Extra: p.Extra, Method: p.Method, LocalAddr: p.LocalAddr, MTU: p.MTU,
+			Link: generateLink(p),
+		})
+	}
+	return sub
+}
+
+// renderEnigmaSub seals the structured subscription with a key bound to the
+// requesting device (X-Hwid), so a captured response is useless elsewhere.
+// The device must have registered over the secure API first.
+func renderEnigmaSub(w http.ResponseWriter, r *http.Request, u subUser, proxies []Proxy) {
+	hwid := r.Header.Get("X-Hwid")
+	if hwid == "" {
+		http.Error(w, "Device ID Required", 400)
+		return
+	}
+
+	// The key derives from the device's own long-term key. Anything else the
+	// server could use (the shared key, the hardware ID) is known to whoever
+	// captures the response, so unregistered devices get nothing.
+	var encoded string
+	db.DB.QueryRow(`
+		SELECT IFNULL(d.enigma_key, '') FROM devices d
+		JOIN user_devices ud ON d.id = ud.device_id
+		WHERE d.hardware_id=? AND ud.user_uuid=?
+	`, hwid, u.UUID).Scan(&encoded)
+	deviceKey, err := base64.StdEncoding.DecodeString(secrets.OpenOrEmpty(encoded))
+	if err != nil || len(deviceKey) == 0 {
+		http.Error(w, "Device not registered", 403)
+		return
+	}
+
+	key, err := enigma.DeriveKey(deviceKey, "subscription", hwid)
+	if err != nil {
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+	body, _ := json.Marshal(buildEnigmaSub(u, proxies))
+	sealed, err := enigma.Seal(body, key)
+	if err != nil {
+		log.Println("Enigma Sub Error:", err)
+		http.Error(w, "Encryption failed", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(sealed))
+}
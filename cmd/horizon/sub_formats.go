@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// Subscription output formats
+const (
+	SubFormatLinks   = "links"   // Base64 list of share links (v2ray standard)
+	SubFormatClash   = "clash"   // Clash / Clash Meta / Mihomo YAML
+	SubFormatSingbox = "singbox" // sing-box JSON config
+	SubFormatXray    = "xray"    // Array of full Xray JSON configs
+	SubFormatHTML    = "html"    // Human-readable page for browsers
+	SubFormatEnigma  = "enigma"  // Sealed structured config for the Aether app
+)
+
+// User-Agent fragments (lowercase) that identify client families
+var subClientAgents = []struct {
+	Fragment string
+	Format   string
+}{
+	{"clash", SubFormatClash}, // clash, clash-verge, clashx, clash.meta
+	{"mihomo", SubFormatClash},
+	{"stash", SubFormatClash},
+	{"sing-box", SubFormatSingbox},
+	{"sfa/", SubFormatSingbox},
+	{"sfi/", SubFormatSingbox},
+	{"sfm/", SubFormatSingbox},
+	{"sft/", SubFormatSingbox},
+	{"aether/", SubFormatEnigma},
+}
+
+// detectSubFormat honours ?format= and otherwise guesses from the User-Agent.
+func detectSubFormat(r *http.Request) string {
+	switch f := strings.ToLower(r.URL.Query().Get("format")); f {
+	case SubFormatLinks, SubFormatClash, SubFormatSingbox, SubFormatXray, SubFormatHTML, SubFormatEnigma:
+		return f
+	case "base64", "v2ray":
+		return SubFormatLinks
+	case "sing-box":
+		return SubFormatSingbox
+	case "mihomo", "clash-meta":
+		return SubFormatClash
+	}
+
+	ua := strings.ToLower(r.UserAgent())
+	for _, c := range subClientAgents {
+		if strings.Contains(ua, c.Fragment) {
+			return c.Format
+		}
+	}
+
+	// Proxy clients don't ask for HTML; browsers always do
+	if strings.HasPrefix(ua, "mozilla/") && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return SubFormatHTML
+	}
+	return SubFormatLinks
+}
+
+func writeSubscription(w http.ResponseWriter, format string, proxies []Proxy) {
+	switch format {
+	case SubFormatClash:
+		body, err := renderClash(proxies)
+		if err != nil {
+			http.Error(w, "Render Error", 500)
+			return
+		}
+		w.Header().Set("Content-Type", "text/yaml; charset=utf-8")
+		w.Write(body)
+
+	case SubFormatSingbox:
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(renderSingbox(proxies))
+
+	case SubFormatXray:
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(renderXray(proxies))
+
+	default:
+		var links []string
+		for _, p := range proxies {
+			if link := generateLink(p); link != "" {
+				links = append(links, link)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+		// Base64 encode for v2ray subscription standard
+		encoded := base64.StdEncoding.EncodeToString([]byte(strings.Join(links, "\n")))
+		w.Write([]byte(encoded))
+	}
+}
+
+// uniqueRemarks returns one name per proxy; Clash and sing-box reject duplicates.
+func uniqueRemarks(proxies []Proxy) []string {
+	seen := make(map[string]int)
+	names := make([]string, len(proxies))
+	for i, p := range proxies {
+		seen[p.Remark]++
+		names[i] = p.Remark
+		if n := seen[p.Remark]; n > 1 {
+			names[i] = fmt.Sprintf("%s (%d)", p.Remark, n)
+		}
+	}
+	return names
+}
+
+// supportedProxies keeps the proxies whose transport the target client knows.
+func supportedProxies(proxies []Proxy, networks map[string]bool) []Proxy {
+	var out []Proxy
+	for _, p := range proxies {
+		if networks[p.Network] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// ========== CLASH / MIHOMO ==========
+
+var clashNetworks = map[string]bool{"tcp": true, "ws": true, "grpc": true, "httpupgrade": true, "udp": true}
+
+func clashProxy(p Proxy, name string) map[string]interface{} {
+	switch p.Protocol {
+	case "shadowsocks":
+		return map[string]interface{}{
+			"name": name, "type": "ss", "server": p.Address, "port": p.Port,
+			"cipher": p.Method, "password": p.ID, "udp": true,
+		}
+	case "wireguard":
+		return map[string]interface{}{
+			"name": name, "type": "wireguard", "server": p.Address, "port": p.Port,
+			"ip":          strings.TrimSuffix(p.LocalAddr, "/32"),
+			"private-key": p.ID, "public-key": p.PublicKey, "mtu": p.MTU, "udp": true,
+		}
+	}
+
+	c := map[string]interface{}{
+		"name":    name,
+		"type":    p.Protocol,
+		"server":  p.Address,
+		"port":    p.Port,
+		"udp":     true,
+		"network": p.Network,
+	}
+
+	switch p.Protocol {
+	case "vless":
+		c["uuid"] = p.ID
+		if p.Flow != "" {
+			c["flow"] = p.Flow
+		}
+	case "vmess":
+		c["uuid"] = p.ID
+		c["alterId"] = 0
+		c["cipher"] = "auto"
+	case "trojan":
+		c["password"] = p.ID
+	}
+
+	if p.Security == "tls" || p.Security == "reality" {
+		if p.Protocol == "trojan" {
+			c["sni"] = p.SNI
+		} else {
+			c["tls"] = true
+			c["servername"] = p.SNI
+		}
+		if p.Fingerprint != "" {
+			c["client-fingerprint"] = p.Fingerprint
+		}
+		if p.ALPN != "" {
+			c["alpn"] = strings.Split(p.ALPN, ",")
+		}
+		if p.Security == "reality" {
+			c["reality-opts"] = map[string]interface{}{
+				"public-key": p.PublicKey,
+				"short-id":   p.ShortID,
+			}
+		}
+	}
+
+	switch p.Network {
+	case "ws":
+		opts := map[string]interface{}{"path": p.Path}
+		if p.Host != "" {
+			opts["headers"] = map[string]string{"Host": p.Host}
+		}
+		c["ws-opts"] = opts
+	case "httpupgrade":
+		opts := map[string]interface{}{"path": p.Path, "v2ray-http-upgrade": true}
+		if p.Host != "" {
+			opts["headers"] = map[string]string{"Host": p.Host}
+		}
+		c["network"] = "ws"
+		c["ws-opts"] = opts
+	case "grpc":
+		c["grpc-opts"] = map[string]interface{}{"grpc-service-name": p.ServiceName}
+	case "tcp":
+		if p.HeaderType == "http" {
+			c["network"] = "http"
+			c["http-opts"] = map[string]interface{}{"path": []string{"/"}}
+		}
+	}
+	return c
+}
+
+func renderClash(proxies []Proxy) ([]byte, error) {
+	proxies = supportedProxies(proxies, clashNetworks)
+	names := uniqueRemarks(proxies)
+	var list []interface{}
+	for i, p := range proxies {
+		list = append(list, clashProxy(p, names[i]))
+	}
+
+	config := map[string]interface{}{
+		"mixed-port": 7890,
+		"allow-lan":  false,
+		"mode":       "rule",
+		"log-level":  "info",
+		"proxies":    list,
+		"proxy-groups": []interface{}{
+			map[string]interface{}{
+				"name":    "Proxy",
+				"type":    "select",
+				"proxies": append([]string{"Auto"}, names...),
+			},
+			map[string]interface{}{
+				"name":     "Auto",
+				"type":     "url-test",
+				"url":      "https://www.gstatic.com/generate_204",
+				"interval": 300,
+				"proxies":  names,
+			},
+		},
+		"rules": []string{"MATCH,Proxy"},
+	}
+	return yaml.Marshal(config)
+}
+
+// ========== SING-BOX ==========
+
+var singboxNetworks = map[string]bool{"tcp": true, "ws": true, "grpc": true, "httpupgrade": true, "udp": true}
+
+func singboxOutbound(p Proxy, tag string) map[string]interface{} {
+	switch p.Protocol {
+	case "shadowsocks":
+		return map[string]interface{}{
+			"type": "shadowsocks", "tag": tag, "server": p.Address, "server_port": p.Port,
+			"method": p.Method, "password": p.ID,
+		}
+	case "wireguard":
+		return map[string]interface{}{
+			"type": "wireguard", "tag": tag, "server": p.Address, "server_port": p.Port,
+			"local_address": []string{p.LocalAddr},
+			"private_key":   p.ID, "peer_public_key": p.PublicKey, "mtu": p.MTU,
+		}
+	}
+
+	o := map[string]interface{}{
+		"type":        p.Protocol,
+		"tag":         tag,
+		"server":      p.Address,
+		"server_port": p.Port,
+	}
+
+	switch p.Protocol {
+	case "vless":
+		o["uuid"] = p.ID
+		if p.Flow != "" {
+			o["flow"] = p.Flow
+		}
+	case "vmess":
+		o["uuid"] = p.ID
+		o["security"] = "auto"
+		o["alter_id"] = 0
+	case "trojan":
+		o["password"] = p.ID
+	}
+
+	switch p.Network {
+	case "ws":
+		t := map[string]interface{}{"type": "ws", "path": p.Path}
+		if p.Host != "" {
+			t["headers"] = map[string]string{"Host": p.Host}
+		}
+		o["transport"] = t
+	case "grpc":
+		o["transport"] = map[string]interface{}{"type": "grpc", "service_name": p.ServiceName}
+	case "httpupgrade":
+		t := map[string]interface{}{"type": "httpupgrade", "path": p.Path}
+		if p.Host != "" {
+			t["host"] = p.Host
+		}
+		o["transport"] = t
+	case "tcp":
+		if p.HeaderType == "http" {
+			o["transport"] = map[string]interface{}{"type": "http"}
+		}
+	}
+
+	if p.Security == "tls" || p.Security == "reality" {
+		tls := map[string]interface{}{
+			"enabled":     true,
+			"server_name": p.SNI,
+		}
+		if p.Fingerprint != "" {
+			tls["utls"] = map[string]interface{}{"enabled": true, "fingerprint": p.Fingerprint}
+		}
+		if p.ALPN != "" {
+			tls["alpn"] = strings.Split(p.ALPN, ",")
+		}
+		if p.Security == "reality" {
+			tls["reality"] = map[string]interface{}{
+				"enabled":    true,
+				"public_key": p.PublicKey,
+				"short_id":   p.ShortID,
+			}
+		}
+		o["tls"] = tls
+	}
+	return o
+}
+
+func renderSingbox(proxies []Proxy) map[string]interface{} {
+	proxies = supportedProxies(proxies, singboxNetworks)
+	names := uniqueRemarks(proxies)
+	outbounds := []interface{}{
+		map[string]interface{}{
+			"type":      "selector",
+			"tag":       "Proxy",
+			"outbounds": append([]string{"Auto"}, names...),
+			"default":   "Auto",
+		},
+		map[string]interface{}{
+			"type":      "urltest",
+			"tag":       "Auto",
+			"outbounds": names,
+			"url":       "https://www.gstatic.com/generate_204",
+			"interval":  "5m",
+		},
+	}
+	for i, p := range proxies {
+		outbounds = append(outbounds, singboxOutbound(p, names[i]))
+	}
+	outbounds = append(outbounds, map[string]interface{}{"type": "direct", "tag": "direct"})
+
+	return map[string]interface{}{
+		"log": map[string]interface{}{"level": "warn"},
+		"inbounds": []interface{}{
+			map[string]interface{}{
+				"type":         "tun",
+				"tag":          "tun-in",
+				"address":      []string{"172.19.0.1/30"},
+				"auto_route":   true,
+				"strict_route": true,
+			},
+			map[string]interface{}{
+				"type":        "mixed",
+				"tag":         "mixed-in",
+				"listen":      "127.0.0.1",
+				"listen_port": 2080,
+			},
+		},
+		"outbounds": outbounds,
+		"route": map[string]interface{}{
+			"auto_detect_interface": true,
+			"final":                 "Proxy",
+		},
+	}
+}
+
+// ========== XRAY JSON ==========
+
+func xrayOutbound(p Proxy) map[string]interface{} {
+	o := map[string]interface{}{
+		"tag":      "proxy",
+		"protocol": p.Protocol,
+	}
+
+	switch p.Protocol {
+	case "vless":
+		user := map[string]interface{}{"id": p.ID, "encryption": "none"}
+		if p.Flow != "" {
+			user["flow"] = p.Flow
+		}
+		o["settings"] = map[string]interface{}{
+			"vnext": []interface{}{map[string]interface{}{
+				"address": p.Address, "port": p.Port, "users": []interface{}{user},
+			}},
+		}
+	case "vmess":
+		o["settings"] = map[string]interface{}{
+			"vnext": []interface{}{map[string]interface{}{
+				"address": p.Address, "port": p.Port,
+				"users": []interface{}{map[string]interface{}{"id": p.ID, "alterId": 0, "security": "auto"}},
+			}},
+		}
+	case "trojan":
+		o["settings"] = map[string]interface{}{
+			"servers": []interface{}{map[string]interface{}{
+				"address": p.Address, "port": p.Port, "password": p.ID,
+			}},
+		}
+	case "shadowsocks":
+		o["settings"] = map[string]interface{}{
+			"servers": []interface{}{map[string]interface{}{
+				"address": p.Address, "port": p.Port, "method": p.Method, "password": p.ID,
+			}},
+		}
+	case "wireguard":
+		o["settings"] = map[string]interface{}{
+			"secretKey": p.ID,
+			"address":   []string{p.LocalAddr},
+			"peers": []interface{}{map[string]interface{}{
+				"endpoint": net.JoinHostPort(p.Address, strconv.Itoa(p.Port)), "publicKey": p.PublicKey,
+			}},
+			"mtu": p.MTU,
+		}
+		return o // No stream settings
+	}
+
+	stream := map[string]interface{}{
+		"network":  p.Network,
+		"security": p.Security,
+	}
+	switch p.Security {
+	case "tls":
+		tls := map[string]interface{}{"serverName": p.SNI}
+		if p.Fingerprint != "" {
+			tls["fingerprint"] = p.Fingerprint
+		}
+		if p.ALPN != "" {
+			tls["alpn"] = strings.Split(p.ALPN, ",")
+		}
+		stream["tlsSettings"] = tls
+	case "reality":
+		stream["realitySettings"] = map[string]interface{}{
+			"serverName":  p.SNI,
+			"publicKey":   p.PublicKey,
+			"shortId":     p.ShortID,
+			"fingerprint": p.Fingerprint,
+		}
+	}
+	switch p.Network {
+	case "ws":
+		ws := map[string]interface{}{"path": p.Path}
+		if p.Host != "" {
+			ws["headers"] = map[string]string{"Host": p.Host}
+		}
+		stream["wsSettings"] = ws
+	case "grpc":
+		stream["grpcSettings"] = map[string]interface{}{"serviceName": p.ServiceName}
+	case "xhttp":
+		xhttp := map[string]interface{}{"path": p.Path, "host": p.Host, "mode": p.Mode}
+		if p.Extra != "" {
+			xhttp["extra"] = json.RawMessage(p.Extra)
+		}
+		stream["xhttpSettings"] = xhttp
+	case "httpupgrade":
+		stream["httpupgradeSettings"] = map[string]interface{}{"path": p.Path, "host": p.Host}
+	case "tcp":
+		if p.HeaderType == "http" {
+			stream["tcpSettings"] = map[string]interface{}{"header": map[string]interface{}{"type": "http"}}
+		}
+	}
+	o["streamSettings"] = stream
+	return o
+}
+
+// renderXray returns one complete client config per proxy, the format
+// v2rayN / v2rayNG import as "custom config" subscriptions.
+func renderXray(proxies []Proxy) []interface{} {
+	configs := []interface{}{}
+	for _, p := range proxies {
+		configs = append(configs, map[string]interface{}{
+			"remarks": p.Remark,
+			"log":     map[string]interface{}{"loglevel": "warning"},
+			"inbounds": []interface{}{
+				map[string]interface{}{
+					"tag": "socks", "port": 10808, "listen": "127.0.0.1", "protocol": "socks",
+					"settings": map[string]interface{}{"auth": "noauth", "udp": true},
+					"sniffing": map[string]interface{}{"enabled": true, "destOverride": []string{"http", "tls"}},
+				},
+				map[string]interface{}{
+					"tag": "http", "port": 10809, "listen": "127.0.0.1", "protocol": "http",
+				},
+			},
+			"outbounds": []interface{}{
+				xrayOutbound(p),
+				map[string]interface{}{"tag": "direct", "protocol": "freedom"},
+				map[string]interface{}{"tag": "block", "protocol": "blackhole"},
+			},
+		})
+	}
+	return configs
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"embed"
+	"encoding/base64"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/skip2/go-qrcode"
+)
+
+//go:embed templates/sub_page.html
+var subPageFS embed.FS
+
+var subPageTemplate = template.Must(template.ParseFS(subPageFS, "templates/sub_page.html"))
+
+type subPageLink struct {
+	Remark string
+	Link   string
+	QR     template.URL
+}
+
+type subPageDeepLink struct {
+	Name string
+	URL  template.URL // Custom schemes need template.URL to survive escaping
+}
+
+// subPageDeepLinks returns one-tap import links for common clients.
+func subPageDeepLinks(subURL, title string) []subPageDeepLink {
+	enc := url.QueryEscape(subURL)
+	return []subPageDeepLink{
+		{"v2rayNG", template.URL("v2rayng://install-config?url=" + enc)},
+		{"Hiddify", template.URL("hiddify://import/" + subURL + "#" + url.PathEscape(title))},
+		{"Streisand", template.URL("streisand://import/" + subURL)},
+		{"v2RayTun", template.URL("v2raytun://import/" + subURL)},
+		{"sing-box", template.URL("sing-box://import-remote-profile?url=" + enc + "#" + url.PathEscape(title))},
+		{"Clash / Mihomo", template.URL("clash://install-config?url=" + enc)},
+		{"Shadowrocket", template.URL("sub://" + base64.URLEncoding.EncodeToString([]byte(subURL)))},
+	}
+}
+
+// qrDataURI renders content as an inline PNG QR code.
+func qrDataURI(content string) template.URL {
+	png, err := qrcode.Encode(content, qrcode.Medium, 256)
+	if err != nil {
+		return ""
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+}
+
+// renderSubPage serves the browser view of a subscription, built from the
+// same proxies as the machine-readable formats.
+func renderSubPage(w http.ResponseWriter, r *http.Request, u subUser, proxies []Proxy) {
+	title := getSetting("sub_profile_title")
+	subURL := publicBaseURL(r) + r.URL.Path
+	if token := r.URL.Query().Get("token"); token != "" {
+		subURL += "?token=" + url.QueryEscape(token)
+	} else if uuid := r.URL.Query().Get("uuid"); uuid != "" {
+		subURL += "?uuid=" + url.QueryEscape(uuid)
+	}
+
+	vars := remarkVars(u)
+	used := u.Upload + u.Download
+	percent := 0
+	if u.Limit > 0 {
+		percent = int(min(used*100/u.Limit, 100))
+	}
+
+	var notices []string
+	var links []subPageLink
+	for _, p := range proxies {
+		if p.Placeholder {
+			notices = append(notices, p.Remark)
+			continue
+		}
+		link := generateLink(p)
+		if link == "" {
+			continue
+		}
+		links = append(links, subPageLink{Remark: p.Remark, Link: link, QR: qrDataURI(link)})
+	}
+
+	data := map[string]interface{}{
+		"Title":      title,
+		"Username":   u.Name,
+		"Status":     u.subStatus(),
+		"Used":       formatBytes(used),
+		"Limit":      vars["{DATA_LIMIT}"],
+		"Left":       vars["{DATA_LEFT}"],
+		"Percent":    percent,
+		"Unlimited":  u.Limit == 0,
+		"ExpireDate": vars["{EXPIRE_DATE}"],
+		"DaysLeft":   vars["{DAYS_LEFT}"],
+		"SubURL":     subURL,
+		"SubQR":      qrDataURI(subURL),
+		"DeepLinks":  subPageDeepLinks(subURL, title),
+		"Notices":    notices,
+		"Links":      links,
+		"SupportURL": getSetting("sub_support_url"),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := subPageTemplate.Execute(w, data); err != nil {
+		log.Println("Sub Page Error:", err)
+	}
+}
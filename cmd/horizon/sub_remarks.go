@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// subUser is the account state a subscription is rendered for.
+type subUser struct {
+	UUID     string
+	Name     string
+	Status   string
+	Expiry   int64
+	Limit    int64 // Bytes, 0 = unlimited
+	Upload   int64
+	Download int64
+
+	TrojanPassword string // Imported from another panel, see credentials.go
+	SSPassword     string
+}
+
+// subStatus folds expiry into the stored status: active, limited, expired
+// or disabled (anything else the admin set).
+func (u subUser) subStatus() string {
+	if u.Expiry > 0 && u.Expiry < time.Now().Unix() {
+		return "expired"
+	}
+	switch u.Status {
+	case "active", "limited":
+		return u.Status
+	}
+	return "disabled"
+}
+
+// formatBytes renders a byte count the way clients show traffic, e.g. "12.50 GB".
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	v := float64(n)
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.2f %s", v, units[i])
+}
+
+// remarkVars returns the user-level template variables. {NODE}, {TAG},
+// {PROTOCOL} and {TRANSPORT} are added per proxy.
+func remarkVars(u subUser) map[string]string {
+	used := u.Upload + u.Download
+	vars := map[string]string{
+		"{USERNAME}":    u.Name,
+		"{STATUS}":      u.subStatus(),
+		"{DATA_USED}":   formatBytes(used),
+		"{DATA_LIMIT}":  "∞",
+		"{DATA_LEFT}":   "∞",
+		"{DAYS_LEFT}":   "∞",
+		"{EXPIRE_DATE}": "∞",
+	}
+	if u.Limit > 0 {
+		vars["{DATA_LIMIT}"] = formatBytes(u.Limit)
+		vars["{DATA_LEFT}"] = formatBytes(max(u.Limit-used, 0))
+	}
+	if u.Expiry > 0 {
+		days := math.Ceil(time.Until(time.Unix(u.Expiry, 0)).Hours() / 24)
+		vars["{DAYS_LEFT}"] = fmt.Sprintf("%d", int64(max(days, 0)))
+		vars["{EXPIRE_DATE}"] = time.Unix(u.Expiry, 0).UTC().Format("2006-01-02")
+	}
+	return vars
+}
+
+// expandRemark substitutes template variables; unknown ones are left as is.
+func expandRemark(tmpl string, vars map[string]string) string {
+	pairs := make([]string, 0, len(vars)*2)
+	for k, v := range vars {
+		pairs = append(pairs, k, v)
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
+
+// placeholderProxies builds unusable entries whose only purpose is their
+// name: traffic/days info on top of a subscription, or the reason it stopped
+// working. One entry per non-empty line of the setting.
+func placeholderProxies(settingKey string, vars map[string]string) []Proxy {
+	var proxies []Proxy
+	for _, line := range strings.Split(getSetting(settingKey), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		proxies = append(proxies, Proxy{
+			Remark:      expandRemark(line, vars),
+			Protocol:    "vless",
+			Address:     "0.0.0.0",
+			Port:        1,
+			ID:          "00000000-0000-0000-0000-000000000000",
+			Network:     "tcp",
+			Security:    "none",
+			Placeholder: true,
+		})
+	}
+	return proxies
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"aether/internal/horizon/db"
+)
+
+// Subscription tokens are opaque, HMAC-signed handles that stand in for the
+// proxy UUID in /sub links: base64url(id[12] | expires_at[8] | mac[16]).
+// The id is stored in subscription_tokens so a token can be revoked without
+// touching the user's proxy credential.
+
+const (
+	subTokenIDLen  = 12
+	subTokenMACLen = 16
+)
+
+var (
+	errSubTokenInvalid = errors.New("invalid subscription token")
+	errSubTokenExpired = errors.New("subscription token expired")
+	errSubTokenRevoked = errors.New("subscription token revoked")
+)
+
+func subTokenMAC(payload []byte) []byte {
+	mac := hmac.New(sha256.New, getSecret("sub_token_secret"))
+	mac.Write(payload)
+	return mac.Sum(nil)[:subTokenMACLen]
+}
+
+// encodeSubToken builds the token string for a stored token id.
+func encodeSubToken(id []byte, expiresAt int64) string {
+	payload := make([]byte, subTokenIDLen+8)
+	copy(payload, id)
+	binary.BigEndian.PutUint64(payload[subTokenIDLen:], uint64(expiresAt))
+	return base64.RawURLEncoding.EncodeToString(append(payload, subTokenMAC(payload)...))
+}
+
+// issueSubToken revokes the user's current tokens and issues a new one.
+// expiresAt of 0 means the token never expires.
+func issueSubToken(uuid string, expiresAt int64) (string, error) {
+	id := make([]byte, subTokenIDLen)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().Unix()
+	if _, err := tx.Exec("UPDATE subscription_tokens SET revoked_at=? WHERE user_uuid=? AND revoked_at=0", now, uuid); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO subscription_tokens (token_id, user_uuid, created_at, expires_at) VALUES (?, ?, ?, ?)",
+		hex.EncodeToString(id), uuid, now, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return encodeSubToken(id, expiresAt), nil
+}
+
+// userSubToken returns the user's active token, issuing one if there is none.
+func userSubToken(uuid string) (string, int64, error) {
+	var idHex string
+	var expiresAt int64
+	err := db.DB.QueryRow(`
+		SELECT token_id, expires_at FROM subscription_tokens
+		WHERE user_uuid=? AND revoked_at=0 AND (expires_at=0 OR expires_at > ?)
+		ORDER BY created_at DESC LIMIT 1
+	`, uuid, time.Now().Unix()).Scan(&idHex, &expiresAt)
+	if err == sql.ErrNoRows {
+		token, err := issueSubToken(uuid, 0)
+		return token, 0, err
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	id, _ := hex.DecodeString(idHex)
+	return encodeSubToken(id, expiresAt), expiresAt, nil
+}
+
+// verifySubToken checks the signature and expiry, then resolves the owner.
+func verifySubToken(token string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != subTokenIDLen+8+subTokenMACLen {
+		return "", errSubTokenInvalid
+	}
+	payload, mac := raw[:subTokenIDLen+8], raw[subTokenIDLen+8:]
+	if !hmac.Equal(mac, subTokenMAC(payload)) {
+		return "", errSubTokenInvalid
+	}
+
+	expiresAt := int64(binary.BigEndian.Uint64(payload[subTokenIDLen:]))
+	if expiresAt > 0 && expiresAt < time.Now().Unix() {
+		return "", errSubTokenExpired
+	}
+
+	var uuid string
+	var revokedAt int64
+	err = db.DB.QueryRow("SELECT user_uuid, revoked_at FROM subscription_tokens WHERE token_id=?",
+		hex.EncodeToString(payload[:subTokenIDLen])).Scan(&uuid, &revokedAt)
+	if err != nil {
+		return "", errSubTokenInvalid
+	}
+	if revokedAt != 0 {
+		return "", errSubTokenRevoked
+	}
+	return uuid, nil
+}
+
+// resolveSubscriber identifies the user behind a /sub request: a token in the
+// path or ?token=, or (if sub_allow_uuid_links is on) a legacy link carrying
+// the UUID itself, as /sub/<uuid> or ?uuid=.
+func resolveSubscriber(r *http.Request) (string, int, string) {
+	legacy := r.URL.Query().Get("uuid")
+	token := r.PathValue("token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token != "" {
+		uuid, err := verifySubToken(token)
+		switch {
+		case err == nil:
+			return uuid, 200, ""
+		case err == errSubTokenExpired:
+			return "", 403, "Subscription link expired"
+		case err == errSubTokenInvalid && token == r.PathValue("token"):
+			legacy = token // Not a token at all; maybe /sub/<uuid>
+		default:
+			return "", 404, "Subscription not found"
+		}
+	}
+
+	if legacy != "" {
+		if getSetting("sub_allow_uuid_links") != "true" {
+			return "", 404, "Subscription not found"
+		}
+		return legacy, 200, ""
+	}
+	return "", 400, "Token Required"
+}
+
+// publicBaseURL is where clients reach the panel: sub_base_url, or the
+// scheme and host the request came in on.
+func publicBaseURL(r *http.Request) string {
+	if base := strings.TrimRight(getSetting("sub_base_url"), "/"); base != "" {
+		return base
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// subscriptionURL returns the public /sub link for a token.
+func subscriptionURL(r *http.Request, token string) string {
+	return publicBaseURL(r) + "/sub/" + token
+}
+
+// GET    /api/users/sub-token?uuid=   -> current token and link
+// POST   /api/users/sub-token          -> revoke and reissue {uuid, expires_at}
+// DELETE /api/users/sub-token?uuid=   -> revoke, the user has no working link
+func handleUserSubToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	uuid := r.URL.Query().Get("uuid")
+	var req struct {
+		UUID      string `json:"uuid"`
+		ExpiresAt int64  `json:"expires_at"`
+	}
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		uuid = req.UUID
+	}
+
+	var exists int
+	db.DB.QueryRow("SELECT COUNT(*) FROM users WHERE uuid=?", uuid).Scan(&exists)
+	if exists == 0 || !canManageUser(r, uuid) {
+		http.Error(w, "User not found", 404)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		token, expiresAt, err := userSubToken(uuid)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":            token,
+			"expires_at":       expiresAt,
+			"subscription_url": subscriptionURL(r, token),
+		})
+
+	case "POST":
+		token, err := issueSubToken(uuid, req.ExpiresAt)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":            token,
+			"expires_at":       req.ExpiresAt,
+			"subscription_url": subscriptionURL(r, token),
+		})
+
+	case "DELETE":
+		_, err := db.DB.Exec("UPDATE subscription_tokens SET revoked_at=? WHERE user_uuid=? AND revoked_at=0", time.Now().Unix(), uuid)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
@@ -6,18 +6,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
-	"time"
 
 	"aether/internal/horizon/db"
 )
 
 // XrayInbound represents the partial structure of an inbound config we care about
 type XrayInbound struct {
-	Tag            string `json:"tag"`
-	Port           int    `json:"port"`
-	Protocol       string `json:"protocol"`
+	Tag      string `json:"tag"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Settings struct {
+		Method    string `json:"method"`    // shadowsocks
+		Password  string `json:"password"`  // shadowsocks 2022 server key
+		SecretKey string `json:"secretKey"` // wireguard
+		MTU       int    `json:"mtu"`
+	} `json:"settings"`
 	StreamSettings struct {
 		Network     string `json:"network"`
 		Security    string `json:"security"`
@@ -41,45 +49,103 @@ type XrayInbound struct {
 		GrpcSettings struct {
 			ServiceName string `json:"serviceName"`
 		} `json:"grpcSettings"`
+		XhttpSettings struct {
+			Path  string          `json:"path"`
+			Host  string          `json:"host"`
+			Mode  string          `json:"mode"`
+			Extra json.RawMessage `json:"extra"`
+		} `json:"xhttpSettings"`
+		HttpupgradeSettings struct {
+			Path string `json:"path"`
+			Host string `json:"host"`
+		} `json:"httpupgradeSettings"`
 	} `json:"streamSettings"`
 }
 
 func handleSubscription(w http.ResponseWriter, r *http.Request) {
-	uuid := r.URL.Query().Get("uuid")
-	if uuid == "" {
-		// Try path param if query is empty (simple manual check, real router would handle this)
-		parts := strings.Split(r.URL.Path, "/")
-		if len(parts) > 0 {
-			uuid = parts[len(parts)-1]
-		}
-	}
-
-	if uuid == "" {
-		http.Error(w, "UUID Required", 400)
+	uuid, status, msg := resolveSubscriber(r)
+	if status != 200 {
+		http.Error(w, msg, status)
 		return
 	}
 
-	// 1. Validate User & Fetch Access Info
-	var u struct {
-		Name   string
-		Status string
-		Expiry int64
-	}
-	err := db.DB.QueryRow("SELECT name, status, expiry FROM users WHERE uuid=?", uuid).Scan(&u.Name, &u.Status, &u.Expiry)
+	// 1. Fetch Access Info
+	u, err := loadSubUser(uuid)
 	if err == sql.ErrNoRows {
 		http.Error(w, "User not found", 404)
 		return
 	}
-	if u.Status != "active" {
-		http.Error(w, "User is not active", 403)
+	if err != nil {
+		http.Error(w, "Internal Error", 500)
 		return
 	}
-	if u.Expiry > 0 && u.Expiry < time.Now().Unix() {
-		http.Error(w, "User expired", 403)
+
+	// 2. Collect Proxies from the user's groups, or explain why there are none
+	var proxies []Proxy
+	if remarks := subDeviceRemarks(r, u.UUID); remarks != "" {
+		proxies = placeholderProxies(remarks, remarkVars(u))
+	} else if proxies, err = subscriptionProxies(u); err != nil {
+		log.Println("Sub Error:", err)
+		http.Error(w, "Internal Error", 500)
+		return
+	}
+
+	// 3. Return Response
+	format := detectSubFormat(r)
+	switch format {
+	case SubFormatHTML:
+		renderSubPage(w, r, u, proxies)
+		return
+	case SubFormatEnigma:
+		renderEnigmaSub(w, r, u, proxies)
 		return
 	}
+	setSubscriptionHeaders(w, u.Upload, u.Download, u.Limit, u.Expiry)
+	writeSubscription(w, format, proxies)
+}
+
+// subscriptionProxies returns the entries every output format renders: the
+// user's proxies, or placeholder entries explaining why there are none.
+func subscriptionProxies(u subUser) ([]Proxy, error) {
+	vars := remarkVars(u)
+	switch u.subStatus() {
+	case "active":
+		proxies, err := collectProxies(u, vars)
+		if err != nil {
+			return nil, err
+		}
+		if getSetting("sub_show_info") == "true" {
+			proxies = append(placeholderProxies("sub_info_remarks", vars), proxies...)
+		}
+		return proxies, nil
+	case "limited":
+		return placeholderProxies("sub_limited_remarks", vars), nil
+	case "expired":
+		return placeholderProxies("sub_expired_remarks", vars), nil
+	}
+	return placeholderProxies("sub_disabled_remarks", vars), nil
+}
+
+// loadSubUser reads the account state a subscription is rendered from.
+func loadSubUser(uuid string) (subUser, error) {
+	u := subUser{UUID: uuid}
+	var limitGB float64
+	err := db.DB.QueryRow(`
+		SELECT name, status, expiry, limit_gb, upload_bytes, download_bytes, IFNULL(trojan_password, ''), IFNULL(ss_password, '')
+		FROM users WHERE uuid=?`, uuid).
+		Scan(&u.Name, &u.Status, &u.Expiry, &limitGB, &u.Upload, &u.Download, &u.TrojanPassword, &u.SSPassword)
+	u.Limit = int64(limitGB * 1024 * 1024 * 1024)
+	return u, err
+}
 
-	// 2. Get Allowed Inbound Tags via Groups
+// collectProxies returns every endpoint the user may connect to: the inbounds
+// allowed by their groups, on each active node those inbounds are deployed to.
+// Remarks are expanded from the host or panel template with vars.
+func collectProxies(u subUser, vars map[string]string) ([]Proxy, error) {
+	uuid := u.UUID
+	remarkTemplate := getSetting("sub_remark_template")
+
+	// 1. Get Allowed Inbound Tags via Groups
 	rows, err := db.DB.Query(`
 		SELECT DISTINCT gi.inbound_tag 
 		FROM user_groups ug
@@ -87,9 +153,7 @@ func handleSubscription(w http.ResponseWriter, r *http.Request) {
 		WHERE ug.user_uuid = ?
 	`, uuid)
 	if err != nil {
-		log.Println("Sub Error (Tags):", err)
-		http.Error(w, "Internal Error", 500)
-		return
+		return nil, fmt.Errorf("tags: %w", err)
 	}
 	defer rows.Close()
 
@@ -101,16 +165,14 @@ func handleSubscription(w http.ResponseWriter, r *http.Request) {
 	}
 	rows.Close()
 
-	// 3. Fetch Active Nodes
+	// 2. Fetch Active Nodes
 	nodeRows, err := db.DB.Query("SELECT id, name, ip FROM nodes WHERE status='active'")
 	if err != nil {
-		log.Println("Sub Error (Nodes):", err)
-		http.Error(w, "Internal Error", 500)
-		return
+		return nil, fmt.Errorf("nodes: %w", err)
 	}
 	defer nodeRows.Close()
 
-	var links []string
+	var proxies []Proxy
 
 	// Pre-fetch configs to avoid N+1 query spam inside node loop
 	// Map: NodeID -> []RawInbounds
@@ -122,20 +184,39 @@ func handleSubscription(w http.ResponseWriter, r *http.Request) {
 		JOIN core_configs ct ON nc.config_id = ct.id
 	`)
 	if err != nil {
-		log.Println("Sub Error (NodeConfigs):", err)
-		http.Error(w, "Internal Error", 500)
-		return
+		return nil, fmt.Errorf("node configs: %w", err)
 	}
 
 	for ncRows.Next() {
 		var nid int
 		var raw string
 		if err := ncRows.Scan(&nid, &raw); err == nil {
+			if raw, err = openInbounds(raw); err != nil {
+				ncRows.Close()
+				return nil, fmt.Errorf("node configs: %w", err)
+			}
 			nodeConfigs[nid] = append(nodeConfigs[nid], raw)
 		}
 	}
 	ncRows.Close()
 
+	hosts, err := loadHosts()
+	if err != nil {
+		return nil, fmt.Errorf("hosts: %w", err)
+	}
+	seen := make(map[Proxy]bool)
+	add := func(p Proxy, vars map[string]string) {
+		p.Remark = expandRemark(p.Remark, vars)
+
+		// The same host may be reachable through several nodes; list it once
+		key := p
+		key.Remark, key.NodeID, key.NodeName = "", 0, ""
+		if !seen[key] {
+			seen[key] = true
+			proxies = append(proxies, p)
+		}
+	}
+
 	for nodeRows.Next() {
 		var nid int
 		var nName, nIP string
@@ -153,109 +234,335 @@ func handleSubscription(w http.ResponseWriter, r *http.Request) {
 			}
 
 			for _, in := range inbounds {
-				if allowedTags[in.Tag] {
-					link := generateLink(uuid, u.Name, nIP, nName, in)
-					if link != "" {
-						links = append(links, link)
+				if !allowedTags[in.Tag] {
+					continue
+				}
+				p, ok := buildProxy(u, nIP, in)
+				if !ok {
+					continue
+				}
+				p.Remark = remarkTemplate
+				p.NodeID, p.NodeName, p.Tag = nid, nName, in.Tag
+				proxyVars := map[string]string{
+					"{NODE}":      nName,
+					"{TAG}":       in.Tag,
+					"{PROTOCOL}":  strings.ToUpper(p.Protocol),
+					"{TRANSPORT}": p.Network,
+				}
+				for k, v := range vars {
+					proxyVars[k] = v
+				}
+
+				// One entry per host; the node IP only when none are defined
+				matched := false
+				for _, h := range hosts[in.Tag] {
+					if h.NodeID == 0 || h.NodeID == nid {
+						add(applyHost(p, h), proxyVars)
+						matched = true
 					}
 				}
+				if !matched {
+					add(p, proxyVars)
+				}
 			}
 		}
 	}
 
-	// 4. Return Response
-	responseBody := strings.Join(links, "\n")
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Header().Set("Subscription-Userinfo", fmt.Sprintf("upload=0; download=0; total=%d; expire=%d", 0, u.Expiry)) // TODO: Real stats
+	return proxies, nil
+}
+
+// Proxy is one client-importable endpoint, normalized from an Xray inbound so
+// every subscription format renders from the same data.
+type Proxy struct {
+	Remark      string
+	Protocol    string // vless, vmess, trojan, shadowsocks, wireguard
+	Address     string
+	Port        int
+	ID          string // UUID; password for trojan/shadowsocks; private key for wireguard
+	Flow        string
+	Network     string // tcp, ws, grpc, xhttp, httpupgrade (udp for wireguard)
+	Security    string // none, tls, reality
+	SNI         string
+	Fingerprint string
+	ALPN        string // Comma separated
+	PublicKey   string // reality public key, or the wireguard server's public key
+	ShortID     string
+	Path        string
+	Host        string
+	ServiceName string
+	HeaderType  string
+	Mode        string // xhttp mode
+	Extra       string // xhttp extra (raw JSON)
+	Method      string // shadowsocks cipher
+	LocalAddr   string // wireguard tunnel address
+	MTU         int
+	Placeholder bool // Informational entry, not a usable server
 
-	// Base64 encode for v2ray subscription standard
-	encoded := base64.StdEncoding.EncodeToString([]byte(responseBody))
-	w.Write([]byte(encoded))
+	// Where the entry came from, for structured formats
+	NodeID   int
+	NodeName string
+	Tag      string
 }
 
-func generateLink(uuid, username, nodeIP, nodeName string, in XrayInbound) string {
-	ps := fmt.Sprintf("%s-%s-%s", "Horizon", nodeName, in.Tag)
+// buildProxy maps an inbound to the Proxy a user connects with.
+func buildProxy(u subUser, nodeIP string, in XrayInbound) (Proxy, bool) {
+	uuid := u.UUID
+	p := Proxy{
+		Protocol: in.Protocol,
+		Address:  nodeIP,
+		Port:     in.Port,
+		ID:       uuid,
+	}
 
 	switch in.Protocol {
-	case "vless":
-		// vless://uuid@ip:port?params#name
-		params := []string{
-			"type=" + in.StreamSettings.Network,
-			"security=" + in.StreamSettings.Security,
+	case "vless", "vmess":
+	case "trojan":
+		p.ID = trojanUserPassword(uuid, u.TrojanPassword)
+	case "shadowsocks":
+		p.Method = in.Settings.Method
+		if p.Method == "" {
+			return Proxy{}, false
 		}
-
-		if in.StreamSettings.Security == "reality" {
-			params = append(params, "pbk="+in.StreamSettings.RealitySettings.PublicKey)
-			params = append(params, "sni="+in.StreamSettings.RealitySettings.ServerName)
-			params = append(params, "fp=chrome")
-			// Side ID / ShortIds?
-			if len(in.StreamSettings.RealitySettings.ShortIds) > 0 {
-				params = append(params, "sid="+in.StreamSettings.RealitySettings.ShortIds[0])
+		p.ID = ssUserPassword(p.Method, uuid, u.SSPassword)
+		if isSS2022(p.Method) {
+			if in.Settings.Password == "" {
+				return Proxy{}, false
 			}
-			params = append(params, "flow=xtls-rprx-vision") // Default assumes vision for reality usually
-		} else if in.StreamSettings.Security == "tls" {
-			params = append(params, "sni="+in.StreamSettings.TlsSettings.ServerName)
+			p.ID = in.Settings.Password + ":" + p.ID // Multi-user 2022 is server key + user key
+		}
+		p.Network, p.Security = "tcp", "none"
+		return p, true
+	case "wireguard":
+		p.PublicKey = wgPublicKey(in.Settings.SecretKey)
+		p.LocalAddr = wgUserAddress(uuid)
+		if p.PublicKey == "" || p.LocalAddr == "" {
+			return Proxy{}, false
+		}
+		p.ID, _ = wgUserKeys(uuid)
+		p.MTU = in.Settings.MTU
+		if p.MTU == 0 {
+			p.MTU = 1420
 		}
+		p.Network, p.Security = "udp", "none"
+		return p, true
+	default:
+		return Proxy{}, false
+	}
 
-		if in.StreamSettings.Network == "ws" {
-			params = append(params, "path="+in.StreamSettings.WsSettings.Path)
-			if host, ok := in.StreamSettings.WsSettings.Headers["Host"]; ok {
-				params = append(params, "host="+host)
-			}
-		} else if in.StreamSettings.Network == "grpc" {
-			params = append(params, "serviceName="+in.StreamSettings.GrpcSettings.ServiceName)
-			params = append(params, "mode=gun")
-		} else if in.StreamSettings.Network == "tcp" {
-			if in.StreamSettings.TcpSettings.Header.Type == "http" {
-				params = append(params, "headerType=http")
-			}
+	ss := in.StreamSettings
+	p.Network = ss.Network
+	p.Security = ss.Security
+	if p.Network == "" {
+		p.Network = "tcp"
+	}
+	if p.Network == "splithttp" {
+		p.Network = "xhttp" // Old name for the same transport
+	}
+	if p.Security == "" {
+		p.Security = "none"
+	}
+
+	switch ss.Security {
+	case "reality":
+		p.SNI = ss.RealitySettings.ServerName
+		p.PublicKey = ss.RealitySettings.PublicKey
+		p.Fingerprint = "chrome"
+		if len(ss.RealitySettings.ShortIds) > 0 {
+			p.ShortID = ss.RealitySettings.ShortIds[0]
+		}
+		if in.Protocol == "vless" && p.Network == "tcp" {
+			p.Flow = "xtls-rprx-vision" // Default assumes vision for reality usually
+		}
+	case "tls":
+		p.SNI = ss.TlsSettings.ServerName
+	}
+
+	switch p.Network {
+	case "ws":
+		p.Path = ss.WsSettings.Path
+		p.Host = ss.WsSettings.Headers["Host"]
+	case "grpc":
+		p.ServiceName = ss.GrpcSettings.ServiceName
+	case "xhttp":
+		p.Path = ss.XhttpSettings.Path
+		p.Host = ss.XhttpSettings.Host
+		p.Mode = ss.XhttpSettings.Mode
+		if p.Mode == "" {
+			p.Mode = "auto"
+		}
+		if len(ss.XhttpSettings.Extra) > 0 && string(ss.XhttpSettings.Extra) != "null" {
+			p.Extra = string(ss.XhttpSettings.Extra)
+		}
+	case "httpupgrade":
+		p.Path = ss.HttpupgradeSettings.Path
+		p.Host = ss.HttpupgradeSettings.Host
+	case "tcp":
+		if ss.TcpSettings.Header.Type == "http" {
+			p.HeaderType = "http"
+		}
+	}
+	return p, true
+}
+
+// streamQuery holds the transport and security parameters shared by the
+// vless:// and trojan:// link formats.
+func streamQuery(p Proxy) url.Values {
+	q := url.Values{}
+	q.Set("type", p.Network)
+	q.Set("security", p.Security)
+
+	switch p.Security {
+	case "reality":
+		q.Set("pbk", p.PublicKey)
+		q.Set("sni", p.SNI)
+		q.Set("fp", p.Fingerprint)
+		if p.ShortID != "" {
+			q.Set("sid", p.ShortID)
+		}
+	case "tls":
+		if p.SNI != "" {
+			q.Set("sni", p.SNI)
+		}
+		if p.Fingerprint != "" {
+			q.Set("fp", p.Fingerprint)
 		}
+		if p.ALPN != "" {
+			q.Set("alpn", p.ALPN)
+		}
+	}
+	if p.Flow != "" {
+		q.Set("flow", p.Flow)
+	}
 
-		return fmt.Sprintf("vless://%s@%s:%d?%s#%s", uuid, nodeIP, in.Port, strings.Join(params, "&"), ps)
+	switch p.Network {
+	case "ws", "httpupgrade":
+		q.Set("path", p.Path)
+		if p.Host != "" {
+			q.Set("host", p.Host)
+		}
+	case "xhttp":
+		q.Set("path", p.Path)
+		if p.Host != "" {
+			q.Set("host", p.Host)
+		}
+		q.Set("mode", p.Mode)
+		if p.Extra != "" {
+			q.Set("extra", p.Extra)
+		}
+	case "grpc":
+		q.Set("serviceName", p.ServiceName)
+		q.Set("mode", "gun")
+	case "tcp":
+		if p.HeaderType != "" {
+			q.Set("headerType", p.HeaderType)
+		}
+	}
+	return q
+}
+
+// shareURL assembles scheme://userinfo@host:port?query#remark with every
+// part escaped; net.JoinHostPort brackets IPv6 addresses.
+func shareURL(scheme string, user *url.Userinfo, p Proxy, q url.Values) string {
+	u := url.URL{
+		Scheme:   scheme,
+		User:     user,
+		Host:     net.JoinHostPort(p.Address, strconv.Itoa(p.Port)),
+		Fragment: p.Remark,
+	}
+	if q != nil {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+func generateLink(p Proxy) string {
+	switch p.Protocol {
+	case "vless":
+		// vless://uuid@ip:port?params#name
+		q := streamQuery(p)
+		q.Set("encryption", "none")
+		return shareURL("vless", url.User(p.ID), p, q)
+
+	case "trojan":
+		// trojan://password@ip:port?security=tls&sni=...#name
+		return shareURL("trojan", url.User(p.ID), p, streamQuery(p))
+
+	case "shadowsocks":
+		// SIP002; SS2022 keys are percent-encoded instead of base64 (SIP022)
+		if isSS2022(p.Method) {
+			return shareURL("ss", url.UserPassword(p.Method, p.ID), p, nil)
+		}
+		userinfo := base64.RawURLEncoding.EncodeToString([]byte(p.Method + ":" + p.ID))
+		return shareURL("ss", url.User(userinfo), p, nil)
+
+	case "wireguard":
+		// wireguard://privatekey@ip:port?publickey=...&address=...#name
+		q := url.Values{}
+		q.Set("publickey", p.PublicKey)
+		q.Set("address", p.LocalAddr)
+		q.Set("mtu", strconv.Itoa(p.MTU))
+		return shareURL("wireguard", url.User(p.ID), p, q)
 
 	case "vmess":
 		// VMess JSON -> Base64
 		v := map[string]string{
 			"v":    "2",
-			"ps":   ps,
-			"add":  nodeIP,
-			"port": fmt.Sprintf("%d", in.Port),
-			"id":   uuid,
+			"ps":   p.Remark,
+			"add":  p.Address,
+			"port": fmt.Sprintf("%d", p.Port),
+			"id":   p.ID,
 			"aid":  "0",
 			"scy":  "auto",
-			"net":  in.StreamSettings.Network,
+			"net":  p.Network,
 			"type": "none",
-			"tls":  in.StreamSettings.Security,
+			"tls":  p.Security,
 		}
 
-		if in.StreamSettings.Network == "ws" {
-			v["path"] = in.StreamSettings.WsSettings.Path
-			if host, ok := in.StreamSettings.WsSettings.Headers["Host"]; ok {
-				v["host"] = host
+		switch p.Network {
+		case "ws", "httpupgrade":
+			v["path"] = p.Path
+			v["host"] = p.Host
+		case "xhttp":
+			v["path"] = p.Path
+			v["host"] = p.Host
+			v["type"] = p.Mode
+		case "grpc":
+			v["path"] = p.ServiceName
+			v["type"] = "gun"
+		case "tcp":
+			if p.HeaderType != "" {
+				v["type"] = p.HeaderType
 			}
-		} else if in.StreamSettings.Network == "grpc" {
-			v["path"] = in.StreamSettings.GrpcSettings.ServiceName
-			v["type"] = "gun" // specific map for vmess grpc?
 		}
 
-		if in.StreamSettings.Security == "tls" {
-			v["sni"] = in.StreamSettings.TlsSettings.ServerName
+		if p.Security == "tls" {
+			v["sni"] = p.SNI
+			v["fp"] = p.Fingerprint
+			v["alpn"] = p.ALPN
 		}
 
 		jsonBytes, _ := json.Marshal(v)
 		return "vmess://" + base64.StdEncoding.EncodeToString(jsonBytes)
-
-	case "trojan":
-		// trojan://password@ip:port?security=tls&sni=...#name
-		params := []string{
-			"type=" + in.StreamSettings.Network,
-			"security=" + in.StreamSettings.Security,
-		}
-		if in.StreamSettings.Security == "tls" {
-			params = append(params, "sni="+in.StreamSettings.TlsSettings.ServerName)
-		}
-		return fmt.Sprintf("trojan://%s@%s:%d?%s#%s", uuid, nodeIP, in.Port, strings.Join(params, "&"), ps)
 	}
 
 	return ""
 }
+
+// setSubscriptionHeaders writes the de-facto standard headers read by
+// v2rayNG, Hiddify, Streisand and similar clients. total=0 means unlimited.
+func setSubscriptionHeaders(w http.ResponseWriter, upload, download, total, expire int64) {
+	w.Header().Set("Subscription-Userinfo", fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", upload, download, total, expire))
+
+	if title := getSetting("sub_profile_title"); title != "" {
+		w.Header().Set("Profile-Title", "base64:"+base64.StdEncoding.EncodeToString([]byte(title)))
+	}
+	if interval := getSetting("sub_update_interval"); interval != "" {
+		w.Header().Set("Profile-Update-Interval", interval)
+	}
+	if supportURL := getSetting("sub_support_url"); supportURL != "" {
+		w.Header().Set("Support-Url", supportURL)
+	}
+	if webPageURL := getSetting("sub_web_page_url"); webPageURL != "" {
+		w.Header().Set("Profile-Web-Page-Url", webPageURL)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"aether/internal/horizon/db"
+)
+
+// API tokens for scripts and bots. An admin mints a named token with a set of
+// scopes and an optional expiry; the token is shown once and only its SHA-256
+// is stored. It is sent as "Authorization: Bearer hzn_..." and acts as the
+// admin who minted it, limited by both that admin's role and its scopes.
+//
+// Scopes are <resource>:read (GET) and <resource>:write (everything else);
+// write includes read. sub:render covers fetching a user's configs and
+// subscription link. Routes without a scope (tokens, admins, logout) need a
+// login session.
+
+const apiTokenPrefix = "hzn_"
+
+var apiScopes = map[string]bool{
+	"users:read": true, "users:write": true,
+	"nodes:read": true, "nodes:write": true,
+	"configs:read": true, "configs:write": true,
+	"groups:read": true, "groups:write": true,
+	"templates:read": true, "templates:write": true,
+	"devices:read": true, "devices:write": true,
+	"hosts:read": true, "hosts:write": true,
+	"settings:read": true, "settings:write": true,
+	"enigma:read": true, "enigma:write": true,
+	"stats:read": true,
+	"audit:read": true,
+	"sub:render": true,
+}
+
+// requiredScope returns the scope a token needs for r, or false if tokens
+// may not call it at all.
+func requiredScope(r *http.Request) (string, bool) {
+	p := r.URL.Path
+	access := "read"
+	if r.Method != "GET" {
+		access = "write"
+	}
+	switch {
+	case p == "/api/auth/me":
+		return "", true
+	case p == "/api/user/config" || (p == "/api/users/sub-token" && r.Method == "GET"):
+		return "sub:render", true
+	case p == "/api/users" || strings.HasPrefix(p, "/api/users/") || strings.HasPrefix(p, "/api/user/"):
+		return "users:" + access, true
+	case p == "/api/nodes" || strings.HasPrefix(p, "/api/nodes/"):
+		return "nodes:" + access, true
+	case p == "/api/configs":
+		return "configs:" + access, true
+	case p == "/api/groups":
+		return "groups:" + access, true
+	case p == "/api/user_templates":
+		return "templates:" + access, true
+	case p == "/api/devices":
+		return "devices:" + access, true
+	case p == "/api/hosts":
+		return "hosts:" + access, true
+	case p == "/api/settings":
+		return "settings:" + access, true
+	case strings.HasPrefix(p, "/api/enigma/"):
+		return "enigma:" + access, true
+	case (p == "/api/stats" || p == "/api/admin/stats") && r.Method == "GET":
+		return "stats:read", true
+	case p == "/api/audit" && r.Method == "GET":
+		return "audit:read", true
+	}
+	return "", false
+}
+
+// scopeAllows is the token check run by requireAdmin after roleAllows.
+func scopeAllows(scopes []string, r *http.Request) bool {
+	need, ok := requiredScope(r)
+	if !ok {
+		return false
+	}
+	if need == "" {
+		return true
+	}
+	for _, s := range scopes {
+		if s == need || (strings.HasSuffix(need, ":read") && s == strings.TrimSuffix(need, ":read")+":write") {
+			return true
+		}
+	}
+	return false
+}
+
+func adminFromAPIToken(token string, r *http.Request) (*Admin, error) {
+	a := &Admin{}
+	var scopes string
+	var lastUsed int64
+	now := time.Now().Unix()
+	err := db.DB.QueryRow(`
+		SELECT a.id, a.username, a.role, a.max_users, a.max_total_gb, a.created_at, a.last_login_at, a.totp_enabled,
+		       t.id, t.scopes, t.last_used_at
+		FROM api_tokens t
+		JOIN admins a ON t.admin_id = a.id
+		WHERE t.token_hash=? AND t.revoked_at = 0 AND (t.expires_at = 0 OR t.expires_at > ?) AND a.disabled = 0
+	`, hashToken(token), now).Scan(&a.ID, &a.Username, &a.Role, &a.MaxUsers, &a.MaxTotalGB, &a.CreatedAt, &a.LastLoginAt, &a.TOTPEnabled,
+		&a.TokenID, &scopes, &lastUsed)
+	if err != nil {
+		return nil, err
+	}
+	a.Scopes = strings.Fields(scopes)
+
+	// A minute is fine-grained enough and spares a write per request
+	if now-lastUsed >= 60 {
+		db.DB.Exec("UPDATE api_tokens SET last_used_at=?, last_used_ip=? WHERE id=?", now, auditIP(r), a.TokenID)
+	}
+	return a, nil
+}
+
+type apiToken struct {
+	ID            int      `json:"id"`
+	AdminID       int      `json:"admin_id"`
+	AdminUsername string   `json:"admin_username"`
+	Name          string   `json:"name"`
+	Prefix        string   `json:"prefix"`
+	Scopes        []string `json:"scopes"`
+	CreatedAt     int64    `json:"created_at"`
+	ExpiresAt     int64    `json:"expires_at"`
+	LastUsedAt    int64    `json:"last_used_at"`
+	LastUsedIP    string   `json:"last_used_ip"`
+	RevokedAt     int64    `json:"revoked_at"`
+}
+
+// GET    /api/tokens - your tokens (owners see everyone's)
+// POST   /api/tokens - {"name", "scopes": [...], "expires_at": unix (0 = never)}
+// DELETE /api/tokens?id= - revoke
+func handleAPITokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	actor := currentAdmin(r)
+
+	switch r.Method {
+	case "GET":
+		query := `
+			SELECT t.id, t.admin_id, IFNULL(a.username, ''), t.name, t.prefix, t.scopes, t.created_at,
+			       t.expires_at, t.last_used_at, t.last_used_ip, t.revoked_at
+			FROM api_tokens t LEFT JOIN admins a ON t.admin_id = a.id`
+		var args []interface{}
+		if actor.Role != roleOwner {
+			query += " WHERE t.admin_id = ?"
+			args = append(args, actor.ID)
+		}
+		rows, err := db.DB.Query(query+" ORDER BY t.id DESC", args...)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		defer rows.Close()
+
+		list := []apiToken{}
+		for rows.Next() {
+			var t apiToken
+			var scopes string
+			if err := rows.Scan(&t.ID, &t.AdminID, &t.AdminUsername, &t.Name, &t.Prefix, &scopes, &t.CreatedAt,
+				&t.ExpiresAt, &t.LastUsedAt, &t.LastUsedIP, &t.RevokedAt); err != nil {
+				continue
+			}
+			t.Scopes = strings.Fields(scopes)
+			list = append(list, t)
+		}
+		json.NewEncoder(w).Encode(list)
+
+	case "POST":
+		var req struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			ExpiresAt int64    `json:"expires_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", 400)
+			return
+		}
+		if req.Name == "" || len(req.Scopes) == 0 {
+			http.Error(w, "name and scopes are required", 400)
+			return
+		}
+		for _, s := range req.Scopes {
+			if !apiScopes[s] {
+				http.Error(w, "Unknown scope: "+s, 400)
+				return
+			}
+		}
+		now := time.Now().Unix()
+		if req.ExpiresAt != 0 && req.ExpiresAt <= now {
+			http.Error(w, "expires_at must be in the future", 400)
+			return
+		}
+
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			http.Error(w, "Internal Error", 500)
+			return
+		}
+		token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+		res, err := db.DB.Exec(`
+			INSERT INTO api_tokens (admin_id, name, token_hash, prefix, scopes, created_at, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, actor.ID, req.Name, hashToken(token), token[:len(apiTokenPrefix)+6], strings.Join(req.Scopes, " "), now, req.ExpiresAt)
+		if err != nil {
+			http.Error(w, "Create Failed: "+err.Error(), 500)
+			return
+		}
+		id, _ := res.LastInsertId()
+		recordAudit(r, "token.create", "token", id, nil, auditRow("api_tokens", "id", id))
+		// The only time the token is ever shown
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "id": id, "token": token})
+
+	case "DELETE":
+		var id int
+		fmt.Sscan(r.URL.Query().Get("id"), &id)
+		var owner int
+		if err := db.DB.QueryRow("SELECT admin_id FROM api_tokens WHERE id=?", id).Scan(&owner); err == sql.ErrNoRows {
+			http.Error(w, "Token not found", 404)
+			return
+		}
+		if owner != actor.ID && actor.Role != roleOwner {
+			http.Error(w, "Token not found", 404)
+			return
+		}
+		before := auditRow("api_tokens", "id", id)
+		_, err := db.DB.Exec("UPDATE api_tokens SET revoked_at=? WHERE id=? AND revoked_at = 0", time.Now().Unix(), id)
+		if err != nil {
+			http.Error(w, "Revoke Failed", 500)
+			return
+		}
+		recordAudit(r, "token.revoke", "token", id, before, auditRow("api_tokens", "id", id))
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+
+	default:
+		http.Error(w, "Method not allowed", 405)
+	}
+}
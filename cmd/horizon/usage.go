@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"aether/internal/horizon/core"
+	"aether/internal/horizon/db"
+)
+
+type UsagePoint struct {
+	Time  int64 `json:"t"`
+	Bytes int64 `json:"bytes"`
+}
+
+// parseUsageRange reads from/to (unix seconds) and granularity from the query.
+// Defaults to the last 7 days; granularity is picked from the range if absent.
+func parseUsageRange(r *http.Request) (from, to int64, granularity string, ok bool) {
+	q := r.URL.Query()
+	to = time.Now().Unix()
+	if v := q.Get("to"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, 0, "", false
+		}
+		to = n
+	}
+	from = to - 7*24*3600
+	if v := q.Get("from"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return 0, 0, "", false
+		}
+		from = n
+	}
+	if from > to {
+		return 0, 0, "", false
+	}
+
+	granularity = q.Get("granularity")
+	switch granularity {
+	case core.GranularityHour, core.GranularityDay, core.GranularityMonth:
+	case "":
+		switch span := to - from; {
+		case span <= 2*24*3600:
+			granularity = core.GranularityHour
+		case span <= 90*24*3600:
+			granularity = core.GranularityDay
+		default:
+			granularity = core.GranularityMonth
+		}
+	default:
+		return 0, 0, "", false
+	}
+
+	// Include the bucket that contains `from`
+	from = core.BucketStart(granularity, time.Unix(from, 0)).Unix()
+	return from, to, granularity, true
+}
+
+func scanUsagePoints(rows *sql.Rows) ([]UsagePoint, int64) {
+	points := []UsagePoint{}
+	var total int64
+	for rows.Next() {
+		var p UsagePoint
+		rows.Scan(&p.Time, &p.Bytes)
+		total += p.Bytes
+		points = append(points, p)
+	}
+	return points, total
+}
+
+// GET /api/users/{uuid}/usage?from=&to=&granularity=hour|day|month
+// Also served read-only at /sub/{token}/usage for the user's own view.
+func handleUserUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	uuid := r.PathValue("uuid")
+	if r.PathValue("token") != "" {
+		var status int
+		var msg string
+		if uuid, status, msg = resolveSubscriber(r); status != 200 {
+			http.Error(w, msg, status)
+			return
+		}
+	}
+	var exists int
+	db.DB.QueryRow("SELECT COUNT(*) FROM users WHERE uuid=?", uuid).Scan(&exists)
+	if exists == 0 || !canManageUser(r, uuid) {
+		http.Error(w, "User not found", 404)
+		return
+	}
+
+	from, to, granularity, ok := parseUsageRange(r)
+	if !ok {
+		http.Error(w, "Invalid from/to/granularity", 400)
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT bucket, SUM(bytes) FROM usage_user_stats
+		WHERE user_uuid=? AND granularity=? AND bucket >= ? AND bucket <= ?
+		GROUP BY bucket ORDER BY bucket
+	`, uuid, granularity, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	points, total := scanUsagePoints(rows)
+	rows.Close()
+
+	resp := map[string]interface{}{
+		"uuid":        uuid,
+		"granularity": granularity,
+		"from":        from,
+		"to":          to,
+		"total":       total,
+		"points":      points,
+	}
+
+	// Per-node breakdown is for admins only
+	if !strings.HasPrefix(r.URL.Path, "/sub/") {
+		nRows, err := db.DB.Query(`
+			SELECT s.node_id, IFNULL(n.name, ''), SUM(s.bytes) FROM usage_user_stats s
+			LEFT JOIN nodes n ON s.node_id = n.id
+			WHERE s.user_uuid=? AND s.granularity=? AND s.bucket >= ? AND s.bucket <= ?
+			GROUP BY s.node_id
+		`, uuid, granularity, from, to)
+		if err == nil {
+			nodes := []map[string]interface{}{}
+			for nRows.Next() {
+				var nodeID int
+				var name string
+				var bytes int64
+				nRows.Scan(&nodeID, &name, &bytes)
+				nodes = append(nodes, map[string]interface{}{"node_id": nodeID, "name": name, "bytes": bytes})
+			}
+			nRows.Close()
+			resp["nodes"] = nodes
+		}
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+// GET /api/nodes/{id}/usage?from=&to=&granularity=hour|day|month
+func handleNodeUsage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", 405)
+		return
+	}
+
+	nodeID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid node id", 400)
+		return
+	}
+	from, to, granularity, ok := parseUsageRange(r)
+	if !ok {
+		http.Error(w, "Invalid from/to/granularity", 400)
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT bucket, SUM(bytes) FROM usage_user_stats
+		WHERE node_id=? AND granularity=? AND bucket >= ? AND bucket <= ?
+		GROUP BY bucket ORDER BY bucket
+	`, nodeID, granularity, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	points, total := scanUsagePoints(rows)
+	rows.Close()
+
+	// Series per inbound tag
+	iRows, err := db.DB.Query(`
+		SELECT inbound_tag, bucket, bytes FROM usage_inbound_stats
+		WHERE node_id=? AND granularity=? AND bucket >= ? AND bucket <= ?
+		ORDER BY inbound_tag, bucket
+	`, nodeID, granularity, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	inbounds := map[string][]UsagePoint{}
+	for iRows.Next() {
+		var tag string
+		var p UsagePoint
+		iRows.Scan(&tag, &p.Time, &p.Bytes)
+		inbounds[tag] = append(inbounds[tag], p)
+	}
+	iRows.Close()
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"node_id":     nodeID,
+		"granularity": granularity,
+		"from":        from,
+		"to":          to,
+		"total":       total,
+		"points":      points,
+		"inbounds":    inbounds,
+	})
+}
@@ -127,7 +127,7 @@ func main() {
 	// Stats API (Mock for now to satisfy Panel Poller)
 	// Stats API (Real User Usage)
 	http.HandleFunc("/admin/stats", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		usageMap, err := xrayMgr.GetStats()
+		trafficMap, err := xrayMgr.GetUserTraffic()
 		if err != nil {
 			log.Printf("❌ Failed to get stats from Xray Core: %v", err)
 			// Return the actual error details for remote debugging
@@ -136,8 +136,13 @@ func main() {
 		}
 
 		var stats []config.User
-		for uuid, usage := range usageMap {
-			stats = append(stats, config.User{UUID: uuid, UsageBytes: usage})
+		for uuid, t := range trafficMap {
+			stats = append(stats, config.User{
+				UUID:       uuid,
+				UsageBytes: t.Uplink + t.Downlink,
+				Uplink:     t.Uplink,
+				Downlink:   t.Downlink,
+			})
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -148,6 +153,19 @@ func main() {
 		}
 	}))
 
+	// Inbound Stats API (Per-Tag Usage)
+	http.HandleFunc("/admin/stats/inbounds", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		usageMap, err := xrayMgr.GetInboundStats()
+		if err != nil {
+			log.Printf("❌ Failed to get inbound stats from Xray Core: %v", err)
+			http.Error(w, fmt.Sprintf("Failed to get stats: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usageMap)
+	}))
+
 	// User Management (Dynamic Config Update)
 	http.HandleFunc("/api/users", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
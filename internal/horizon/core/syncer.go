@@ -2,6 +2,7 @@ package core
 
 import (
 	"aether/internal/horizon/db"
+	"aether/internal/horizon/secrets"
 	"aether/pkg/config"
 	"encoding/json"
 	"fmt"
@@ -27,8 +28,9 @@ func SyncAll() {
 	}
 	defer rows.Close()
 
-	// Map to aggregate usage: UserUUID -> TotalBytes
-	usageMap := make(map[string]int64)
+	// Map to aggregate usage since last sync: UserUUID -> {Uplink, Downlink}
+	usageMap := make(map[string][2]int64)
+	now := time.Now()
 
 	type NodeInfo struct {
 		ID   int
@@ -41,6 +43,7 @@ func SyncAll() {
 	for rows.Next() {
 		var n NodeInfo
 		rows.Scan(&n.ID, &n.IP, &n.Port, &n.Key)
+		n.Key = secrets.OpenOrEmpty(n.Key)
 		nodes = append(nodes, n)
 
 		// 2. Poll Node
@@ -61,28 +64,57 @@ func SyncAll() {
 		db.DB.Exec("UPDATE nodes SET status='active' WHERE id=?", n.ID)
 
 		// 3. Aggregate
+		// Agent counters are cumulative since the last Xray restart, so only
+		// the growth since the previous poll is added to the user's total.
 		for _, u := range stats {
-			usageMap[u.UUID] += u.UsageBytes
+			up, down := u.Uplink, u.Downlink
+			if up+down == 0 {
+				// Older agents only report the total
+				down = u.UsageBytes
+			}
+			dUp, dDown := counterDelta(n.ID, u.UUID, up, down)
+			acc := usageMap[u.UUID]
+			usageMap[u.UUID] = [2]int64{acc[0] + dUp, acc[1] + dDown}
+			recordUserUsage(n.ID, u.UUID, dUp+dDown, now)
+		}
+
+		// Per-inbound totals (older agents don't expose them)
+		inboundStats, err := fetchInboundStats(n.IP, n.Port, n.Key)
+		if err != nil {
+			log.Printf("⚠️ Node %s: No inbound stats: %v", n.IP, err)
+			continue
+		}
+		for tag, bytes := range inboundStats {
+			recordInboundUsage(n.ID, tag, inboundCounterDelta(n.ID, tag, bytes), now)
 		}
 	}
 
 	// 4. Update DB & Enforce Quotas
-	for uuid, totalUsage := range usageMap {
+	for uuid, delta := range usageMap {
+		if delta[0]+delta[1] == 0 {
+			continue
+		}
+
 		// Update DB
-		_, err := db.DB.Exec("UPDATE users SET used_bytes = ? WHERE uuid = ?", totalUsage, uuid)
+		_, err := db.DB.Exec(`
+			UPDATE users SET used_bytes = used_bytes + ?,
+			       upload_bytes = upload_bytes + ?, download_bytes = download_bytes + ?
+			WHERE uuid = ?`, delta[0]+delta[1], delta[0], delta[1], uuid)
 		if err != nil {
 			continue
 		}
 
 		// Check Limit
 		var limit float64
-		err = db.DB.QueryRow("SELECT limit_gb FROM users WHERE uuid = ?", uuid).Scan(&limit)
-		if err == nil && limit > 0 {
+		var totalUsage int64
+		var status string
+		err = db.DB.QueryRow("SELECT limit_gb, used_bytes, status FROM users WHERE uuid = ?", uuid).Scan(&limit, &totalUsage, &status)
+		if err == nil && limit > 0 && status == "active" {
 			limitBytes := int64(limit * 1024 * 1024 * 1024)
 			if totalUsage > limitBytes {
-				// 🚫 Disable User
-				log.Printf("🚫 User %s EXCEEDED Quota (%.2fGB / %.2fGB). Suspending...", uuid, float64(totalUsage)/1e9, limit)
-				db.DB.Exec("UPDATE users SET status='suspended' WHERE uuid=?", uuid)
+				// 🚫 Disable User (lifted again by the periodic reset, if any)
+				log.Printf("🚫 User %s EXCEEDED Quota (%.2fGB / %.2fGB). Limiting...", uuid, float64(totalUsage)/1e9, limit)
+				db.DB.Exec("UPDATE users SET status='limited' WHERE uuid=?", uuid)
 
 				// TODO: Trigger PushNodeConfig to immediately cut off user
 				// For now, they will be removed on next config update
@@ -91,6 +123,45 @@ func SyncAll() {
 	}
 }
 
+// counterDelta records the latest cumulative counters reported by a node for a
+// user and returns how much each direction grew since the previous poll. A
+// counter lower than the stored one means Xray was restarted, so the whole
+// value is new.
+func counterDelta(nodeID int, uuid string, uplink, downlink int64) (int64, int64) {
+	var lastUp, lastDown int64
+	db.DB.QueryRow("SELECT last_uplink, last_downlink FROM node_user_counters WHERE node_id=? AND user_uuid=?", nodeID, uuid).
+		Scan(&lastUp, &lastDown)
+
+	dUp, dDown := uplink-lastUp, downlink-lastDown
+	if uplink < lastUp || downlink < lastDown {
+		dUp, dDown = uplink, downlink
+	}
+
+	db.DB.Exec(`
+		INSERT INTO node_user_counters (node_id, user_uuid, last_bytes, last_uplink, last_downlink) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(node_id, user_uuid) DO UPDATE SET
+			last_bytes = excluded.last_bytes, last_uplink = excluded.last_uplink, last_downlink = excluded.last_downlink
+	`, nodeID, uuid, uplink+downlink, uplink, downlink)
+	return dUp, dDown
+}
+
+// inboundCounterDelta is counterDelta for per-inbound counters.
+func inboundCounterDelta(nodeID int, tag string, current int64) int64 {
+	var last int64
+	db.DB.QueryRow("SELECT last_bytes FROM node_inbound_counters WHERE node_id=? AND inbound_tag=?", nodeID, tag).Scan(&last)
+
+	delta := current - last
+	if current < last {
+		delta = current
+	}
+
+	db.DB.Exec(`
+		INSERT INTO node_inbound_counters (node_id, inbound_tag, last_bytes) VALUES (?, ?, ?)
+		ON CONFLICT(node_id, inbound_tag) DO UPDATE SET last_bytes = excluded.last_bytes
+	`, nodeID, tag, current)
+	return delta
+}
+
 func fetchStats(ip, port, key string) ([]config.User, error) {
 	client := http.Client{Timeout: 5 * time.Second}
 	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s:%s/admin/stats", ip, port), nil)
@@ -116,3 +187,27 @@ func fetchStats(ip, port, key string) ([]config.User, error) {
 	}
 	return stats, nil
 }
+
+func fetchInboundStats(ip, port, key string) (map[string]int64, error) {
+	client := http.Client{Timeout: 5 * time.Second}
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s:%s/admin/stats/inbounds", ip, port), nil)
+	if key != "" {
+		req.Header.Set("X-Master-Key", key)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	stats := make(map[string]int64)
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"log"
+	"time"
+
+	"aether/internal/horizon/db"
+)
+
+// Usage bucket granularities
+const (
+	GranularityHour  = "hour"
+	GranularityDay   = "day"
+	GranularityMonth = "month"
+)
+
+// Retention per granularity (monthly buckets are kept forever)
+var usageRetention = map[string]time.Duration{
+	GranularityHour: 14 * 24 * time.Hour,
+	GranularityDay:  400 * 24 * time.Hour,
+}
+
+// BucketStart truncates t (UTC) to the start of its bucket.
+func BucketStart(granularity string, t time.Time) time.Time {
+	t = t.UTC()
+	switch granularity {
+	case GranularityDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case GranularityMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(time.Hour)
+}
+
+// recordUserUsage adds delta bytes to the user's hourly bucket on a node and
+// rolls it up into the matching daily and monthly buckets.
+func recordUserUsage(nodeID int, uuid string, delta int64, at time.Time) {
+	if delta <= 0 {
+		return
+	}
+	for _, g := range []string{GranularityHour, GranularityDay, GranularityMonth} {
+		_, err := db.DB.Exec(`
+			INSERT INTO usage_user_stats (granularity, bucket, user_uuid, node_id, bytes) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(granularity, bucket, user_uuid, node_id) DO UPDATE SET bytes = bytes + excluded.bytes
+		`, g, BucketStart(g, at).Unix(), uuid, nodeID, delta)
+		if err != nil {
+			log.Println("Usage Record Error:", err)
+			return
+		}
+	}
+}
+
+// recordInboundUsage does the same for the total traffic of an inbound tag.
+func recordInboundUsage(nodeID int, tag string, delta int64, at time.Time) {
+	if delta <= 0 {
+		return
+	}
+	for _, g := range []string{GranularityHour, GranularityDay, GranularityMonth} {
+		_, err := db.DB.Exec(`
+			INSERT INTO usage_inbound_stats (granularity, bucket, node_id, inbound_tag, bytes) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(granularity, bucket, node_id, inbound_tag) DO UPDATE SET bytes = bytes + excluded.bytes
+		`, g, BucketStart(g, at).Unix(), nodeID, tag, delta)
+		if err != nil {
+			log.Println("Usage Record Error:", err)
+			return
+		}
+	}
+}
+
+// StartUsagePruner periodically drops buckets that are past their retention.
+func StartUsagePruner() {
+	PruneUsage()
+	ticker := time.NewTicker(1 * time.Hour)
+	for range ticker.C {
+		PruneUsage()
+	}
+}
+
+func PruneUsage() {
+	now := time.Now()
+	for g, keep := range usageRetention {
+		cutoff := now.Add(-keep).Unix()
+		db.DB.Exec("DELETE FROM usage_user_stats WHERE granularity=? AND bucket < ?", g, cutoff)
+		db.DB.Exec("DELETE FROM usage_inbound_stats WHERE granularity=? AND bucket < ?", g, cutoff)
+	}
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Backup writes a consistent snapshot of the live database to path (a new
+// file) with SQLite's online backup API. Horizon keeps serving meanwhile;
+// copying horizon.db by hand can catch it mid-write or miss the WAL.
+func Backup(path string) error {
+	dst, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	return copyDatabase(DB, dst)
+}
+
+// Restore replaces the contents of the live database with the database at
+// path, in one step. Validate it with Version first.
+func Restore(path string) error {
+	src, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return copyDatabase(src, DB)
+}
+
+func copyDatabase(src, dst *sql.DB) error {
+	ctx := context.Background()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer dstConn.Close()
+
+	return dstConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			dc, ok1 := d.(*sqlite3.SQLiteConn)
+			sc, ok2 := s.(*sqlite3.SQLiteConn)
+			if !ok1 || !ok2 {
+				return errors.New("not a SQLite connection")
+			}
+			b, err := dc.Backup("main", sc, "main")
+			if err != nil {
+				return err
+			}
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// LatestVersion is the newest migration this build knows.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Version returns the newest migration applied to conn, 0 for a database
+// from before versioned migrations, or an error if conn does not look like
+// a Horizon database.
+func Version(conn *sql.DB) (int, error) {
+	var tables int
+	err := conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name IN ('nodes', 'users')").Scan(&tables)
+	if err != nil {
+		return 0, err
+	}
+	if tables != 2 {
+		return 0, errors.New("not a Horizon database")
+	}
+	var versioned int
+	conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='schema_migrations'").Scan(&versioned)
+	if versioned == 0 {
+		return 0, nil
+	}
+	var version sql.NullInt64
+	err = conn.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	return int(version.Int64), err
+}
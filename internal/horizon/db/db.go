@@ -0,0 +1,30 @@
+package db
+
+import (
+	"database/sql"
+	"log"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var DB *sql.DB
+
+func Init(path string) {
+	var err error
+	DB, err = sql.Open("sqlite3", path)
+	if err != nil {
+		log.Fatal("❌ Failed to open database:", err)
+	}
+
+	// Enable WAL Mode for better concurrency
+	if _, err := DB.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		log.Printf("⚠️ Failed to enable WAL mode: %v", err)
+	}
+
+	// Enable Foreign Keys
+	if _, err := DB.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		log.Printf("⚠️ Failed to enable foreign keys: %v", err)
+	}
+
+	// Tables are created by Migrate (see migrations.go)
+}
@@ -0,0 +1,266 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Migration is one numbered schema change. Up and Down run inside a
+// transaction; a nil Down means the migration cannot be rolled back.
+//
+// Up steps must also be safe on a database that already has the change:
+// databases from before schema_migrations existed replay every migration
+// once to be brought onto the versioned scheme.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+}
+
+// MigrationStatus describes a migration and whether it has been applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt int64 // 0 if pending
+}
+
+func ensureMigrationsTable() error {
+	_, err := DB.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		)
+	`)
+	return err
+}
+
+func appliedMigrations() (map[int]int64, error) {
+	if err := ensureMigrationsTable(); err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]int64{}
+	for rows.Next() {
+		var version int
+		var at int64
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// Status lists every known migration in order.
+func Status() ([]MigrationStatus, error) {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		list = append(list, MigrationStatus{Version: m.Version, Name: m.Name, AppliedAt: applied[m.Version]})
+	}
+	return list, nil
+}
+
+// Migrate applies every pending migration.
+func Migrate() error {
+	return MigrateTo(0)
+}
+
+// MigrateTo applies pending migrations up to and including target; 0 means
+// all of them.
+func MigrateTo(target int) error {
+	var legacy int
+	DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='nodes'").Scan(&legacy)
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+	if legacy > 0 && len(applied) == 0 {
+		// Tables but no history: a database from before versioning
+		log.Println("🔄 Bringing existing database onto versioned migrations...")
+	}
+
+	for _, m := range migrations {
+		if target > 0 && m.Version > target {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		log.Printf("⬆️  Migration %d: %s", m.Version, m.Name)
+		err := inTx(func(tx *sql.Tx) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+				m.Version, m.Name, time.Now().Unix())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// Rollback reverts the last n applied migrations, newest first.
+func Rollback(n int) error {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && n > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		if m.Down == nil {
+			return fmt.Errorf("migration %d (%s) cannot be rolled back", m.Version, m.Name)
+		}
+		log.Printf("⬇️  Migration %d: %s", m.Version, m.Name)
+		err := inTx(func(tx *sql.Tx) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version=?", m.Version)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		n--
+	}
+	return nil
+}
+
+func inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Helpers for migration steps
+
+func hasColumn(tx *sql.Tx, table, column string) (bool, error) {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var cid, notnull, pk int
+	var name, ctype string
+	var dfltValue interface{}
+	for rows.Next() {
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+func columnType(tx *sql.Tx, table, column string) (string, error) {
+	var ctype string
+	err := tx.QueryRow("SELECT type FROM pragma_table_info(?) WHERE name=?", table, column).Scan(&ctype)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return ctype, err
+}
+
+// column names a table column and, for addColumns, its definition.
+type column struct{ table, name, def string }
+
+// addColumns adds the columns a table does not have yet.
+func addColumns(tx *sql.Tx, cols ...column) error {
+	for _, c := range cols {
+		ok, err := hasColumn(tx, c.table, c.name)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		if _, err := tx.Exec("ALTER TABLE " + c.table + " ADD COLUMN " + c.name + " " + c.def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropColumns removes the columns a table still has.
+func dropColumns(tx *sql.Tx, cols ...column) error {
+	for _, c := range cols {
+		ok, err := hasColumn(tx, c.table, c.name)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if _, err := tx.Exec("ALTER TABLE " + c.table + " DROP COLUMN " + c.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execSQL returns a step that runs a fixed script.
+func execSQL(script string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(script)
+		return err
+	}
+}
+
+// dropTables returns a Down step that drops tables, in the order given.
+func dropTables(tables ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, t := range tables {
+			if _, err := tx.Exec("DROP TABLE IF EXISTS " + t); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// steps chains migration steps.
+func steps(fns ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, fn := range fns {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func addColumnsStep(cols ...column) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error { return addColumns(tx, cols...) }
+}
+
+func dropColumnsStep(cols ...column) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error { return dropColumns(tx, cols...) }
+}
@@ -0,0 +1,586 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// migrations is the schema history, oldest first. Append new migrations at
+// the end and never renumber or edit one that has shipped. Versions 1-18
+// are the schema built up by the startup checks that came before them.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "initial_schema",
+		Up:      steps(execSQL(initialSchema), fixLegacyCoreTables),
+	},
+	{
+		Version: 2,
+		Name:    "multi_node_configs",
+		Up: steps(
+			execSQL(`
+				CREATE TABLE IF NOT EXISTS node_configs (
+					node_id INTEGER,
+					config_id INTEGER,
+					PRIMARY KEY (node_id, config_id),
+					FOREIGN KEY(node_id) REFERENCES nodes(id),
+					FOREIGN KEY(config_id) REFERENCES core_configs(id)
+				);
+			`),
+			addColumnsStep(
+				column{"core_configs", "raw_inbounds", "TEXT"},
+				column{"nodes", "base_config", "TEXT"}, // Global Settings (DNS/Routing)
+			),
+		),
+		Down: steps(
+			dropTables("node_configs"),
+			dropColumnsStep(column{table: "core_configs", name: "raw_inbounds"}, column{table: "nodes", name: "base_config"}),
+		),
+	},
+	{
+		Version: 3,
+		Name:    "groups",
+		Up: steps(
+			execSQL(`
+				CREATE TABLE IF NOT EXISTS groups (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					name TEXT UNIQUE NOT NULL,
+					is_disabled BOOLEAN DEFAULT 0
+				);
+
+				CREATE TABLE IF NOT EXISTS group_inbounds (
+					group_id INTEGER,
+					inbound_tag TEXT,
+					PRIMARY KEY (group_id, inbound_tag),
+					FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE
+				);
+
+				CREATE TABLE IF NOT EXISTS user_groups (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_uuid TEXT NOT NULL,
+					group_id INTEGER NOT NULL,
+					FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE,
+					FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE,
+					UNIQUE(user_uuid, group_id)
+				);
+			`),
+			fixLegacyGroupTables,
+		),
+		Down: dropTables("user_groups", "group_inbounds", "groups"),
+	},
+	{
+		Version: 4,
+		Name:    "user_templates",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS user_templates (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT UNIQUE NOT NULL,
+				data_limit INTEGER DEFAULT 0,
+				expire_duration INTEGER DEFAULT 0,
+				username_prefix TEXT,
+				username_suffix TEXT,
+				status TEXT DEFAULT 'active',
+				data_limit_reset_strategy TEXT DEFAULT 'no_reset',
+				extra_settings TEXT, -- JSON
+				is_disabled BOOLEAN DEFAULT 0
+			);
+
+			CREATE TABLE IF NOT EXISTS template_group_association (
+				template_id INTEGER,
+				group_id INTEGER,
+				PRIMARY KEY (template_id, group_id),
+				FOREIGN KEY(template_id) REFERENCES user_templates(id) ON DELETE CASCADE,
+				FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE
+			);
+		`),
+		Down: dropTables("template_group_association", "user_templates"),
+	},
+	{
+		Version: 5,
+		Name:    "usage_reset_strategy",
+		Up: steps(
+			addColumnsStep(
+				column{"users", "data_limit_reset_strategy", "TEXT DEFAULT 'no_reset'"},
+				column{"users", "last_reset_at", "INTEGER DEFAULT 0"},
+			),
+			execSQL(`
+				CREATE TABLE IF NOT EXISTS user_usage_resets (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					user_uuid TEXT NOT NULL,
+					used_bytes INTEGER DEFAULT 0,
+					period_start INTEGER DEFAULT 0,
+					period_end INTEGER DEFAULT 0,
+					FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE
+				);
+
+				CREATE TABLE IF NOT EXISTS node_user_counters (
+					node_id INTEGER NOT NULL,
+					user_uuid TEXT NOT NULL,
+					last_bytes INTEGER DEFAULT 0,
+					PRIMARY KEY (node_id, user_uuid),
+					FOREIGN KEY(node_id) REFERENCES nodes(id) ON DELETE CASCADE
+				);
+			`),
+		),
+		Down: steps(
+			dropTables("node_user_counters", "user_usage_resets"),
+			dropColumnsStep(column{table: "users", name: "data_limit_reset_strategy"}, column{table: "users", name: "last_reset_at"}),
+		),
+	},
+	{
+		Version: 6,
+		Name:    "usage_time_series",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS usage_user_stats (
+				granularity TEXT NOT NULL,
+				bucket INTEGER NOT NULL,
+				user_uuid TEXT NOT NULL,
+				node_id INTEGER NOT NULL,
+				bytes INTEGER DEFAULT 0,
+				PRIMARY KEY (granularity, bucket, user_uuid, node_id)
+			);
+			CREATE INDEX IF NOT EXISTS idx_usage_user_stats_user ON usage_user_stats(user_uuid, granularity, bucket);
+			CREATE INDEX IF NOT EXISTS idx_usage_user_stats_node ON usage_user_stats(node_id, granularity, bucket);
+
+			CREATE TABLE IF NOT EXISTS usage_inbound_stats (
+				granularity TEXT NOT NULL,
+				bucket INTEGER NOT NULL,
+				node_id INTEGER NOT NULL,
+				inbound_tag TEXT NOT NULL,
+				bytes INTEGER DEFAULT 0,
+				PRIMARY KEY (granularity, bucket, node_id, inbound_tag)
+			);
+
+			CREATE TABLE IF NOT EXISTS node_inbound_counters (
+				node_id INTEGER NOT NULL,
+				inbound_tag TEXT NOT NULL,
+				last_bytes INTEGER DEFAULT 0,
+				PRIMARY KEY (node_id, inbound_tag),
+				FOREIGN KEY(node_id) REFERENCES nodes(id) ON DELETE CASCADE
+			);
+		`),
+		Down: dropTables("node_inbound_counters", "usage_inbound_stats", "usage_user_stats"),
+	},
+	{
+		Version: 7,
+		Name:    "traffic_direction_and_settings",
+		Up: steps(
+			func(tx *sql.Tx) error {
+				// Totals from before the split count as download
+				split, err := hasColumn(tx, "users", "upload_bytes")
+				if err != nil || split {
+					return err
+				}
+				_, err = tx.Exec(`
+					ALTER TABLE users ADD COLUMN upload_bytes INTEGER DEFAULT 0;
+					ALTER TABLE users ADD COLUMN download_bytes INTEGER DEFAULT 0;
+					UPDATE users SET download_bytes = used_bytes;
+				`)
+				return err
+			},
+			func(tx *sql.Tx) error {
+				split, err := hasColumn(tx, "node_user_counters", "last_uplink")
+				if err != nil || split {
+					return err
+				}
+				_, err = tx.Exec(`
+					ALTER TABLE node_user_counters ADD COLUMN last_uplink INTEGER DEFAULT 0;
+					ALTER TABLE node_user_counters ADD COLUMN last_downlink INTEGER DEFAULT 0;
+					UPDATE node_user_counters SET last_downlink = last_bytes;
+				`)
+				return err
+			},
+			execSQL(`
+				CREATE TABLE IF NOT EXISTS settings (
+					key TEXT PRIMARY KEY,
+					value TEXT
+				);
+			`),
+		),
+		Down: steps(
+			dropTables("settings"),
+			dropColumnsStep(
+				column{table: "users", name: "upload_bytes"},
+				column{table: "users", name: "download_bytes"},
+				column{table: "node_user_counters", name: "last_uplink"},
+				column{table: "node_user_counters", name: "last_downlink"},
+			),
+		),
+	},
+	{
+		Version: 8,
+		Name:    "subscription_tokens",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS subscription_tokens (
+				token_id TEXT PRIMARY KEY,
+				user_uuid TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				expires_at INTEGER DEFAULT 0,
+				revoked_at INTEGER DEFAULT 0,
+				FOREIGN KEY(user_uuid) REFERENCES users(uuid) ON DELETE CASCADE ON UPDATE CASCADE
+			);
+			CREATE INDEX IF NOT EXISTS idx_subscription_tokens_user ON subscription_tokens(user_uuid);
+		`),
+		Down: dropTables("subscription_tokens"),
+	},
+	{
+		Version: 9,
+		Name:    "wireguard_peers",
+		Up:      addColumnsStep(column{"users", "wg_peer_id", "INTEGER DEFAULT 0"}),
+		Down:    dropColumnsStep(column{table: "users", name: "wg_peer_id"}),
+	},
+	{
+		Version: 10,
+		Name:    "hosts",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS hosts (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				inbound_tag TEXT NOT NULL,
+				node_id INTEGER DEFAULT 0,
+				remark TEXT DEFAULT '',
+				address TEXT DEFAULT '',
+				port INTEGER DEFAULT 0,
+				sni TEXT DEFAULT '',
+				host TEXT DEFAULT '',
+				path TEXT DEFAULT '',
+				alpn TEXT DEFAULT '',
+				fingerprint TEXT DEFAULT '',
+				enabled BOOLEAN DEFAULT 1,
+				priority INTEGER DEFAULT 0
+			);
+			CREATE INDEX IF NOT EXISTS idx_hosts_tag ON hosts(inbound_tag);
+		`),
+		Down: dropTables("hosts"),
+	},
+	{
+		Version: 11,
+		Name:    "device_enigma_keys",
+		Up:      addColumnsStep(column{"devices", "enigma_key", "TEXT DEFAULT ''"}),
+		Down:    dropColumnsStep(column{table: "devices", name: "enigma_key"}),
+	},
+	{
+		Version: 12,
+		Name:    "enigma_keyring",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS enigma_keys (
+				key_id TEXT PRIMARY KEY,
+				private_key TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				activates_at INTEGER DEFAULT 0,
+				expires_at INTEGER DEFAULT 0,
+				retired_at INTEGER DEFAULT 0
+			);
+		`),
+		Down: dropTables("enigma_keys"),
+	},
+	{
+		Version: 13,
+		Name:    "hwid_limits",
+		Up: addColumnsStep(
+			column{"users", "hwid_limit", "BOOLEAN DEFAULT 0"},
+			column{"groups", "hwid_limit", "BOOLEAN DEFAULT 0"},
+			column{"user_templates", "hwid_limit", "BOOLEAN DEFAULT 0"},
+			column{"devices", "os", "TEXT DEFAULT ''"},
+		),
+		Down: dropColumnsStep(
+			column{table: "users", name: "hwid_limit"},
+			column{table: "groups", name: "hwid_limit"},
+			column{table: "user_templates", name: "hwid_limit"},
+			column{table: "devices", name: "os"},
+		),
+	},
+	{
+		Version: 14,
+		Name:    "admin_accounts",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS admins (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT UNIQUE NOT NULL,
+				password_hash TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				last_login_at INTEGER DEFAULT 0,
+				disabled BOOLEAN DEFAULT 0
+			);
+
+			CREATE TABLE IF NOT EXISTS admin_sessions (
+				token_hash TEXT PRIMARY KEY,
+				admin_id INTEGER NOT NULL,
+				created_at INTEGER NOT NULL,
+				expires_at INTEGER NOT NULL,
+				user_agent TEXT DEFAULT '',
+				FOREIGN KEY(admin_id) REFERENCES admins(id) ON DELETE CASCADE
+			);
+		`),
+		Down: dropTables("admin_sessions", "admins"),
+	},
+	{
+		Version: 15,
+		Name:    "admin_roles",
+		Up: steps(
+			addColumnsStep(
+				column{"admins", "role", "TEXT DEFAULT 'owner'"}, // Accounts from before roles had full access
+				column{"admins", "max_users", "INTEGER DEFAULT 0"},
+				column{"admins", "max_total_gb", "REAL DEFAULT 0"},
+				column{"users", "owner_admin_id", "INTEGER DEFAULT 0"},
+			),
+			execSQL(`
+				CREATE TABLE IF NOT EXISTS admin_groups (
+					admin_id INTEGER NOT NULL,
+					group_id INTEGER NOT NULL,
+					PRIMARY KEY (admin_id, group_id),
+					FOREIGN KEY(admin_id) REFERENCES admins(id) ON DELETE CASCADE,
+					FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE
+				);
+
+				CREATE TABLE IF NOT EXISTS admin_templates (
+					admin_id INTEGER NOT NULL,
+					template_id INTEGER NOT NULL,
+					PRIMARY KEY (admin_id, template_id),
+					FOREIGN KEY(admin_id) REFERENCES admins(id) ON DELETE CASCADE,
+					FOREIGN KEY(template_id) REFERENCES user_templates(id) ON DELETE CASCADE
+				);
+				CREATE INDEX IF NOT EXISTS idx_users_owner_admin ON users(owner_admin_id);
+			`),
+		),
+		Down: steps(
+			execSQL("DROP INDEX IF EXISTS idx_users_owner_admin"),
+			dropTables("admin_templates", "admin_groups"),
+			dropColumnsStep(
+				column{table: "admins", name: "role"},
+				column{table: "admins", name: "max_users"},
+				column{table: "admins", name: "max_total_gb"},
+				column{table: "users", name: "owner_admin_id"},
+			),
+		),
+	},
+	{
+		Version: 16,
+		Name:    "audit_log",
+		Up: execSQL(`
+			CREATE TABLE IF NOT EXISTS audit_log (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				created_at INTEGER NOT NULL,
+				admin_id INTEGER DEFAULT 0,
+				admin_username TEXT DEFAULT '',
+				action TEXT NOT NULL,
+				entity TEXT DEFAULT '',
+				entity_id TEXT DEFAULT '',
+				changes TEXT DEFAULT '{}',
+				ip TEXT DEFAULT ''
+			);
+			CREATE INDEX IF NOT EXISTS idx_audit_log_created ON audit_log(created_at);
+			CREATE INDEX IF NOT EXISTS idx_audit_log_entity ON audit_log(entity, entity_id);
+		`),
+		Down: dropTables("audit_log"),
+	},
+	{
+		Version: 17,
+		Name:    "api_tokens",
+		Up: steps(
+			execSQL(`
+				CREATE TABLE IF NOT EXISTS api_tokens (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					admin_id INTEGER NOT NULL,
+					name TEXT NOT NULL,
+					token_hash TEXT UNIQUE NOT NULL,
+					prefix TEXT DEFAULT '',
+					scopes TEXT DEFAULT '',
+					created_at INTEGER NOT NULL,
+					expires_at INTEGER DEFAULT 0,
+					last_used_at INTEGER DEFAULT 0,
+					last_used_ip TEXT DEFAULT '',
+					revoked_at INTEGER DEFAULT 0,
+					FOREIGN KEY(admin_id) REFERENCES admins(id) ON DELETE CASCADE
+				);
+			`),
+			addColumnsStep(column{"audit_log", "token_id", "INTEGER DEFAULT 0"}),
+		),
+		Down: steps(
+			dropTables("api_tokens"),
+			dropColumnsStep(column{table: "audit_log", name: "token_id"}),
+		),
+	},
+	{
+		Version: 18,
+		Name:    "two_factor_auth",
+		Up: steps(
+			addColumnsStep(
+				column{"admins", "totp_secret", "TEXT DEFAULT ''"},
+				column{"admins", "totp_enabled", "BOOLEAN DEFAULT 0"},
+				column{"admins", "totp_last_step", "INTEGER DEFAULT 0"},
+				column{"admin_sessions", "verified_at", "INTEGER DEFAULT 0"},
+			),
+			execSQL(`
+				CREATE TABLE IF NOT EXISTS admin_recovery_codes (
+					id INTEGER PRIMARY KEY AUTOINCREMENT,
+					admin_id INTEGER NOT NULL,
+					code_hash TEXT NOT NULL,
+					used_at INTEGER DEFAULT 0,
+					FOREIGN KEY(admin_id) REFERENCES admins(id) ON DELETE CASCADE
+				);
+			`),
+		),
+		Down: steps(
+			dropTables("admin_recovery_codes"),
+			dropColumnsStep(
+				column{table: "admins", name: "totp_secret"},
+				column{table: "admins", name: "totp_enabled"},
+				column{table: "admins", name: "totp_last_step"},
+				column{table: "admin_sessions", name: "verified_at"},
+			),
+		),
+	},
+	{
+		Version: 19,
+		Name:    "imported_credentials",
+		Up: addColumnsStep(
+			column{"users", "trojan_password", "TEXT DEFAULT ''"}, // Kept from another panel on import; '' = derived from the UUID
+			column{"users", "ss_password", "TEXT DEFAULT ''"},
+		),
+		Down: dropColumnsStep(
+			column{table: "users", name: "trojan_password"},
+			column{table: "users", name: "ss_password"},
+		),
+	},
+	{
+		Version: 20,
+		Name:    "reset_anchor",
+		Up: steps(
+			addColumnsStep(column{"users", "reset_anchor_at", "INTEGER DEFAULT 0"}), // Start of the first reset period
+			execSQL(`UPDATE users SET reset_anchor_at = IFNULL(last_reset_at, 0)`),
+		),
+		Down: dropColumnsStep(column{table: "users", name: "reset_anchor_at"}),
+	},
+}
+
+// initialSchema is the original table set. Groups and their inbounds are
+// left to migration 3, which also owns their canonical shape.
+const initialSchema = `
+	CREATE TABLE IF NOT EXISTS nodes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT,
+		ip TEXT,
+		admin_port TEXT,
+		master_key TEXT,
+		status TEXT DEFAULT 'offline',
+		last_check INTEGER DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS users (
+		uuid TEXT PRIMARY KEY,
+		name TEXT,
+		limit_gb REAL,
+		device_limit INTEGER DEFAULT 3,
+		used_bytes INTEGER DEFAULT 0,
+		expiry INTEGER DEFAULT 0,
+		status TEXT DEFAULT 'active'
+	);
+
+	CREATE TABLE IF NOT EXISTS devices (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		hardware_id TEXT UNIQUE NOT NULL,
+		label TEXT,
+		status TEXT DEFAULT 'active',
+		last_seen DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+
+	CREATE TABLE IF NOT EXISTS user_devices (
+		user_uuid TEXT NOT NULL,
+		device_id INTEGER NOT NULL,
+		FOREIGN KEY (user_uuid) REFERENCES users(uuid) ON DELETE CASCADE,
+		FOREIGN KEY (device_id) REFERENCES devices(id) ON DELETE CASCADE,
+		UNIQUE(user_uuid, device_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS core_configs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		node_id INTEGER,
+		protocol TEXT,
+		port TEXT,
+		settings TEXT,
+		status TEXT DEFAULT 'active',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (node_id) REFERENCES nodes(id)
+	);
+
+	CREATE TABLE IF NOT EXISTS group_configs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		group_id INTEGER NOT NULL,
+		config_id INTEGER NOT NULL,
+		FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE,
+		FOREIGN KEY (config_id) REFERENCES core_configs(id) ON DELETE CASCADE,
+		UNIQUE(group_id, config_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS user_config_usage (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_uuid TEXT NOT NULL,
+		config_id INTEGER NOT NULL,
+		used_bytes BIGINT DEFAULT 0,
+		last_sync DATETIME,
+		FOREIGN KEY (user_uuid) REFERENCES users(uuid) ON DELETE CASCADE,
+		FOREIGN KEY (config_id) REFERENCES core_configs(id) ON DELETE CASCADE,
+		UNIQUE(user_uuid, config_id)
+	);
+`
+
+// fixLegacyCoreTables upgrades the earliest databases: integer config ports
+// and users without device_limit.
+func fixLegacyCoreTables(tx *sql.Tx) error {
+	portType, err := columnType(tx, "core_configs", "port")
+	if err != nil {
+		return err
+	}
+	if portType != "" && !strings.EqualFold(portType, "TEXT") {
+		_, err := tx.Exec(`
+			ALTER TABLE core_configs ADD COLUMN port_new TEXT;
+			UPDATE core_configs SET port_new = CAST(port AS TEXT);
+			ALTER TABLE core_configs DROP COLUMN port;
+			ALTER TABLE core_configs RENAME COLUMN port_new TO port;
+		`)
+		if err != nil {
+			return err
+		}
+	}
+	return addColumns(tx, column{"users", "device_limit", "INTEGER DEFAULT 3"})
+}
+
+// fixLegacyGroupTables converges the two shapes groups used to be created
+// in. Databases initialised by the old db.createTables got groups with
+// unused description/max_traffic_gb/created_at columns and no is_disabled,
+// and a group_inbounds keyed by a surrogate id that allowed duplicate tags.
+func fixLegacyGroupTables(tx *sql.Tx) error {
+	err := addColumns(tx, column{"groups", "is_disabled", "BOOLEAN DEFAULT 0"})
+	if err != nil {
+		return err
+	}
+	err = dropColumns(tx,
+		column{table: "groups", name: "description"},
+		column{table: "groups", name: "max_traffic_gb"},
+		column{table: "groups", name: "created_at"},
+	)
+	if err != nil {
+		return err
+	}
+
+	legacy, err := hasColumn(tx, "group_inbounds", "id")
+	if err != nil || !legacy {
+		return err
+	}
+	// group_inbounds is only ever a child table, so rebuilding it is safe
+	// with foreign keys on.
+	_, err = tx.Exec(`
+		CREATE TABLE group_inbounds_new (
+			group_id INTEGER,
+			inbound_tag TEXT,
+			PRIMARY KEY (group_id, inbound_tag),
+			FOREIGN KEY(group_id) REFERENCES groups(id) ON DELETE CASCADE
+		);
+		INSERT OR IGNORE INTO group_inbounds_new (group_id, inbound_tag)
+			SELECT group_id, inbound_tag FROM group_inbounds WHERE group_id IN (SELECT id FROM groups);
+		DROP TABLE group_inbounds;
+		ALTER TABLE group_inbounds_new RENAME TO group_inbounds;
+	`)
+	return err
+}
@@ -0,0 +1,174 @@
+// Package secrets encrypts Horizon's secret columns at rest. Values are
+// sealed with AES-256-GCM under a key-encryption key (KEK) and stored as
+// "enc:v1:<key id>:<base64 nonce+ciphertext>". Values without the prefix are
+// legacy plaintext and are returned as they are.
+//
+// The KEK is 32 bytes, base64 or hex encoded, taken from HORIZON_KEK or the
+// file named by HORIZON_KEK_FILE (default horizon.key), which is created on
+// first start. Keep it out of database backups.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	prefix      = "enc:v1:"
+	DefaultFile = "horizon.key"
+)
+
+var ErrWrongKey = errors.New("secret was sealed with a different key")
+
+// Key is a loaded KEK.
+type Key struct {
+	ID   string
+	aead cipher.AEAD
+}
+
+var current *Key
+
+// NewKey wraps 32 raw bytes.
+func NewKey(raw []byte) (*Key, error) {
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &Key{ID: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+// ParseKey decodes a base64 or hex encoded key.
+func ParseKey(encoded string) (*Key, error) {
+	encoded = strings.TrimSpace(encoded)
+	if raw, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(raw) == 32 {
+		return NewKey(raw)
+	}
+	if raw, err := hex.DecodeString(encoded); err == nil {
+		return NewKey(raw)
+	}
+	return nil, errors.New("key is neither 32 bytes of base64 nor hex")
+}
+
+// LoadKeyFile reads a key file, creating it with a new random key if create
+// is set and it does not exist.
+func LoadKeyFile(path string, create bool) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(raw)
+		if err := os.WriteFile(path, []byte(encoded+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Println("🔑 Created key-encryption key", path)
+		return NewKey(raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(string(data))
+}
+
+// Init loads the KEK from the environment.
+func Init() error {
+	var err error
+	if env := os.Getenv("HORIZON_KEK"); env != "" {
+		current, err = ParseKey(env)
+		return err
+	}
+	// A missing file is created. Should that happen over existing secrets
+	// (say, a lost volume), opening them fails rather than being overwritten.
+	path := os.Getenv("HORIZON_KEK_FILE")
+	if path == "" {
+		path = DefaultFile
+	}
+	current, err = LoadKeyFile(path, true)
+	return err
+}
+
+// Current returns the KEK loaded by Init.
+func Current() *Key {
+	return current
+}
+
+// IsSealed reports whether value is an encrypted secret.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Seal encrypts value. Empty and already sealed values are left alone.
+func (k *Key) Seal(value string) (string, error) {
+	if value == "" || IsSealed(value) {
+		return value, nil
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(value), nil)
+	return prefix + k.ID + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a sealed value. Plaintext passes through.
+func (k *Key) Open(value string) (string, error) {
+	if !IsSealed(value) {
+		return value, nil
+	}
+	id, data, ok := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	if !ok {
+		return "", errors.New("malformed secret")
+	}
+	if id != k.ID {
+		return "", ErrWrongKey
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(data)
+	if err != nil || len(raw) < k.aead.NonceSize() {
+		return "", errors.New("malformed secret")
+	}
+	nonce, ciphertext := raw[:k.aead.NonceSize()], raw[k.aead.NonceSize():]
+	plain, err := k.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// Seal encrypts value under the current KEK.
+func Seal(value string) (string, error) {
+	return current.Seal(value)
+}
+
+// Open decrypts value with the current KEK.
+func Open(value string) (string, error) {
+	return current.Open(value)
+}
+
+// OpenOrEmpty is Open for read paths that have no way to report an error; a
+// secret that cannot be opened is logged and comes back empty.
+func OpenOrEmpty(value string) string {
+	plain, err := Open(value)
+	if err != nil {
+		log.Println("❌ Secret Error:", err)
+		return ""
+	}
+	return plain
+}
@@ -0,0 +1,171 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Streams encrypt files too large to seal in one piece (database backups).
+// After a header of streamMagic, the key ID and a random nonce prefix, the
+// data follows in chunks of up to streamChunk bytes, each sealed with a
+// nonce of prefix + chunk counter. Every chunk starts with a flag byte,
+// authenticated with it, that marks the last one, so a truncated stream is
+// rejected rather than read short.
+
+const (
+	streamMagic  = "HZENC1"
+	streamChunk  = 64 * 1024
+	streamPrefix = 8
+)
+
+var ErrTruncated = errors.New("encrypted stream is truncated")
+
+// IsStream reports whether header (the first bytes of a file) starts an
+// encrypted stream.
+func IsStream(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(streamMagic))
+}
+
+type streamWriter struct {
+	k      *Key
+	w      io.Writer
+	prefix []byte
+	n      uint32
+	buf    []byte
+}
+
+// NewWriter returns a writer that encrypts everything written to it into w.
+// Close must be called to write the final chunk; it does not close w.
+func (k *Key) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	prefix := make([]byte, streamPrefix)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := append([]byte(streamMagic+k.ID), prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &streamWriter{k: k, w: w, prefix: prefix, buf: make([]byte, 0, streamChunk)}, nil
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):cap(s.buf)], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == cap(s.buf) {
+			if err := s.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *streamWriter) Close() error {
+	return s.flush(true)
+}
+
+func (s *streamWriter) flush(final bool) error {
+	flag := []byte{0}
+	if final {
+		flag[0] = 1
+	}
+	sealed := s.k.aead.Seal(nil, streamNonce(s.prefix, s.n), s.buf, flag)
+	s.n++
+	s.buf = s.buf[:0]
+
+	head := make([]byte, 5)
+	head[0] = flag[0]
+	binary.BigEndian.PutUint32(head[1:], uint32(len(sealed)))
+	if _, err := s.w.Write(head); err != nil {
+		return err
+	}
+	_, err := s.w.Write(sealed)
+	return err
+}
+
+func streamNonce(prefix []byte, n uint32) []byte {
+	nonce := make([]byte, streamPrefix+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamPrefix:], n)
+	return nonce
+}
+
+type streamReader struct {
+	k      *Key
+	r      *bufio.Reader
+	prefix []byte
+	n      uint32
+	buf    []byte
+	done   bool
+}
+
+// NewReader decrypts a stream written by NewWriter. A stream sealed under
+// another key fails with ErrWrongKey.
+func (k *Key) NewReader(r io.Reader) (io.Reader, error) {
+	header := make([]byte, len(streamMagic)+len(k.ID)+streamPrefix)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("not an encrypted stream")
+	}
+	if !IsStream(header) {
+		return nil, errors.New("not an encrypted stream")
+	}
+	if string(header[len(streamMagic):len(streamMagic)+len(k.ID)]) != k.ID {
+		return nil, ErrWrongKey
+	}
+	return &streamReader{k: k, r: bufio.NewReader(r), prefix: header[len(header)-streamPrefix:]}, nil
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *streamReader) next() error {
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(s.r, head); err != nil {
+		return ErrTruncated
+	}
+	size := binary.BigEndian.Uint32(head[1:])
+	if size > streamChunk+uint32(s.k.aead.Overhead()) {
+		return errors.New("malformed encrypted stream")
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(s.r, sealed); err != nil {
+		return ErrTruncated
+	}
+	plain, err := s.k.aead.Open(nil, streamNonce(s.prefix, s.n), sealed, head[:1])
+	if err != nil {
+		return err
+	}
+	s.n++
+	s.buf = plain
+	s.done = head[0] == 1
+	return nil
+}
+
+// NewWriter encrypts into w under the current KEK.
+func NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return current.NewWriter(w)
+}
+
+// NewReader decrypts r with the current KEK.
+func NewReader(r io.Reader) (io.Reader, error) {
+	return current.NewReader(r)
+}
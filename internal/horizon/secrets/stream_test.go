@@ -0,0 +1,150 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testKey(t *testing.T) *Key {
+	t.Helper()
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKey(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// seal encrypts data as one stream under k.
+func seal(t *testing.T, k *Key, data []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	w, err := k.NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// open decrypts a whole stream under k.
+func open(k *Key, stream []byte) ([]byte, error) {
+	r, err := k.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	k := testKey(t)
+	for _, size := range []int{0, 1, streamChunk - 1, streamChunk, streamChunk + 1, 3*streamChunk + 17} {
+		data := make([]byte, size)
+		rand.Read(data)
+		stream := seal(t, k, data)
+		if !IsStream(stream) {
+			t.Fatalf("%d bytes: IsStream = false", size)
+		}
+		if size > 0 && bytes.Contains(stream, data) {
+			t.Fatalf("%d bytes: plaintext in stream", size)
+		}
+		got, err := open(k, stream)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: round trip changed the data", size)
+		}
+	}
+}
+
+func TestStreamSmallWrites(t *testing.T) {
+	k := testKey(t)
+	data := make([]byte, 2*streamChunk+5)
+	rand.Read(data)
+
+	var out bytes.Buffer
+	w, err := k.NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rest := data; len(rest) > 0; {
+		n := min(len(rest), 1000)
+		if _, err := w.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := open(k, out.Bytes())
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("round trip of small writes failed: %v", err)
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	k := testKey(t)
+	data := make([]byte, 2*streamChunk+100)
+	rand.Read(data)
+	stream := seal(t, k, data)
+	header := len(streamMagic) + len(k.ID) + streamPrefix
+	chunk := 5 + streamChunk + k.aead.Overhead()
+
+	for _, tc := range []struct {
+		name string
+		cut  int
+	}{
+		{"header only", header},
+		{"inside a chunk header", header + 3},
+		{"inside a chunk", header + chunk/2},
+		{"at a chunk boundary", header + chunk},
+		{"before the final chunk", header + 2*chunk},
+		{"last byte missing", len(stream) - 1},
+	} {
+		_, err := open(k, stream[:tc.cut])
+		if !errors.Is(err, ErrTruncated) {
+			t.Errorf("%s: err = %v, want ErrTruncated", tc.name, err)
+		}
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	stream := seal(t, testKey(t), []byte("backup"))
+	if _, err := testKey(t).NewReader(bytes.NewReader(stream)); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("err = %v, want ErrWrongKey", err)
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	k := testKey(t)
+	stream := seal(t, k, []byte("backup"))
+	stream[len(stream)-1] ^= 1
+	if _, err := open(k, stream); err == nil {
+		t.Fatal("tampered stream was accepted")
+	}
+}
+
+func TestStreamNotAStream(t *testing.T) {
+	k := testKey(t)
+	for _, data := range [][]byte{nil, []byte("SQLite format 3\x00 and some more bytes")} {
+		if IsStream(data) {
+			t.Errorf("IsStream(%q) = true", data)
+		}
+		if _, err := k.NewReader(bytes.NewReader(data)); err == nil {
+			t.Errorf("NewReader(%q) accepted it", data)
+		}
+	}
+}
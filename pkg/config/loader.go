@@ -9,6 +9,8 @@ type User struct {
 	UUID       string  `json:"uuid"`
 	LimitGB    float64 `json:"limit_gb"`              // 0 = Unlimited, Supports decimals (e.g. 0.12)
 	UsageBytes int64   `json:"usage_bytes"`           // Exact byte count
+	Uplink     int64   `json:"uplink,omitempty"`      // Part of UsageBytes sent by the user
+	Downlink   int64   `json:"downlink,omitempty"`    // Part of UsageBytes received by the user
 	HardwareID string  `json:"hardware_id,omitempty"` // Device Lock
 }
 
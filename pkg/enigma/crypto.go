@@ -1,10 +1,13 @@
 package enigma
 
 import (
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"io"
+	"strings"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -66,3 +69,10 @@ func Open(b64Ciphertext string, key []byte) ([]byte, error) {
 
 	return plaintext, nil
 }
+
+// DeriveKey derives a 32-byte subkey from secret, bound to the given context
+// strings (e.g. a purpose and a device ID) with HKDF-SHA256.
+func DeriveKey(secret []byte, context ...string) ([]byte, error) {
+	info := strings.Join(context, "\x00")
+	return hkdf.Key(sha256.New, secret, nil, info, chacha20poly1305.KeySize)
+}
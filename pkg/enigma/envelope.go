@@ -0,0 +1,169 @@
+package enigma
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Envelope v2
+//
+// Seal/Open (v1) only encrypt the body. A v2 message carries a header that is
+// authenticated along with the request it belongs to:
+//
+//	base64( 0x02 | len(kid) | kid | timestamp (8, unix seconds) | nonce (24) | ciphertext )
+//
+// The AEAD associated data is the header followed by the binding, normally
+// Binding(method, path), so a message cannot be moved to another endpoint.
+// The timestamp and nonce let the receiver reject replays with a ReplayCache.
+
+const Version2 = 2
+
+var (
+	ErrMalformed = errors.New("enigma: malformed message")
+	ErrVersion   = errors.New("enigma: unsupported version")
+	ErrStale     = errors.New("enigma: timestamp outside window")
+	ErrReplay    = errors.New("enigma: replayed message")
+)
+
+// Header is the authenticated, unencrypted part of a v2 message.
+type Header struct {
+	Version   byte
+	KeyID     string
+	Timestamp int64
+	Nonce     []byte
+}
+
+func (h Header) marshal() []byte {
+	b := make([]byte, 0, 2+len(h.KeyID)+8+len(h.Nonce))
+	b = append(b, h.Version, byte(len(h.KeyID)))
+	b = append(b, h.KeyID...)
+	b = binary.BigEndian.AppendUint64(b, uint64(h.Timestamp))
+	return append(b, h.Nonce...)
+}
+
+// Binding returns the associated data that ties a message to one endpoint.
+func Binding(method, path string) string {
+	return method + " " + path
+}
+
+// SealV2 encrypts plaintext into a v2 envelope bound to binding.
+func SealV2(plaintext, key []byte, keyID, binding string) (string, error) {
+	if len(keyID) > 255 {
+		return "", errors.New("enigma: key id too long")
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return "", err
+	}
+
+	h := Header{Version: Version2, KeyID: keyID, Timestamp: time.Now().Unix(), Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(h.Nonce); err != nil {
+		return "", err
+	}
+
+	header := h.marshal()
+	aad := append(append([]byte{}, header...), binding...)
+	out := aead.Seal(header, h.Nonce, plaintext, aad)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// ParseHeader reads the header of a v2 message without decrypting it, so the
+// receiver can pick the key named by KeyID.
+func ParseHeader(message string) (Header, error) {
+	h, _, err := parseV2(message)
+	return h, err
+}
+
+func parseV2(message string) (Header, []byte, error) {
+	data, err := base64.StdEncoding.DecodeString(message)
+	if err != nil || len(data) < 2 {
+		return Header{}, nil, ErrMalformed
+	}
+	if data[0] != Version2 {
+		return Header{}, nil, ErrVersion
+	}
+	kidLen := int(data[1])
+	headerLen := 2 + kidLen + 8 + chacha20poly1305.NonceSizeX
+	if len(data) < headerLen+chacha20poly1305.Overhead {
+		return Header{}, nil, ErrMalformed
+	}
+
+	h := Header{
+		Version:   data[0],
+		KeyID:     string(data[2 : 2+kidLen]),
+		Timestamp: int64(binary.BigEndian.Uint64(data[2+kidLen:])),
+		Nonce:     data[2+kidLen+8 : headerLen],
+	}
+	return h, data, nil
+}
+
+// OpenV2 decrypts a v2 envelope and verifies it was sealed for binding.
+// Freshness is up to the caller (see ReplayCache).
+func OpenV2(message string, key []byte, binding string) ([]byte, Header, error) {
+	h, data, err := parseV2(message)
+	if err != nil {
+		return nil, Header{}, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, Header{}, err
+	}
+
+	headerLen := 2 + len(h.KeyID) + 8 + len(h.Nonce)
+	aad := append(append([]byte{}, data[:headerLen]...), binding...)
+	plaintext, err := aead.Open(nil, h.Nonce, data[headerLen:], aad)
+	if err != nil {
+		return nil, Header{}, err
+	}
+	return plaintext, h, nil
+}
+
+// ReplayCache remembers the nonces seen within a sliding time window.
+// Messages older or newer than the window are rejected outright, so a nonce
+// only has to be kept for as long as its message could still be accepted.
+type ReplayCache struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]int64 // nonce -> timestamp
+	last int64            // Last sweep
+}
+
+func NewReplayCache(window time.Duration) *ReplayCache {
+	return &ReplayCache{window: window, seen: make(map[string]int64)}
+}
+
+// Check accepts a header once: it must be within the window and its nonce
+// must not have been seen before.
+func (c *ReplayCache) Check(h Header) error {
+	now := time.Now().Unix()
+	window := int64(c.window / time.Second)
+	if h.Timestamp < now-window || h.Timestamp > now+window {
+		return ErrStale
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now-c.last >= window {
+		for nonce, ts := range c.seen {
+			if ts < now-window {
+				delete(c.seen, nonce)
+			}
+		}
+		c.last = now
+	}
+
+	nonce := string(h.Nonce)
+	if _, ok := c.seen[nonce]; ok {
+		return ErrReplay
+	}
+	c.seen[nonce] = h.Timestamp
+	return nil
+}
@@ -0,0 +1,72 @@
+package enigma
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Handshake
+//
+// The server publishes a static X25519 public key. For each request the client
+// generates an ephemeral key pair, sends the ephemeral public key alongside
+// the sealed body, and both sides derive the session key as
+//
+//	HKDF-SHA256(X25519(priv, peerPub), info = "enigma-session" | ephemeralPub | serverPub)
+//
+// The response is sealed with the same session key. Nothing secret ships in
+// the client binary.
+
+const sessionInfo = "enigma-session"
+
+// GenerateKeyPair returns a new X25519 private and public key.
+func GenerateKeyPair() (priv, pub []byte, err error) {
+	priv = make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(priv); err != nil {
+		return nil, nil, err
+	}
+	pub, err = curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return priv, pub, nil
+}
+
+// PublicKey returns the X25519 public key for priv.
+func PublicKey(priv []byte) ([]byte, error) {
+	return curve25519.X25519(priv, curve25519.Basepoint)
+}
+
+func sessionKey(priv, peerPub, ephemeralPub, serverPub []byte) ([]byte, error) {
+	if len(peerPub) != curve25519.PointSize {
+		return nil, errors.New("invalid public key")
+	}
+	shared, err := curve25519.X25519(priv, peerPub)
+	if err != nil {
+		return nil, err
+	}
+	info := sessionInfo + string(ephemeralPub) + string(serverPub)
+	return hkdf.Key(sha256.New, shared, nil, info, chacha20poly1305.KeySize)
+}
+
+// ClientSessionKey derives the session key on the client side.
+func ClientSessionKey(ephemeralPriv, serverPub []byte) ([]byte, error) {
+	ephemeralPub, err := PublicKey(ephemeralPriv)
+	if err != nil {
+		return nil, err
+	}
+	return sessionKey(ephemeralPriv, serverPub, ephemeralPub, serverPub)
+}
+
+// ServerSessionKey derives the session key on the server side.
+func ServerSessionKey(serverPriv, ephemeralPub []byte) ([]byte, error) {
+	serverPub, err := PublicKey(serverPriv)
+	if err != nil {
+		return nil, err
+	}
+	return sessionKey(serverPriv, ephemeralPub, ephemeralPub, serverPub)
+}
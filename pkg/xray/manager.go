@@ -39,6 +39,38 @@ type Inbound struct {
 
 // ... (Rest of structs) ...
 
+// Traffic holds cumulative per-direction byte counters
+type Traffic struct {
+	Uplink   int64
+	Downlink int64
+}
+
+// GetUserTraffic returns the cumulative traffic per user, split by direction
+func (m *Manager) GetUserTraffic() (map[string]Traffic, error) {
+	cmd := exec.Command(m.binPath, "api", "statsquery", "--server=127.0.0.1:10085")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stats: %v. Output: %s", err, string(output))
+	}
+
+	trafficMap := make(map[string]Traffic)
+	lines := strings.Split(string(output), "\n")
+	for _, line := range lines {
+		parts := strings.Split(line, " >>> ")
+		if len(parts) >= 5 && parts[0] == "user" && parts[2] == "traffic" {
+			value, _ := strconv.ParseInt(strings.TrimSpace(parts[4]), 10, 64)
+			t := trafficMap[parts[1]]
+			if parts[3] == "uplink" {
+				t.Uplink += value
+			} else {
+				t.Downlink += value
+			}
+			trafficMap[parts[1]] = t
+		}
+	}
+	return trafficMap, nil
+}
+
 // Helper function to query stats
 func (m *Manager) GetStats() (map[string]int64, error) {
 	// Execute: xray api statsquery --server=127.0.0.1:10085
@@ -64,6 +96,30 @@ func (m *Manager) GetStats() (map[string]int64, error) {
 	return usageMap, nil
 }
 
+// GetInboundStats returns the cumulative traffic per inbound tag
+// Pattern: inbound >>> [tag] >>> traffic >>> [downlink|uplink] >>> [value]
+func (m *Manager) GetInboundStats() (map[string]int64, error) {
+	cmd := exec.Command(m.binPath, "api", "statsquery", "--server=127.0.0.1:10085")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query stats: %v. Output: %s", err, string(output))
+	}
+
+	usageMap := make(map[string]int64)
+	lines := strings.Split(string(output), "\n")
+	for _, line := range lines {
+		parts := strings.Split(line, " >>> ")
+		if len(parts) >= 5 && parts[0] == "inbound" && parts[2] == "traffic" {
+			if parts[1] == "api" {
+				continue // Internal stats inbound
+			}
+			value, _ := strconv.ParseInt(strings.TrimSpace(parts[4]), 10, 64)
+			usageMap[parts[1]] += value
+		}
+	}
+	return usageMap, nil
+}
+
 type SniffingConfig struct {
 	Enabled      bool     `json:"enabled"`
 	DestOverride []string `json:"destOverride"`
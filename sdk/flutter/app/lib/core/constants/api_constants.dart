@@ -1,6 +1,6 @@
 class ApiConstants {
   // Use 10.0.2.2 for Android Emulator to access host machine (localhost)
   // For real device, replace with your machine's LAN IP
-  static const String baseUrl = "http://10.0.2.2:8081/api/v1/secure";
+  static const String baseUrl = "http://10.0.2.2:8080/api/v1/secure";
   static const String vpnAddress = "10.0.2.2:4242";
 }
@@ -33,9 +33,11 @@ class _SplashScreenState extends State<SplashScreen> {
 
     // 2. Verify with Backend Securely
     try {
+       final hwId = await AetherClient.getHardwareId();
        final payload = jsonEncode({
          "action": "get_config",
-         "user_uuid": uuid
+         "user_uuid": uuid,
+         "hardware_id": hwId
        });
        
        // Use Full URL from Constants
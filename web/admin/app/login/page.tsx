@@ -0,0 +1,65 @@
+"use client"
+
+import { useState } from "react"
+import { useRouter } from "next/navigation"
+import { Card } from "@/components/ui/card"
+import { Button } from "@/components/ui/button"
+import { Input } from "@/components/ui/input"
+import { Label } from "@/components/ui/label"
+
+export default function LoginPage() {
+    const router = useRouter()
+    const [username, setUsername] = useState("")
+    const [password, setPassword] = useState("")
+    const [code, setCode] = useState("")
+    const [needCode, setNeedCode] = useState(false)
+    const [error, setError] = useState("")
+    const [loading, setLoading] = useState(false)
+
+    const login = async (e: React.FormEvent) => {
+        e.preventDefault()
+        setLoading(true)
+        setError("")
+        const res = await fetch('/api/auth/login', {
+            method: 'POST',
+            body: JSON.stringify({ username, password, code }),
+        })
+        setLoading(false)
+        if (res.headers.get('X-Horizon-MFA') === 'required') {
+            setNeedCode(true)
+        }
+        if (!res.ok) {
+            setError((await res.text()).trim() || 'Login failed')
+            return
+        }
+        router.push('/')
+    }
+
+    return (
+        <div className="flex min-h-screen items-center justify-center p-6">
+            <Card className="w-full max-w-sm p-6">
+                <h1 className="text-2xl font-bold mb-6">Sign in to Horizon</h1>
+                <form onSubmit={login} className="space-y-4">
+                    <div className="space-y-2">
+                        <Label htmlFor="username">Username</Label>
+                        <Input id="username" autoComplete="username" value={username} onChange={(e) => setUsername(e.target.value)} />
+                    </div>
+                    <div className="space-y-2">
+                        <Label htmlFor="password">Password</Label>
+                        <Input id="password" type="password" autoComplete="current-password" value={password} onChange={(e) => setPassword(e.target.value)} />
+                    </div>
+                    {needCode && (
+                        <div className="space-y-2">
+                            <Label htmlFor="code">Authentication code</Label>
+                            <Input id="code" autoComplete="one-time-code" inputMode="numeric" placeholder="123456 or recovery code" value={code} onChange={(e) => setCode(e.target.value)} autoFocus />
+                        </div>
+                    )}
+                    {error && <p className="text-sm text-red-500">{error}</p>}
+                    <Button type="submit" className="w-full" disabled={loading}>
+                        {loading ? 'Signing in...' : 'Sign in'}
+                    </Button>
+                </form>
+            </Card>
+        </div>
+    )
+}
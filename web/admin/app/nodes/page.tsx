@@ -28,6 +28,7 @@ import {
 } from "@/components/ui/alert-dialog"
 import { Textarea } from "@/components/ui/textarea"
 import { Plus, Server, Pencil, Trash2, Settings } from "lucide-react"
+import { fetchWithStepUp } from "@/lib/stepup"
 
 export default function NodesPage() {
     const [nodes, setNodes] = useState([])
@@ -130,7 +131,8 @@ export default function NodesPage() {
     }
 
     const handleDeleteNode = async () => {
-        await fetch(`/api/nodes?id=${selectedNode.id}`, { method: 'DELETE' })
+        const res = await fetchWithStepUp(`/api/nodes?id=${selectedNode.id}`, { method: 'DELETE' })
+        if (!res.ok) alert(`Error removing node: ${await res.text()}`)
         setDeleteDialogOpen(false)
         fetchNodes()
     }
@@ -139,8 +141,15 @@ export default function NodesPage() {
     const [baseConfig, setBaseConfig] = useState("")
 
     const [deployDialogOpen, setDeployDialogOpen] = useState(false)
-    const openDeployDialog = (node: any) => {
-        setSelectedNode(node)
+    const openDeployDialog = async (node: any) => {
+        // The node list leaves master keys out; revealing one needs a step-up
+        const res = await fetchWithStepUp(`/api/nodes/${node.id}/master-key`)
+        if (!res.ok) {
+            alert(`Error loading master key: ${await res.text()}`)
+            return
+        }
+        const { master_key } = await res.json()
+        setSelectedNode({ ...node, master_key })
         setDeployDialogOpen(true)
     }
     const deployCommand = selectedNode ? `curl -fsSL https://get.horizon/install.sh | sudo bash -s -- --key ${selectedNode.master_key} --port 8081` : ""
@@ -1,8 +1,8 @@
 "use client"
 
-import { LayoutDashboard, Users, Server, Settings, Globe, Layers, Smartphone, Activity, Copy } from "lucide-react"
+import { LayoutDashboard, Users, Server, Settings, Globe, Layers, Smartphone, Activity, Copy, LogOut } from "lucide-react"
 import Link from "next/link"
-import { usePathname } from "next/navigation"
+import { usePathname, useRouter } from "next/navigation"
 
 import { cn } from "@/lib/utils"
 
@@ -19,6 +19,14 @@ const routes = [
 
 export function Sidebar() {
   const pathname = usePathname()
+  const router = useRouter()
+
+  if (pathname === "/login") return null
+
+  const logout = async () => {
+    await fetch('/api/auth/logout', { method: 'POST' })
+    router.push('/login')
+  }
 
   return (
     <div className="flex min-h-screen w-64 flex-col border-r bg-zinc-950 text-white">
@@ -48,6 +56,13 @@ export function Sidebar() {
         })}
       </nav>
       <div className="p-4 border-t border-zinc-900">
+        <button
+          onClick={logout}
+          className="flex w-full items-center px-3 py-2 mb-2 text-sm font-medium rounded-md text-zinc-400 hover:bg-zinc-900 hover:text-white"
+        >
+          <LogOut className="mr-3 h-5 w-5" />
+          Sign out
+        </button>
         <div className="text-xs text-zinc-500">Aether v2.0.0</div>
       </div>
     </div>
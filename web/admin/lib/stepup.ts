@@ -0,0 +1,25 @@
+// Sensitive API calls answer 403 with X-Horizon-Step-Up: required when the
+// session hasn't been verified recently. Ask for a code (or the password
+// without 2FA), verify, and retry once.
+export async function fetchWithStepUp(input: string, init?: RequestInit): Promise<Response> {
+    const res = await fetch(input, init)
+    if (res.status !== 403 || res.headers.get('X-Horizon-Step-Up') !== 'required') {
+        return res
+    }
+
+    const status = await fetch('/api/auth/2fa').then(r => r.json()).catch(() => ({}))
+    const answer = window.prompt(status.enabled
+        ? 'Enter your authentication or recovery code to continue'
+        : 'Enter your password to continue')
+    if (!answer) {
+        return res
+    }
+    const verify = await fetch('/api/auth/verify', {
+        method: 'POST',
+        body: JSON.stringify(status.enabled ? { code: answer } : { password: answer }),
+    })
+    if (!verify.ok) {
+        return verify
+    }
+    return fetch(input, init)
+}
@@ -0,0 +1,15 @@
+import { NextResponse, type NextRequest } from "next/server"
+
+// Send visitors without a Horizon session to the login page. The backend
+// still checks the session on every /api call; this only saves a round of
+// failed requests.
+export function proxy(request: NextRequest) {
+  if (!request.cookies.has("horizon_session")) {
+    return NextResponse.redirect(new URL("/login", request.url))
+  }
+  return NextResponse.next()
+}
+
+export const config = {
+  matcher: ["/((?!login|api|sub|_next|favicon.ico).*)"],
+}